@@ -1,11 +1,30 @@
 package api
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"go-note/auditlog"
+	"go-note/jwtkeys"
+	"go-note/limiter"
+	"go-note/mailer"
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/oidc"
+	"go-note/service/admin"
+	"go-note/service/audit"
 	"go-note/service/auth"
 	"go-note/service/note"
+	"go-note/service/notebook"
+	"go-note/service/tag"
+	"go-note/service/user"
+	"go-note/service/workspace"
+	"go-note/utils"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -26,15 +45,318 @@ func (s *APIServer) Run() error {
 	router := mux.NewRouter()
 	subrouter := router.PathPrefix("/api/v1").Subrouter()
 
+	accessTTL, err := utils.GetEnvDuration("ACCESS_TOKEN_TTL", auth.DefaultAccessTokenTTL)
+	if err != nil {
+		return err
+	}
+	refreshTTL, err := utils.GetEnvDuration("REFRESH_TOKEN_TTL", auth.DefaultRefreshTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	resetTTL, err := utils.GetEnvDuration("PASSWORD_RESET_TTL", auth.DefaultResetTokenTTL)
+	if err != nil {
+		return err
+	}
+	mail, err := newMailer()
+	if err != nil {
+		return err
+	}
+
+	verifyPolicy := os.Getenv("EMAIL_VERIFICATION")
+	switch verifyPolicy {
+	case "":
+		verifyPolicy = models.VerifyPolicyNotes
+	case models.VerifyPolicyOff, models.VerifyPolicyNotes, models.VerifyPolicyLogin:
+	default:
+		return fmt.Errorf("EMAIL_VERIFICATION must be off, notes or login, got %q", verifyPolicy)
+	}
+	verifyTTL, err := utils.GetEnvDuration("EMAIL_VERIFICATION_TTL", auth.DefaultVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	keys, err := loadKeySet()
+	if err != nil {
+		return err
+	}
+	middlewares.SetKeySet(keys)
+
+	accountLimiter, ipLimiter, err := s.newLoginLimiters()
+	if err != nil {
+		return err
+	}
+	utils.SetTrustProxy(os.Getenv("TRUST_PROXY") == "true")
+
+	auditBuffer, err := utils.GetEnvInt("AUDIT_BUFFER_SIZE", auditlog.DefaultBufferSize)
+	if err != nil {
+		return err
+	}
+	auditStore := audit.NewStore(s.db)
+	auditLog := auditlog.NewAsync(auditStore, auditBuffer, log.Writer())
+	defer auditLog.Close()
+
+	mailQueueSize, err := utils.GetEnvInt("MAIL_QUEUE_SIZE", mailer.DefaultQueueSize)
+	if err != nil {
+		return err
+	}
+	mailQueue := mailer.NewQueue(mailQueueSize)
+	defer mailQueue.Close()
+
+	totpKey, err := utils.NewSecretBox(os.Getenv("TOTP_ENCRYPTION_KEY"))
+	if err != nil {
+		return fmt.Errorf("TOTP_ENCRYPTION_KEY: %v", err)
+	}
+
 	userStore := auth.NewStore(s.db)
-	userHandler := auth.NewHandler(userStore)
+	userStore.SetSecretBox(totpKey)
+	middlewares.SetRevocationStore(userStore)
+	userHandler := auth.NewHandler(userStore, userStore, userStore)
+	userHandler.SetTokenTTLs(accessTTL, refreshTTL)
+	userHandler.SetMailer(mail)
+	userHandler.SetMailQueue(mailQueue)
+	userHandler.SetPasswordReset(os.Getenv("PASSWORD_RESET_URL"), resetTTL)
+	userHandler.SetEmailVerification(verifyPolicy, os.Getenv("EMAIL_VERIFICATION_URL"), verifyTTL)
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		userHandler.SetTwoFactorIssuer(issuer)
+	}
+	userHandler.SetLoginLimiters(accountLimiter, ipLimiter)
+	userHandler.SetKeySet(keys)
+	userHandler.SetAuditRecorder(auditLog)
+	providers, err := oidcProviders()
+	if err != nil {
+		return err
+	}
+	if len(providers) > 0 {
+		userHandler.SetIdentityStore(userStore)
+		for name, provider := range providers {
+			userHandler.AddOIDCProvider(name, provider)
+		}
+	}
 	userHandler.RegisterRoutes(subrouter)
+	userHandler.RegisterWellKnownRoutes(router)
+
+	accountStore := user.NewStore(s.db)
+	middlewares.SetPersonalTokenStore(accountStore)
+	accountHandler := user.NewHandler(accountStore, accountStore, accountStore, accountStore)
+	userHandler.SetSessionStore(accountStore)
+	accountHandler.SetAuditRecorder(auditLog)
+	accountHandler.RegisterRoutes(subrouter)
+
+	auditHandler := audit.NewHandler(auditStore)
+	auditHandler.RegisterRoutes(subrouter)
+
+	revisionLimit, err := utils.GetEnvInt("NOTE_REVISION_LIMIT", note.DefaultRevisionLimit)
+	if err != nil {
+		return err
+	}
 
 	noteStore := note.NewStore(s.db)
+	noteStore.SetRevisionLimit(revisionLimit)
 	noteHandler := note.NewHandler(noteStore)
+	noteHandler.SetRequireIfMatch(os.Getenv("REQUIRE_IF_MATCH") == "true")
+	noteHandler.SetRequireVerifiedEmail(verifyPolicy != models.VerifyPolicyOff)
+	noteHandler.SetAuditRecorder(auditLog)
+	linkLimiter, err := s.newLinkLimiter()
+	if err != nil {
+		return err
+	}
+	noteHandler.SetLinkLimiter(linkLimiter)
 	noteHandler.RegisterRoutes(subrouter)
+	noteHandler.RegisterPublicRoutes(subrouter)
+
+	retention, err := utils.GetEnvDuration("TRASH_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	purgeInterval, err := utils.GetEnvDuration("TRASH_PURGE_INTERVAL", time.Hour)
+	if err != nil {
+		return err
+	}
+	note.StartPurger(context.Background(), noteStore, retention, purgeInterval)
+
+	notebookStore := notebook.NewStore(s.db)
+	notebookHandler := notebook.NewHandler(notebookStore)
+	notebookHandler.RegisterRoutes(subrouter)
+
+	inviteTTL, err := utils.GetEnvDuration("WORKSPACE_INVITE_TTL", workspace.DefaultInvitationTTL)
+	if err != nil {
+		return err
+	}
+	workspaceStore := workspace.NewStore(s.db)
+	workspaceHandler := workspace.NewHandler(workspaceStore)
+	workspaceHandler.SetMailer(mail)
+	workspaceHandler.SetMailQueue(mailQueue)
+	workspaceHandler.SetInvitations(os.Getenv("WORKSPACE_INVITE_URL"), inviteTTL)
+	workspaceHandler.SetAuditRecorder(auditLog)
+	workspaceHandler.RegisterRoutes(subrouter)
+
+	tagStore := tag.NewStore(s.db)
+	tagHandler := tag.NewHandler(tagStore)
+	tagHandler.RegisterRoutes(subrouter)
+
+	adminRouter := subrouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(middlewares.JWTMiddleware, middlewares.RequireRole(models.RoleAdmin))
+	adminHandler := admin.NewHandler()
+	adminHandler.RegisterRoutes(adminRouter)
+
+	accountHandler.RegisterAdminRoutes(adminRouter)
+	auditHandler.RegisterAdminRoutes(adminRouter)
 
 	log.Println("Listening on", s.addr)
 
 	return http.ListenAndServe(s.addr, router)
 }
+
+// newMailer picks the mail backend from MAIL_DRIVER: "smtp" delivers through
+// SMTP_HOST, anything else writes emails to MAIL_LOG_FILE or the log.
+func newMailer() (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	if os.Getenv("MAIL_DRIVER") == "smtp" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return mailer.NewSMTPMailer(os.Getenv("SMTP_HOST"), port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from), nil
+	}
+
+	path := os.Getenv("MAIL_LOG_FILE")
+	if path == "" {
+		return mailer.NewLogMailer(log.Writer(), from), nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return mailer.NewLogMailer(f, from), nil
+}
+
+// newLoginLimiters builds the failed-login limiters per account and per IP.
+// LOGIN_LIMITER=postgres shares attempts between instances through the
+// database; anything else keeps them in memory.
+func (s *APIServer) newLoginLimiters() (limiter.Limiter, limiter.Limiter, error) {
+	account := limiter.DefaultAccountPolicy
+	ip := limiter.DefaultIPPolicy
+
+	var err error
+	if account.Threshold, err = utils.GetEnvInt("LOGIN_MAX_FAILURES", account.Threshold); err != nil {
+		return nil, nil, err
+	}
+	if ip.Threshold, err = utils.GetEnvInt("LOGIN_IP_MAX_FAILURES", ip.Threshold); err != nil {
+		return nil, nil, err
+	}
+	if account.MaxDelay, err = utils.GetEnvDuration("LOGIN_MAX_LOCKOUT", account.MaxDelay); err != nil {
+		return nil, nil, err
+	}
+	ip.MaxDelay = account.MaxDelay
+
+	accountLimiter, err := s.newLimiter("LOGIN_LIMITER", "account", account)
+	if err != nil {
+		return nil, nil, err
+	}
+	ipLimiter, err := s.newLimiter("LOGIN_LIMITER", "ip", ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return accountLimiter, ipLimiter, nil
+}
+
+// newLinkLimiter builds the limiter of wrong public link passwords, with
+// its own LINK_LIMITER backend.
+func (s *APIServer) newLinkLimiter() (limiter.Limiter, error) {
+	policy := limiter.DefaultLinkPolicy
+
+	var err error
+	if policy.Threshold, err = utils.GetEnvInt("LINK_MAX_FAILURES", policy.Threshold); err != nil {
+		return nil, err
+	}
+	if policy.MaxDelay, err = utils.GetEnvDuration("LINK_MAX_LOCKOUT", policy.MaxDelay); err != nil {
+		return nil, err
+	}
+
+	return s.newLimiter("LINK_LIMITER", "link", policy)
+}
+
+// newLimiter builds a limiter with policy from the backend named by the
+// driverEnv variable. postgres shares attempts between instances through
+// the database under scope, pruning expired ones; anything else keeps them
+// in memory.
+func (s *APIServer) newLimiter(driverEnv, scope string, policy limiter.Policy) (limiter.Limiter, error) {
+	switch driver := os.Getenv(driverEnv); driver {
+	case "", "memory":
+		return limiter.NewMemory(policy), nil
+	case "postgres":
+		l := limiter.NewPostgres(s.db, scope, policy)
+		l.StartPruner(context.Background())
+		return l, nil
+	default:
+		return nil, fmt.Errorf("%s must be memory or postgres, got %q", driverEnv, driver)
+	}
+}
+
+// loadKeySet reads the token signing key from JWT_SIGNING_KEY_FILE and the
+// retired keys still accepted during a rotation from the comma-separated
+// JWT_VERIFY_KEY_FILES. Running without a signing key is an error.
+func loadKeySet() (*jwtkeys.KeySet, error) {
+	issuer := os.Getenv("JWT_ISSUER")
+	if issuer == "" {
+		issuer = "go-note"
+	}
+	audience := os.Getenv("JWT_AUDIENCE")
+	if audience == "" {
+		audience = "go-note-api"
+	}
+
+	var verifyFiles []string
+	for _, file := range strings.Split(os.Getenv("JWT_VERIFY_KEY_FILES"), ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			verifyFiles = append(verifyFiles, file)
+		}
+	}
+
+	keys, err := jwtkeys.Load(issuer, audience, os.Getenv("JWT_SIGNING_KEY_FILE"), verifyFiles)
+	if err != nil {
+		return nil, fmt.Errorf("loading JWT keys: %v", err)
+	}
+
+	return keys, nil
+}
+
+// oidcProviders configures an OpenID Connect provider for each name in the
+// comma-separated OIDC_PROVIDERS from OIDC_<NAME>_ISSUER, _CLIENT_ID,
+// _CLIENT_SECRET, _REDIRECT_URL, _SCOPES (space-separated) and
+// _ALLOW_SIGNUP.
+func oidcProviders() (map[string]*oidc.Provider, error) {
+	providers := make(map[string]*oidc.Provider)
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		cfg := oidc.Config{
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+			AllowSignup:  os.Getenv(prefix+"ALLOW_SIGNUP") == "true",
+		}
+		if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			return nil, fmt.Errorf("%sISSUER, %sCLIENT_ID and %sREDIRECT_URL are required", prefix, prefix, prefix)
+		}
+
+		providers[name] = oidc.NewProvider(cfg, nil)
+	}
+
+	return providers, nil
+}
@@ -0,0 +1,119 @@
+package auditlog
+
+import (
+	"fmt"
+	"go-note/models"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// DefaultBufferSize is how many events Async holds while storage catches up.
+const DefaultBufferSize = 1024
+
+// maxBatch caps how many buffered events are stored in one write.
+const maxBatch = 100
+
+// Writer persists batches of audit events.
+type Writer interface {
+	CreateAuditEvents(events []*models.AuditEvent) error
+}
+
+// Async hands events to a background goroutine that stores them in batches,
+// so a slow or unavailable database never delays a request. Events that do
+// not fit in the buffer or fail to store are written to fallback instead of
+// being lost silently.
+type Async struct {
+	writer   Writer
+	fallback *LogRecorder
+	// mu keeps Close from closing events while Record is sending to it.
+	mu     sync.RWMutex
+	closed bool
+	events chan *models.AuditEvent
+	done   chan struct{}
+}
+
+// NewAsync starts storing events through writer until Close is called.
+func NewAsync(writer Writer, buffer int, fallback io.Writer) *Async {
+	a := &Async{
+		writer:   writer,
+		fallback: NewLogRecorder(fallback),
+		events:   make(chan *models.AuditEvent, buffer),
+		done:     make(chan struct{}),
+	}
+	go a.run()
+
+	return a
+}
+
+func (a *Async) Record(r *http.Request, e *models.AuditEvent) {
+	stamp(r, e)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		a.fallback.Record(nil, e)
+		return
+	}
+
+	select {
+	case a.events <- e:
+	default:
+		a.fallback.Record(nil, e)
+	}
+}
+
+// Close stores the events still buffered and stops the goroutine. Events
+// recorded afterwards go to the fallback.
+func (a *Async) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.events)
+	}
+	a.mu.Unlock()
+
+	<-a.done
+}
+
+func (a *Async) run() {
+	defer close(a.done)
+
+	for e := range a.events {
+		a.write(a.batch(e))
+	}
+}
+
+// batch collects first and whatever else is already buffered, up to
+// maxBatch events.
+func (a *Async) batch(first *models.AuditEvent) []*models.AuditEvent {
+	events := []*models.AuditEvent{first}
+	for len(events) < maxBatch {
+		select {
+		case e, ok := <-a.events:
+			if !ok {
+				return events
+			}
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+
+	return events
+}
+
+func (a *Async) write(events []*models.AuditEvent) {
+	err := a.writer.CreateAuditEvents(events)
+	if err == nil {
+		return
+	}
+
+	a.fallback.mu.Lock()
+	fmt.Fprintf(a.fallback.w, "audit: storing %d events failed: %v\n", len(events), err)
+	a.fallback.mu.Unlock()
+	for _, e := range events {
+		a.fallback.Record(nil, e)
+	}
+}
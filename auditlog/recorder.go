@@ -0,0 +1,71 @@
+package auditlog
+
+import (
+	"fmt"
+	"go-note/models"
+	"go-note/utils"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recorder adds events to the security audit log. Record must not block on
+// storage: it is called on the request path, including logins.
+type Recorder interface {
+	// Record stamps e with the client address and user agent of r, when r is
+	// not nil, and the current time before recording it.
+	Record(r *http.Request, e *models.AuditEvent)
+}
+
+func stamp(r *http.Request, e *models.AuditEvent) {
+	if r != nil {
+		e.IP = utils.ClientIP(r)
+		e.UserAgent = r.UserAgent()
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+}
+
+// LogRecorder writes events to w as single lines instead of storing them,
+// for local development and tests.
+type LogRecorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewLogRecorder(w io.Writer) *LogRecorder {
+	return &LogRecorder{w: w}
+}
+
+func (l *LogRecorder) Record(r *http.Request, e *models.AuditEvent) {
+	stamp(r, e)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.w, format(e))
+}
+
+// format renders e as one line of key=value pairs, details sorted by key.
+func format(e *models.AuditEvent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "audit: %s action=%s actor=%d user=%d", e.CreatedAt.Format(time.RFC3339), e.Action, e.ActorID, e.UserID)
+	if e.Target != "" {
+		fmt.Fprintf(&b, " target=%s", e.Target)
+	}
+	fmt.Fprintf(&b, " ip=%q user_agent=%q", e.IP, e.UserAgent)
+
+	keys := make([]string, 0, len(e.Details))
+	for k := range e.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%q", k, e.Details[k])
+	}
+
+	return b.String()
+}
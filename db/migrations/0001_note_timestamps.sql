@@ -0,0 +1,8 @@
+-- Timestamps used for sorting and filtering note listings.
+ALTER TABLE notes
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS notes_user_created_idx ON notes (user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS notes_user_updated_idx ON notes (user_id, updated_at, id);
+CREATE INDEX IF NOT EXISTS notes_user_title_idx ON notes (user_id, title, id);
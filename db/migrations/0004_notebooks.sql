@@ -0,0 +1,17 @@
+-- Nested notebooks. Notes without a notebook live at the root.
+CREATE TABLE IF NOT EXISTS notebooks (
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    parent_id  INTEGER REFERENCES notebooks (id) ON DELETE CASCADE,
+    name       TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS notebooks_user_idx ON notebooks (user_id);
+CREATE INDEX IF NOT EXISTS notebooks_parent_idx ON notebooks (parent_id);
+
+ALTER TABLE notes
+    ADD COLUMN IF NOT EXISTS notebook_id INTEGER REFERENCES notebooks (id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS notes_notebook_idx ON notes (notebook_id);
@@ -0,0 +1,4 @@
+-- Deleted notes stay in the trash until restored or purged.
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS notes_deleted_idx ON notes (deleted_at) WHERE deleted_at IS NOT NULL;
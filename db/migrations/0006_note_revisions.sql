@@ -0,0 +1,11 @@
+-- Content history of notes. Revision numbers count up per note; old
+-- revisions are pruned past the configured limit.
+CREATE TABLE IF NOT EXISTS note_revisions (
+    id          SERIAL PRIMARY KEY,
+    note_id     INTEGER NOT NULL REFERENCES notes (id) ON DELETE CASCADE,
+    revision    INTEGER NOT NULL,
+    title       TEXT NOT NULL,
+    description TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (note_id, revision)
+);
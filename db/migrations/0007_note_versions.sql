@@ -0,0 +1,2 @@
+-- Bumped on every change to a note; exposed to clients as its ETag.
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,8 @@
+-- Roles known to the API: admin, member and readonly.
+UPDATE users SET role = 'member' WHERE role IS NULL OR role NOT IN ('admin', 'member', 'readonly');
+
+ALTER TABLE users
+    ALTER COLUMN role SET DEFAULT 'member',
+    ALTER COLUMN role SET NOT NULL,
+    DROP CONSTRAINT IF EXISTS users_role_check,
+    ADD CONSTRAINT users_role_check CHECK (role IN ('admin', 'member', 'readonly'));
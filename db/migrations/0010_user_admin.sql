@@ -0,0 +1,9 @@
+-- Account state managed through the admin API. Suspended users cannot log in
+-- or use their access tokens; users flagged for a password reset cannot log
+-- in until they set a new password.
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS password_reset_required BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email));
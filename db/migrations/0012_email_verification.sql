@@ -0,0 +1,13 @@
+-- Email verification. Accounts that existed before verification was
+-- introduced count as verified; the backfill only runs when the column is
+-- first added.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'users' AND column_name = 'verified_at'
+    ) THEN
+        ALTER TABLE users ADD COLUMN verified_at TIMESTAMPTZ;
+        UPDATE users SET verified_at = created_at;
+    END IF;
+END $$;
@@ -0,0 +1,9 @@
+-- Failed login attempts per account or IP address, shared by all instances.
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key            TEXT PRIMARY KEY,
+    failures       INTEGER NOT NULL,
+    last_failed_at TIMESTAMPTZ NOT NULL,
+    locked_until   TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_last_failed_idx ON login_attempts (last_failed_at);
@@ -0,0 +1,18 @@
+-- One row per login, tied to its refresh token family. Access tokens carry
+-- the session ID in their sid claim and stop working once revoked_at is
+-- set. Refresh tokens issued before this migration have no session and
+-- cannot be rotated; their users log in again.
+CREATE TABLE IF NOT EXISTS sessions (
+    id           SERIAL PRIMARY KEY,
+    user_id      INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    family_id    TEXT NOT NULL UNIQUE,
+    device       TEXT NOT NULL,
+    user_agent   TEXT NOT NULL,
+    ip           TEXT NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at   TIMESTAMPTZ NOT NULL,
+    revoked_at   TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id);
@@ -0,0 +1,11 @@
+-- Notes shared by their owner with other users, who may view or edit them.
+-- Shares go away with the note or either user.
+CREATE TABLE IF NOT EXISTS note_shares (
+    note_id    INTEGER NOT NULL REFERENCES notes (id) ON DELETE CASCADE,
+    user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    permission TEXT NOT NULL CHECK (permission IN ('viewer', 'editor')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (note_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS note_shares_user_idx ON note_shares (user_id);
@@ -0,0 +1,14 @@
+-- Public read-only links to notes. Only SHA-256 hashes of the tokens and
+-- bcrypt hashes of the optional passwords are stored.
+CREATE TABLE IF NOT EXISTS note_links (
+    id             SERIAL PRIMARY KEY,
+    note_id        INTEGER NOT NULL REFERENCES notes (id) ON DELETE CASCADE,
+    token_hash     TEXT NOT NULL UNIQUE,
+    password_hash  TEXT,
+    expires_at     TIMESTAMPTZ,
+    views          BIGINT NOT NULL DEFAULT 0,
+    last_viewed_at TIMESTAMPTZ,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS note_links_note_idx ON note_links (note_id);
@@ -0,0 +1,39 @@
+-- Workspaces are shared collections of notes. A note belongs to a
+-- workspace when workspace_id is set, and to its user_id otherwise; user_id
+-- stays the note's author.
+CREATE TABLE IF NOT EXISTS workspaces (
+    id         SERIAL PRIMARY KEY,
+    name       TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS workspace_members (
+    workspace_id INTEGER NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+    user_id      INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role         TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'editor', 'viewer')),
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (workspace_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS workspace_members_user_idx ON workspace_members (user_id);
+
+-- Pending invitations, one per email and workspace. Only SHA-256 hashes of
+-- the emailed tokens are stored.
+CREATE TABLE IF NOT EXISTS workspace_invitations (
+    id           SERIAL PRIMARY KEY,
+    workspace_id INTEGER NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+    email        TEXT NOT NULL,
+    role         TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'editor', 'viewer')),
+    token_hash   TEXT NOT NULL UNIQUE,
+    invited_by   INTEGER REFERENCES users (id) ON DELETE SET NULL,
+    expires_at   TIMESTAMPTZ NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS workspace_invitations_email_idx ON workspace_invitations (workspace_id, lower(email));
+
+ALTER TABLE notes
+    ADD COLUMN IF NOT EXISTS workspace_id INTEGER REFERENCES workspaces (id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS notes_workspace_idx ON notes (workspace_id, created_at, id) WHERE workspace_id IS NOT NULL;
@@ -0,0 +1,14 @@
+-- Each limiter keeps its attempts under its own scope, such as account, ip
+-- or link, so it only counts and prunes its own keys. Existing attempts are
+-- scoped by the prefix of their key.
+ALTER TABLE login_attempts ADD COLUMN IF NOT EXISTS scope TEXT NOT NULL DEFAULT '';
+
+UPDATE login_attempts SET scope = split_part(key, ':', 1) WHERE scope = '';
+
+ALTER TABLE login_attempts
+    ALTER COLUMN scope DROP DEFAULT,
+    DROP CONSTRAINT IF EXISTS login_attempts_pkey,
+    ADD CONSTRAINT login_attempts_pkey PRIMARY KEY (scope, key);
+
+DROP INDEX IF EXISTS login_attempts_last_failed_idx;
+CREATE INDEX IF NOT EXISTS login_attempts_scope_last_failed_idx ON login_attempts (scope, last_failed_at);
@@ -0,0 +1,7 @@
+-- Invitation emails are sent in the background. delivery tells admins
+-- whether the email of a pending invitation went out; invitations from
+-- before it was tracked were sent on creation.
+ALTER TABLE workspace_invitations
+    ADD COLUMN IF NOT EXISTS delivery TEXT NOT NULL DEFAULT 'sent' CHECK (delivery IN ('queued', 'sent', 'failed'));
+
+ALTER TABLE workspace_invitations ALTER COLUMN delivery SET DEFAULT 'queued';
@@ -0,0 +1,26 @@
+-- Tags of workspace notes belong to the workspace and are shared by its
+-- members, instead of landing among the tags of whoever tagged the note.
+-- A tag has either a user_id or a workspace_id, and names are unique in
+-- each regardless of case.
+ALTER TABLE tags
+    ADD COLUMN IF NOT EXISTS workspace_id INTEGER REFERENCES workspaces (id) ON DELETE CASCADE,
+    ALTER COLUMN user_id DROP NOT NULL,
+    DROP CONSTRAINT IF EXISTS tags_owner_check,
+    ADD CONSTRAINT tags_owner_check CHECK ((user_id IS NULL) <> (workspace_id IS NULL));
+
+CREATE UNIQUE INDEX IF NOT EXISTS tags_workspace_name_idx ON tags (workspace_id, lower(name));
+
+-- Move the personal tags already on workspace notes to workspace tags of
+-- the same name.
+INSERT INTO tags (workspace_id, name)
+SELECT DISTINCT ON (n.workspace_id, lower(t.name)) n.workspace_id, t.name
+FROM note_tags nt
+JOIN notes n ON n.id = nt.note_id
+JOIN tags t ON t.id = nt.tag_id
+WHERE n.workspace_id IS NOT NULL AND t.user_id IS NOT NULL
+ON CONFLICT (workspace_id, lower(name)) DO NOTHING;
+
+UPDATE note_tags nt SET tag_id = w.id
+FROM notes n, tags t, tags w
+WHERE n.id = nt.note_id AND t.id = nt.tag_id AND t.user_id IS NOT NULL
+    AND w.workspace_id = n.workspace_id AND lower(w.name) = lower(t.name);
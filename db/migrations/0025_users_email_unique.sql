@@ -0,0 +1,6 @@
+-- Emails are matched regardless of case, so accounts must not differ only
+-- by the case of their email. Accounts that already do must be merged or
+-- renamed before this migration can run.
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_unique_idx ON users (lower(email));
+
+DROP INDEX IF EXISTS users_email_lower_idx;
@@ -0,0 +1,149 @@
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minRSABits is the smallest RSA modulus accepted for signing or verifying.
+const minRSABits = 2048
+
+var ErrNoSigningKey = errors.New("no JWT signing key configured")
+
+// KeySet signs tokens with one private key and verifies them against every
+// public key it holds, so tokens signed with a retired key keep working
+// until they expire. Keys are identified by their RFC 7638 thumbprint,
+// which is sent as the kid header.
+type KeySet struct {
+	Issuer   string
+	Audience string
+
+	signer  crypto.Signer
+	method  jwt.SigningMethod
+	kid     string
+	public  map[string]crypto.PublicKey
+	ordered []string
+}
+
+// New returns a KeySet signing with signer, which must be an RSA or Ed25519
+// private key, and additionally accepting tokens signed by the private keys
+// of verify. Access tokens are issued by issuer for audience.
+func New(issuer, audience string, signer crypto.Signer, verify ...crypto.PublicKey) (*KeySet, error) {
+	if signer == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	method, err := signingMethod(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{
+		Issuer:   issuer,
+		Audience: audience,
+		signer:   signer,
+		method:   method,
+		public:   make(map[string]crypto.PublicKey),
+	}
+
+	ks.kid, err = ks.add(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range verify {
+		if _, err := ks.add(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return ks, nil
+}
+
+func (ks *KeySet) add(key crypto.PublicKey) (string, error) {
+	if _, err := signingMethod(key); err != nil {
+		return "", err
+	}
+
+	kid, err := Thumbprint(key)
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := ks.public[kid]; !ok {
+		ks.public[kid] = key
+		ks.ordered = append(ks.ordered, kid)
+	}
+
+	return kid, nil
+}
+
+// Sign signs claims with the current key, stamping the issuer and issue
+// time. Callers set sub, aud and exp.
+func (ks *KeySet) Sign(claims jwt.MapClaims) (string, error) {
+	claims["iss"] = ks.Issuer
+	claims["iat"] = time.Now().Unix()
+
+	token := jwt.NewWithClaims(ks.method, claims)
+	token.Header["kid"] = ks.kid
+
+	return token.SignedString(ks.signer)
+}
+
+// Parse verifies a token signed by any key of the set and checks that it is
+// unexpired, from the set's issuer and meant for audience.
+func (ks *KeySet) Parse(tokenString, audience string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := ks.public[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key ID %q", kid)
+		}
+
+		method, err := signingMethod(key)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithIssuer(ks.Issuer),
+		jwt.WithAudience(audience),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	return claims, nil
+}
+
+func signingMethod(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA keys must have at least %d bits, got %d", minRSABits, k.N.BitLen())
+		}
+		return jwt.SigningMethodRS256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", key)
+	}
+}
@@ -0,0 +1,89 @@
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ParsePrivateKey reads a PEM encoded PKCS #8 or PKCS #1 private key.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+// ParsePublicKey reads a PEM encoded public key. Private keys are accepted
+// too, so a retired signing key can be kept around for verification as is.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		signer, err := ParsePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+		return signer.Public(), nil
+	}
+}
+
+// Load builds a KeySet from a signing key file and any number of retired
+// key files that should still verify.
+func Load(issuer, audience, signingKeyFile string, verifyKeyFiles []string) (*KeySet, error) {
+	if signingKeyFile == "" {
+		return nil, ErrNoSigningKey
+	}
+
+	data, err := os.ReadFile(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", signingKeyFile, err)
+	}
+
+	verify := make([]crypto.PublicKey, 0, len(verifyKeyFiles))
+	for _, file := range verifyKeyFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		verify = append(verify, key)
+	}
+
+	return New(issuer, audience, signer, verify...)
+}
@@ -0,0 +1,54 @@
+package limiter
+
+import (
+	"math"
+	"time"
+)
+
+// Limiter tracks failed attempts per key, such as an account or an IP
+// address, and locks keys out with exponential backoff.
+type Limiter interface {
+	// Check returns how long key stays locked out, or zero.
+	Check(key string) (time.Duration, error)
+	// Fail records a failed attempt for key and returns the lockout it
+	// caused, or zero.
+	Fail(key string) (time.Duration, error)
+	// Reset forgets the failed attempts of key.
+	Reset(key string) error
+}
+
+// Policy allows Threshold failures within Window before locking a key out
+// for BaseDelay, doubling with each further failure up to MaxDelay. A key's
+// failures are forgotten once Window passes without one.
+type Policy struct {
+	Threshold int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Window    time.Duration
+}
+
+var (
+	DefaultAccountPolicy = Policy{Threshold: 5, BaseDelay: time.Second, MaxDelay: 15 * time.Minute, Window: 15 * time.Minute}
+	DefaultIPPolicy      = Policy{Threshold: 20, BaseDelay: time.Second, MaxDelay: 15 * time.Minute, Window: 15 * time.Minute}
+	DefaultLinkPolicy    = Policy{Threshold: 10, BaseDelay: time.Second, MaxDelay: time.Hour, Window: time.Hour}
+)
+
+// lockout returns how long a key with the given number of consecutive
+// failures is locked out.
+func (p Policy) lockout(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+
+	exponent := failures - p.Threshold
+	if exponent > 62 {
+		return p.MaxDelay
+	}
+
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(exponent))
+	if delay > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+
+	return time.Duration(delay)
+}
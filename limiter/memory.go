@@ -0,0 +1,106 @@
+package limiter
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxKeys is how many keys Memory holds. Beyond it the key that failed
+// longest ago is forgotten.
+const maxKeys = 10000
+
+// Memory is a Limiter for a single instance. It keeps keys in the order of
+// their last failure, so stale keys are dropped from the back as new ones
+// come in.
+type Memory struct {
+	mu      sync.Mutex
+	policy  Policy
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type entry struct {
+	key         string
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewMemory(policy Policy) *Memory {
+	return &Memory{policy: policy, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (m *Memory) Check(key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return 0, nil
+	}
+
+	if wait := time.Until(el.Value.(*entry).lockedUntil); wait > 0 {
+		return wait, nil
+	}
+
+	return 0, nil
+}
+
+func (m *Memory) Fail(key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.prune(now)
+
+	el, ok := m.entries[key]
+	if ok && now.Sub(el.Value.(*entry).lastFailure) > m.policy.Window {
+		el.Value = &entry{key: key}
+	}
+	if !ok {
+		el = m.order.PushFront(&entry{key: key})
+		m.entries[key] = el
+	}
+	m.order.MoveToFront(el)
+
+	e := el.Value.(*entry)
+	e.failures++
+	e.lastFailure = now
+
+	lock := m.policy.lockout(e.failures)
+	if lock > 0 {
+		e.lockedUntil = now.Add(lock)
+	}
+
+	return lock, nil
+}
+
+func (m *Memory) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+
+	return nil
+}
+
+// prune drops stale keys from the back, and the oldest keys beyond maxKeys
+// to make room for one more.
+func (m *Memory) prune(now time.Time) {
+	for el := m.order.Back(); el != nil; el = m.order.Back() {
+		e := el.Value.(*entry)
+		stale := now.Sub(e.lastFailure) > m.policy.Window && now.After(e.lockedUntil)
+		if !stale && m.order.Len() < maxKeys {
+			return
+		}
+		m.remove(el)
+	}
+}
+
+func (m *Memory) remove(el *list.Element) {
+	delete(m.entries, el.Value.(*entry).key)
+	m.order.Remove(el)
+}
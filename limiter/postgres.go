@@ -0,0 +1,109 @@
+package limiter
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Postgres is a Limiter shared by every instance using the same database.
+// Limiters with different scopes keep their keys apart, so each counts and
+// prunes only its own.
+type Postgres struct {
+	db     *sql.DB
+	scope  string
+	policy Policy
+}
+
+func NewPostgres(db *sql.DB, scope string, policy Policy) *Postgres {
+	return &Postgres{db: db, scope: scope, policy: policy}
+}
+
+func (p *Postgres) Check(key string) (time.Duration, error) {
+	var seconds float64
+	sqlQuery := `SELECT EXTRACT(EPOCH FROM locked_until - now()) FROM login_attempts WHERE scope = $1 AND key = $2 AND locked_until > now()`
+	err := p.db.QueryRow(sqlQuery, p.scope, key).Scan(&seconds)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func (p *Postgres) Fail(key string) (time.Duration, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	failures := 0
+	sqlQuery := `
+		INSERT INTO login_attempts (scope, key, failures, last_failed_at) VALUES ($1, $2, 1, now())
+		ON CONFLICT (scope, key) DO UPDATE SET
+			failures = CASE
+				WHEN login_attempts.last_failed_at < now() - $3 * interval '1 second' THEN 1
+				ELSE login_attempts.failures + 1 END,
+			last_failed_at = now()
+		RETURNING failures`
+	err = tx.QueryRow(sqlQuery, p.scope, key, p.policy.Window.Seconds()).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	lock := p.policy.lockout(failures)
+	if lock > 0 {
+		sqlQuery = `UPDATE login_attempts SET locked_until = now() + $3 * interval '1 second' WHERE scope = $1 AND key = $2`
+		if _, err := tx.Exec(sqlQuery, p.scope, key, lock.Seconds()); err != nil {
+			return 0, err
+		}
+	}
+
+	return lock, tx.Commit()
+}
+
+func (p *Postgres) Reset(key string) error {
+	_, err := p.db.Exec(`DELETE FROM login_attempts WHERE scope = $1 AND key = $2`, p.scope, key)
+
+	return err
+}
+
+// Prune deletes the attempts of the scope's keys whose failures are older
+// than the policy's window and that are no longer locked out, returning how many it
+// deleted. Such keys would start counting from zero anyway.
+func (p *Postgres) Prune() (int64, error) {
+	sqlQuery := `
+		DELETE FROM login_attempts
+		WHERE scope = $1 AND last_failed_at < now() - $2 * interval '1 second'
+		AND (locked_until IS NULL OR locked_until < now())`
+	res, err := p.db.Exec(sqlQuery, p.scope, p.policy.Window.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// StartPruner calls Prune once per policy window until ctx is cancelled.
+func (p *Postgres) StartPruner(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(p.policy.Window)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if _, err := p.Prune(); err != nil {
+				log.Printf("%s attempts prune failed: %v", p.scope, err)
+			}
+		}
+	}()
+}
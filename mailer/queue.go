@@ -0,0 +1,67 @@
+package mailer
+
+import "sync"
+
+// DefaultQueueSize is how many jobs Queue holds while earlier ones run.
+const DefaultQueueSize = 256
+
+// Queue runs email jobs, such as looking up an account and mailing it a
+// link, on a background goroutine. Requests that send mail then never wait
+// on the mail server and take the same time whether or not an email goes
+// out.
+type Queue struct {
+	mu     sync.RWMutex
+	closed bool
+	jobs   chan func()
+	done   chan struct{}
+}
+
+// NewQueue starts running queued jobs until Close is called.
+func NewQueue(size int) *Queue {
+	q := &Queue{
+		jobs: make(chan func(), size),
+		done: make(chan struct{}),
+	}
+	go q.run()
+
+	return q
+}
+
+// Go queues job. It reports false, dropping the job, when the queue is full
+// or closed.
+func (q *Queue) Go(job func()) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return false
+	}
+
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close runs the jobs still queued and stops the goroutine. Jobs queued
+// afterwards are dropped.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	<-q.done
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+
+	for job := range q.jobs {
+		job()
+	}
+}
@@ -2,10 +2,13 @@ package middlewares
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
+	"go-note/jwtkeys"
+	"go-note/models"
 	"go-note/utils"
+	"log"
 	"net/http"
-	"os"
 	"strings"
 
 	"strconv"
@@ -16,8 +19,55 @@ import (
 
 type contextKey string
 
-const UserKey contextKey = "userID"
+const (
+	UserKey        contextKey = "userID"
+	RoleKey        contextKey = "role"
+	VerifiedKey    contextKey = "emailVerified"
+	ScopesKey      contextKey = "scopes"
+	SessionKey     contextKey = "sessionID"
+	TokenIDKey     contextKey = "tokenID"
+	TokenExpiryKey contextKey = "tokenExpiry"
+)
+
+// RevocationStore reports whether an access token, identified by its jti
+// claim, has been revoked before expiring, whether its user has been
+// suspended since it was issued, and whether its session is still active.
+type RevocationStore interface {
+	// CheckAccessToken answers all three in one query, recording that the
+	// session was just used.
+	CheckAccessToken(jti string, userID, sessionID int) (models.AccessTokenStatus, error)
+}
+
+var revocations RevocationStore
+
+// PersonalTokenStore authenticates personal access tokens by hash.
+type PersonalTokenStore interface {
+	AuthenticatePersonalToken(tokenHash string) (*models.PersonalTokenAuth, error)
+}
+
+var personalTokens PersonalTokenStore
+
+var keys *jwtkeys.KeySet
+
+// SetRevocationStore makes JWTMiddleware reject revoked access tokens and
+// suspended users.
+func SetRevocationStore(store RevocationStore) {
+	revocations = store
+}
 
+// SetKeySet sets the keys access tokens are verified with. Until it is
+// called every access token is rejected.
+func SetKeySet(ks *jwtkeys.KeySet) {
+	keys = ks
+}
+
+// SetPersonalTokenStore makes JWTMiddleware accept personal access tokens.
+func SetPersonalTokenStore(store PersonalTokenStore) {
+	personalTokens = store
+}
+
+// JWTMiddleware authenticates requests with an access token or, once
+// SetPersonalTokenStore is called, a personal access token.
 func JWTMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
@@ -29,53 +79,141 @@ func JWTMiddleware(next http.Handler) http.Handler {
 		}
 
 		tokenStr := bearerToken[1]
-		token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(os.Getenv("SECRET_KEY")), nil
-		})
+		if strings.HasPrefix(tokenStr, models.PersonalTokenPrefix) && personalTokens != nil {
+			servePersonalToken(w, r, next, tokenStr)
+			return
+		}
 
+		claims, err := validateJWT(tokenStr)
 		if err != nil {
 			http.Error(w, "Unauthorized - Error parsing token: "+err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			fmt.Println("Claims:", claims)
-		} else {
+		userID, err := userIDFromClaims(claims)
+		if err != nil {
 			http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
-	})
-}
+		jti, _ := claims["jti"].(string)
+		sid, _ := claims["sid"].(float64)
+		sessionID := int(sid)
+		if jti == "" || sessionID <= 0 {
+			http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
+			return
+		}
 
-func CreateJWT(secret []byte, userID int) (string, error) {
-	expiration := time.Second * time.Duration(3600*24*7)
+		if revocations != nil {
+			status, err := revocations.CheckAccessToken(jti, userID, sessionID)
+			if err != nil {
+				log.Println("checking token revocation:", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			switch status {
+			case models.AccessTokenRevoked:
+				http.Error(w, "Unauthorized - Token revoked", http.StatusUnauthorized)
+				return
+			case models.AccessTokenUserSuspended:
+				http.Error(w, "Forbidden - Account suspended", http.StatusForbidden)
+				return
+			case models.AccessTokenSessionEnded:
+				http.Error(w, "Unauthorized - Session ended", http.StatusUnauthorized)
+				return
+			}
+		}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"userID":    strconv.Itoa(int(userID)),
-		"expiresAt": time.Now().Add(expiration).Unix(),
+		expiry, err := claims.GetExpirationTime()
+		if err != nil {
+			http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		role, _ := claims["role"].(string)
+		verified, _ := claims["email_verified"].(bool)
+
+		ctx := context.WithValue(r.Context(), UserKey, userID)
+		ctx = context.WithValue(ctx, RoleKey, role)
+		ctx = context.WithValue(ctx, VerifiedKey, verified)
+		ctx = context.WithValue(ctx, SessionKey, sessionID)
+		ctx = context.WithValue(ctx, TokenIDKey, jti)
+		ctx = context.WithValue(ctx, TokenExpiryKey, expiry.Time)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
+}
 
-	tokenString, err := token.SignedString(secret)
+// servePersonalToken authenticates a personal access token, limiting the
+// request to the token's scopes.
+func servePersonalToken(w http.ResponseWriter, r *http.Request, next http.Handler, tokenStr string) {
+	auth, err := personalTokens.AuthenticatePersonalToken(utils.HashToken(tokenStr))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
-		return "", err
+		log.Println("checking personal access token:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
-	return tokenString, err
+	if auth.Suspended {
+		http.Error(w, "Forbidden - Account suspended", http.StatusForbidden)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), UserKey, auth.UserID)
+	ctx = context.WithValue(ctx, RoleKey, auth.Role)
+	ctx = context.WithValue(ctx, VerifiedKey, auth.Verified)
+	ctx = context.WithValue(ctx, ScopesKey, auth.Scopes)
+	next.ServeHTTP(w, r.WithContext(ctx))
 }
 
-func validateJWT(tokenString string) (*jwt.Token, error) {
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+// CreateJWT signs an access token for userID's session carrying their role
+// and whether their email is verified that expires after ttl. The token's
+// unique ID is returned so it can be revoked later.
+func CreateJWT(ks *jwtkeys.KeySet, userID, sessionID int, role string, verified bool, ttl time.Duration) (string, string, error) {
+	jti, err := utils.RandomToken(16)
+	if err != nil {
+		return "", "", err
+	}
 
-		return []byte(os.Getenv("SECRET_KEY")), nil
+	tokenString, err := ks.Sign(jwt.MapClaims{
+		"sub":            strconv.Itoa(userID),
+		"aud":            ks.Audience,
+		"exp":            time.Now().Add(ttl).Unix(),
+		"jti":            jti,
+		"sid":            sessionID,
+		"role":           role,
+		"email_verified": verified,
 	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return tokenString, jti, nil
+}
+
+func validateJWT(tokenString string) (jwt.MapClaims, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("no verification keys configured")
+	}
+
+	return keys.Parse(tokenString, keys.Audience)
+}
+
+func userIDFromClaims(claims jwt.MapClaims) (int, error) {
+	sub, err := claims.GetSubject()
+	if err != nil || sub == "" {
+		return 0, fmt.Errorf("missing sub claim")
+	}
+
+	userID, err := strconv.Atoi(sub)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sub claim: %v", err)
+	}
+
+	return userID, nil
 }
 
 func permissionDenied(w http.ResponseWriter) {
@@ -90,3 +228,68 @@ func GetUserIDFromContext(ctx context.Context) int {
 
 	return userID
 }
+
+// GetRoleFromContext returns the role claim of the request's access token.
+func GetRoleFromContext(ctx context.Context) string {
+	role, _ := ctx.Value(RoleKey).(string)
+	return role
+}
+
+// HasScope reports whether the request may use permission. Only requests
+// authenticated with a personal access token are limited by scopes.
+func HasScope(ctx context.Context, permission string) bool {
+	scopes, ok := ctx.Value(ScopesKey).([]string)
+	if !ok {
+		return true
+	}
+
+	for _, scope := range scopes {
+		if scope == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsPersonalToken reports whether the request was authenticated with a
+// personal access token.
+func IsPersonalToken(ctx context.Context) bool {
+	_, ok := ctx.Value(ScopesKey).([]string)
+	return ok
+}
+
+// IsEmailVerified reports whether the request's access token was issued to
+// a user with a verified email.
+func IsEmailVerified(ctx context.Context) bool {
+	verified, _ := ctx.Value(VerifiedKey).(bool)
+	return verified
+}
+
+// GetTokenFromContext returns the ID and expiry of the access token that
+// authenticated the request.
+func GetTokenFromContext(ctx context.Context) (string, time.Time) {
+	jti, _ := ctx.Value(TokenIDKey).(string)
+	expiry, _ := ctx.Value(TokenExpiryKey).(time.Time)
+
+	return jti, expiry
+}
+
+// GetSessionFromContext returns the session of the access token that
+// authenticated the request, or 0 for personal access tokens.
+func GetSessionFromContext(ctx context.Context) int {
+	sessionID, _ := ctx.Value(SessionKey).(int)
+	return sessionID
+}
+
+// RequireUserID returns the ID injected by JWTMiddleware, writing a 401 when
+// the request carries no authenticated user.
+func RequireUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID := GetUserIDFromContext(r.Context())
+	if userID == -1 {
+		utils.ResponseJSON(w, http.StatusUnauthorized, "unauthorized", false)
+		return 0, false
+	}
+
+	return userID, true
+}
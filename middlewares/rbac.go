@@ -0,0 +1,58 @@
+package middlewares
+
+import (
+	"go-note/models"
+	"go-note/utils"
+	"net/http"
+)
+
+// RequireRole only lets requests through whose token carries one of roles.
+// Personal access tokens also need the admin scope. It must run after
+// JWTMiddleware, e.g. on a mux subrouter.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !HasScope(r.Context(), models.PermAdmin) {
+				permissionDenied(w)
+				return
+			}
+
+			role := GetRoleFromContext(r.Context())
+			for _, allowed := range roles {
+				if role == allowed {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			permissionDenied(w)
+		})
+	}
+}
+
+// Permit declares the permission a route needs. Requests whose role, or
+// personal access token scopes, do not grant it get 403.
+func Permit(permission string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !models.HasPermission(GetRoleFromContext(ctx), permission) || !HasScope(ctx, permission) {
+			permissionDenied(w)
+			return
+		}
+
+		handler(w, r)
+	})
+}
+
+// SessionOnly refuses personal access tokens, for routes that manage the
+// account itself.
+func SessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsPersonalToken(r.Context()) {
+			utils.ResponseJSON(w, http.StatusForbidden, "personal access tokens cannot be used here", false)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,79 @@
+package models
+
+import "time"
+
+// Audit log actions.
+const (
+	AuditLoginSucceeded         = "login.succeeded"
+	AuditLoginFailed            = "login.failed"
+	AuditLoginLockedOut         = "login.locked_out"
+	AuditLogout                 = "logout"
+	AuditRegistered             = "user.registered"
+	AuditIdentityLinked         = "identity.linked"
+	AuditPasswordChanged        = "password.changed"
+	AuditPasswordReset          = "password.reset"
+	AuditTwoFactorEnabled       = "2fa.enabled"
+	AuditTwoFactorDisabled      = "2fa.disabled"
+	AuditTokenCreated           = "token.created"
+	AuditTokenRevoked           = "token.revoked"
+	AuditSessionRevoked         = "session.revoked"
+	AuditSessionRefreshed       = "session.refreshed"
+	AuditRefreshReused          = "session.refresh_reused"
+	AuditRoleChanged            = "user.role_changed"
+	AuditUserSuspended          = "user.suspended"
+	AuditUserUnsuspended        = "user.unsuspended"
+	AuditPasswordResetRequired  = "user.password_reset_required"
+	AuditUserDeleted            = "user.deleted"
+	AuditNoteDeleted            = "note.deleted"
+	AuditNotePurged             = "note.purged"
+	AuditNoteShared             = "note.shared"
+	AuditNoteUnshared           = "note.unshared"
+	AuditNoteLinkCreated        = "note.link_created"
+	AuditNoteLinkRevoked        = "note.link_revoked"
+	AuditWorkspaceDeleted       = "workspace.deleted"
+	AuditWorkspaceInvited       = "workspace.invited"
+	AuditWorkspaceJoined        = "workspace.joined"
+	AuditWorkspaceRoleChanged   = "workspace.role_changed"
+	AuditWorkspaceMemberRemoved = "workspace.member_removed"
+)
+
+// AuditEvent is one entry of the security audit log. ActorID is the user who
+// made the request and UserID the account it concerns; either is 0 when
+// there is none, such as a failed login for an unknown email.
+type AuditEvent struct {
+	ID        int64             `json:"id"`
+	Action    string            `json:"action"`
+	ActorID   int               `json:"actor_id,omitempty"`
+	UserID    int               `json:"user_id,omitempty"`
+	Target    string            `json:"target,omitempty"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"user_agent"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// AuditStore appends to and reads the audit log. Entries are never changed
+// or removed.
+type AuditStore interface {
+	CreateAuditEvents(events []*AuditEvent) error
+	GetAuditEvents(opts *AuditListOptions) (*AuditList, error)
+}
+
+// AuditListOptions filters and pages the audit log, newest first. Before is
+// the last ID of the previous page; zero fields do not filter.
+type AuditListOptions struct {
+	Limit   int
+	Before  int64
+	UserID  int
+	ActorID int
+	Action  string
+	IP      string
+	Since   time.Time
+	Until   time.Time
+}
+
+type AuditList struct {
+	Events []*AuditEvent
+	Total  int
+	Next   *int64
+}
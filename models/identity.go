@@ -0,0 +1,27 @@
+package models
+
+import "errors"
+
+var (
+	ErrIdentityEmailUnverified = errors.New("the identity provider has not verified this email")
+	ErrIdentityNoAccount       = errors.New("no account uses this email")
+	ErrIdentityLinkUnverified  = errors.New("verify the email of your account before signing in with this provider")
+	ErrOIDCStateInvalid        = errors.New("invalid or expired login state")
+)
+
+// IdentityStore links accounts to users of external OpenID Connect
+// providers.
+type IdentityStore interface {
+	// GetUserByIdentity returns sql.ErrNoRows for unlinked identities.
+	GetUserByIdentity(provider, subject string) (*User, error)
+	LinkIdentity(userID int, identity *ExternalIdentity) error
+	// CreateUserWithIdentity creates a verified account linked to identity.
+	CreateUserWithIdentity(user *UserRegisterPayload, identity *ExternalIdentity) (*User, error)
+}
+
+// ExternalIdentity is a user of a provider, identified by its subject.
+type ExternalIdentity struct {
+	Provider string
+	Subject  string
+	Email    string
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrLinkNotFound = errors.New("link not found")
+	ErrLinkExpired  = errors.New("link has expired")
+)
+
+// NoteLinkPrefix starts every public link token.
+const NoteLinkPrefix = "gnl_"
+
+// NoteLink publishes a note read-only to anyone holding its token. Only
+// hashes of the token and the optional password are stored, so the token
+// is only ever shown when the link is created.
+type NoteLink struct {
+	ID           int        `json:"id"`
+	NoteID       int        `json:"note_id"`
+	TokenHash    string     `json:"-"`
+	PasswordHash string     `json:"-"`
+	HasPassword  bool       `json:"has_password"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	Views        int64      `json:"views"`
+	LastViewedAt *time.Time `json:"last_viewed_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// Expired reports whether the link stopped working before now.
+func (l *NoteLink) Expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !l.ExpiresAt.After(now)
+}
+
+type NoteLinkPayload struct {
+	ExpiresAt *time.Time `json:"expires_at"`
+	Password  string     `json:"password" validate:"omitempty,min=8,max=72"`
+}
+
+// PublicNote is what a public link shows of a note.
+type PublicNote struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
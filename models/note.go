@@ -1,22 +1,185 @@
 package models
 
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrRevisionNotFound = errors.New("revision not found")
+	ErrVersionMismatch  = errors.New("note has been modified")
+	ErrDiffTooLarge     = errors.New("revisions differ in too many lines to diff")
+)
+
+// NoteStore methods take the ID of the authenticated caller and only ever
+// touch notes that user owns or that are shared with them. Notes the caller
+// cannot see fail with sql.ErrNoRows; notes they see but may not change fail
+// with ErrNoteReadOnly, or ErrNoteOwnerOnly for what only owners may do:
+// moving, deleting, sharing and publishing notes, and the trash. DeleteNote
+// moves a note to the trash, and apart from the trash methods every read and
+// write skips trashed notes. A version of 0 passed to UpdateNote or
+// DeleteNote skips the optimistic concurrency check; UpdateNote and
+// PatchNote return the note's new version.
 type NoteStore interface {
-	CreateNote(*NotePayload) error
-	GetNotes() ([]*Note, error)
-	GetNoteByID(id int) (*Note, error)
-	UpdateNote(id int, note *NotePayload) error
-	DeleteNote(id int) error
+	CreateNote(userID int, note *NotePayload) error
+	GetNotes(userID int, opts *NoteListOptions) (*NoteList, error)
+	GetNoteByID(userID, id int) (*Note, error)
+	UpdateNote(userID, id int, note *NotePayload, version int) (int, error)
+	DeleteNote(userID, id int, version int) error
+	PatchNote(userID, id int, patch *NotePatch, version int) (int, error)
+	MoveNote(userID, id int, notebookID *int) error
+	GetTrash(userID int) ([]*Note, error)
+	RestoreNote(userID, id int) error
+	PurgeNote(userID, id int) error
+	GetRevisions(userID, noteID int) ([]*NoteRevision, error)
+	GetRevision(userID, noteID, revision int) (*NoteRevision, error)
+	RestoreRevision(userID, noteID, revision int) error
+	SearchNotes(userID int, opts *NoteSearchOptions) ([]*NoteSearchResult, error)
+	ShareNote(userID, noteID int, share *NoteSharePayload) (*NoteShare, error)
+	GetNoteShares(userID, noteID int) ([]*NoteShare, error)
+	// RevokeNoteShare lets owners remove any share of the note and other
+	// users remove their own.
+	RevokeNoteShare(userID, noteID, shareUserID int) error
+	GetSharedNotes(userID int) ([]*Note, error)
+	CreateNoteLink(userID int, link *NoteLink) error
+	GetNoteLinks(userID, noteID int) ([]*NoteLink, error)
+	DeleteNoteLink(userID, noteID, linkID int) error
+	// GetNoteLinkByToken and ViewNoteLink serve public links without a
+	// caller. They fail with sql.ErrNoRows once the note is trashed.
+	GetNoteLinkByToken(tokenHash string) (*NoteLink, error)
+	// ViewNoteLink counts a view of the link and returns the note it shows.
+	ViewNoteLink(linkID int) (*PublicNote, error)
 }
 
 type Note struct {
-	ID          int    `json:"id"`
-	Title       string `json:"title" validate:"required"`
-	Description string `json:"description" validate:"required"`
-	UserID      int    `json:"user_id" validate:"required"`
+	ID          int        `json:"id"`
+	Title       string     `json:"title" validate:"required"`
+	Description string     `json:"description" validate:"required"`
+	UserID      int        `json:"user_id" validate:"required"`
+	NotebookID  *int       `json:"notebook_id"`
+	WorkspaceID *int       `json:"workspace_id"`
+	Version     int        `json:"version"`
+	Tags        []string   `json:"tags"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	// Permission is set on notes shared with the caller to what the share
+	// grants them.
+	Permission string `json:"permission,omitempty"`
 }
 
+// NotePayload.Tags names the note's tags, creating any that don't exist yet.
+// A nil Tags or NotebookID leaves that part of an existing note untouched.
+// WorkspaceID only counts on creation, and puts the note in that workspace
+// instead of the caller's own notes.
 type NotePayload struct {
-	Title       string `json:"title" validate:"required"`
-	Description string `json:"description" validate:"required"`
-	UserID      int    `json:"user_id" validate:"required"`
+	Title       string   `json:"title" validate:"required"`
+	Description string   `json:"description" validate:"required"`
+	NotebookID  *int     `json:"notebook_id"`
+	WorkspaceID *int     `json:"workspace_id"`
+	Tags        []string `json:"tags" validate:"max=20,dive,required,max=50"`
+}
+
+// NotePatch lists the fields a PATCH changes. Nil fields are left alone;
+// SetNotebook with a nil NotebookID moves the note to the root.
+type NotePatch struct {
+	Title       *string
+	Description *string
+	SetNotebook bool
+	NotebookID  *int
+	Tags        []string
+}
+
+// NoteMovePayload.NotebookID nil moves the note to the root.
+type NoteMovePayload struct {
+	NotebookID *int `json:"notebook_id"`
+}
+
+const (
+	NoteSortCreated = "created"
+	NoteSortUpdated = "updated"
+	NoteSortTitle   = "title"
+
+	SortAsc  = "asc"
+	SortDesc = "desc"
+
+	TagMatchAll = "all"
+	TagMatchAny = "any"
+)
+
+// NoteListOptions controls filtering, ordering and paging of GetNotes.
+// Zero-valued filters are ignored.
+type NoteListOptions struct {
+	Limit int
+	Sort  string
+	Order string
+	After *NoteCursor
+
+	// WorkspaceID lists the notes of that workspace instead of the
+	// caller's own.
+	WorkspaceID *int
+
+	Title         string
+	Tags          []string
+	TagMatch      string
+	NotebookID    *int
+	Descendants   bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	UpdatedAfter  *time.Time
+	UpdatedBefore *time.Time
+}
+
+// NoteCursor marks the last note of a page. Value holds that note's sort
+// key (RFC 3339 for timestamps) and ID breaks ties between equal keys.
+type NoteCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+type NoteList struct {
+	Notes []*Note
+	Total int
+	Next  *NoteCursor
+}
+
+type NoteSearchOptions struct {
+	Query  string
+	Limit  int
+	Offset int
+}
+
+// HighlightStart and HighlightStop delimit matched terms in the highlights
+// NoteStore.SearchNotes returns. The handler escapes the text around them
+// and turns them into <mark> tags.
+const (
+	HighlightStart = "\x01"
+	HighlightStop  = "\x02"
+)
+
+// NoteSearchResult is a matching note with its relevance and the matched
+// terms wrapped in <mark> tags.
+type NoteSearchResult struct {
+	Note
+	Rank                 float64 `json:"rank"`
+	TitleHighlight       string  `json:"title_highlight"`
+	DescriptionHighlight string  `json:"description_highlight"`
+}
+
+// NoteRevision is the content of a note after one of its updates. Revision
+// 1 is the content the note was created with.
+type NoteRevision struct {
+	NoteID      int       `json:"note_id"`
+	Revision    int       `json:"revision"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type NoteDiff struct {
+	From int    `json:"from"`
+	To   int    `json:"to"`
+	Diff string `json:"diff"`
 }
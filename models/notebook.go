@@ -0,0 +1,46 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotebookNotFound = errors.New("notebook not found")
+	ErrNotebookCycle    = errors.New("a notebook cannot be moved into itself or its descendants")
+)
+
+const (
+	// NotebookDeleteRehome moves the notes and sub-notebooks of a deleted
+	// notebook to its parent, or to the root for top-level notebooks.
+	NotebookDeleteRehome = "rehome"
+	// NotebookDeleteCascade deletes the notebook's sub-notebooks and moves
+	// every note inside them to the trash.
+	NotebookDeleteCascade = "cascade"
+)
+
+// NotebookStore methods are scoped to the notebooks owned by userID.
+type NotebookStore interface {
+	CreateNotebook(userID int, notebook *NotebookPayload) error
+	GetNotebooks(userID int) ([]*Notebook, error)
+	GetNotebookByID(userID, id int, descendants bool) (*Notebook, error)
+	UpdateNotebook(userID, id int, notebook *NotebookPayload) error
+	DeleteNotebook(userID, id int, mode string) error
+}
+
+type Notebook struct {
+	ID        int         `json:"id"`
+	Name      string      `json:"name"`
+	UserID    int         `json:"user_id"`
+	ParentID  *int        `json:"parent_id"`
+	NoteCount int         `json:"note_count"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	Children  []*Notebook `json:"children,omitempty"`
+}
+
+// NotebookPayload.ParentID nil places the notebook at the root.
+type NotebookPayload struct {
+	Name     string `json:"name" validate:"required,max=100"`
+	ParentID *int   `json:"parent_id"`
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrScopeNotAllowed = errors.New("scope not granted by your role")
+
+// PersonalTokenPrefix starts every personal access token so they can be told
+// apart from JWTs in an Authorization header.
+const PersonalTokenPrefix = "gnp_"
+
+// PersonalTokenStore keeps the personal access tokens users create for
+// scripts and integrations. Only hashes of the tokens are stored.
+type PersonalTokenStore interface {
+	CreatePersonalToken(token *PersonalAccessToken) error
+	GetPersonalTokens(userID int) ([]*PersonalAccessToken, error)
+	DeletePersonalToken(userID, id int) error
+}
+
+type PersonalAccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// PersonalTokenAuth is what authenticating with a personal access token
+// yields: the token's owner as they are now, and the token's scopes.
+type PersonalTokenAuth struct {
+	UserID    int
+	Role      string
+	Verified  bool
+	Suspended bool
+	Scopes    []string
+}
+
+type PersonalTokenPayload struct {
+	Name      string     `json:"name" validate:"required,max=100"`
+	Scopes    []string   `json:"scopes" validate:"required,min=1"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
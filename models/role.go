@@ -0,0 +1,37 @@
+package models
+
+const (
+	RoleAdmin    = "admin"
+	RoleMember   = "member"
+	RoleReadOnly = "readonly"
+)
+
+// Permissions are declared per route and granted through roles.
+const (
+	PermNotesRead  = "notes:read"
+	PermNotesWrite = "notes:write"
+	PermAdmin      = "admin"
+)
+
+var RolePermissions = map[string][]string{
+	RoleAdmin:    {PermNotesRead, PermNotesWrite, PermAdmin},
+	RoleMember:   {PermNotesRead, PermNotesWrite},
+	RoleReadOnly: {PermNotesRead},
+}
+
+func IsValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// HasPermission reports whether role grants permission. Unknown roles grant
+// nothing.
+func HasPermission(role, permission string) bool {
+	for _, p := range RolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Session is one login of a user, lasting as long as its refresh token
+// family. Access tokens carry the session ID so ending a session cuts them
+// off immediately.
+type Session struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"-"`
+	FamilyID   string    `json:"-"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"-"`
+	// Current marks the session of the request listing sessions.
+	Current bool `json:"current"`
+}
+
+// SessionStore lists and ends the active sessions of a user. Ending a
+// session revokes its refresh tokens too.
+type SessionStore interface {
+	GetSessions(userID int) ([]*Session, error)
+	// RevokeSession returns sql.ErrNoRows unless the session is active and
+	// belongs to userID.
+	RevokeSession(userID, sessionID int) error
+	// RevokeOtherSessions ends every session of userID but keepSessionID,
+	// returning how many it ended.
+	RevokeOtherSessions(userID, keepSessionID int) (int, error)
+}
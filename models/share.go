@@ -0,0 +1,58 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNoteReadOnly       = errors.New("note is shared with you read-only")
+	ErrNoteOwnerOnly      = errors.New("only the note's owner can do this")
+	ErrShareNotFound      = errors.New("share not found")
+	ErrShareSelf          = errors.New("cannot share a note with yourself")
+	ErrShareUserNotFound  = errors.New("no user with that email or username")
+	ErrShareUserAmbiguous = errors.New("more than one user has that username, share by email instead")
+)
+
+// Access to a note, from least to most. Owners hold ShareOwner implicitly;
+// the other two are granted through shares.
+const (
+	ShareViewer = "viewer"
+	ShareEditor = "editor"
+	ShareOwner  = "owner"
+)
+
+var shareRanks = map[string]int{
+	ShareViewer: 1,
+	ShareEditor: 2,
+	ShareOwner:  3,
+}
+
+// IsValidSharePermission reports whether permission can be granted through
+// a share.
+func IsValidSharePermission(permission string) bool {
+	return permission == ShareViewer || permission == ShareEditor
+}
+
+// SharePermits reports whether having access have allows what needs need.
+// An empty have grants nothing.
+func SharePermits(have, need string) bool {
+	return shareRanks[have] > 0 && shareRanks[have] >= shareRanks[need]
+}
+
+// NoteShare grants a user other than the owner access to a note.
+type NoteShare struct {
+	NoteID     int       `json:"note_id"`
+	UserID     int       `json:"user_id"`
+	Email      string    `json:"email"`
+	Username   string    `json:"username"`
+	Permission string    `json:"permission"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// NoteSharePayload.User is the email or username of the user to share with.
+// Sharing again with the same user changes their permission.
+type NoteSharePayload struct {
+	User       string `json:"user" validate:"required"`
+	Permission string `json:"permission" validate:"required"`
+}
@@ -0,0 +1,48 @@
+package models
+
+import "errors"
+
+var (
+	ErrTagExists = errors.New("tag already exists")
+	ErrTagScope  = errors.New("tags belong to different owners")
+)
+
+// TagStore methods are scoped to the personal tags of userID and the tags of
+// the workspaces userID is a member of. Any member can read a workspace's
+// tags; changing them takes at least the editor role, failing with
+// ErrWorkspaceRole otherwise. Renaming or merging a tag is reflected on
+// every note carrying it.
+type TagStore interface {
+	// CreateTag creates a personal tag, or a workspace tag when
+	// tag.WorkspaceID is set.
+	CreateTag(userID int, tag *TagPayload) error
+	// GetTags lists the personal tags of userID, or the tags of workspaceID
+	// when it is not nil.
+	GetTags(userID int, workspaceID *int) ([]*Tag, error)
+	GetTagByID(userID, id int) (*Tag, error)
+	UpdateTag(userID, id int, tag *TagPayload) error
+	DeleteTag(userID, id int) error
+	// MergeTags fails with ErrTagScope unless both tags are personal or
+	// both belong to the same workspace.
+	MergeTags(userID, sourceID, targetID int) error
+}
+
+// Tag is a personal tag of UserID, or a tag of WorkspaceID with a zero
+// UserID.
+type Tag struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	UserID      int    `json:"user_id"`
+	WorkspaceID *int   `json:"workspace_id"`
+	NoteCount   int    `json:"note_count"`
+}
+
+// TagPayload.WorkspaceID only counts on creation.
+type TagPayload struct {
+	Name        string `json:"name" validate:"required,max=50"`
+	WorkspaceID *int   `json:"workspace_id"`
+}
+
+type TagMergePayload struct {
+	Into int `json:"into" validate:"required"`
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused means an already rotated refresh token was
+	// presented again. The whole token family has been revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+	ErrResetTokenInvalid  = errors.New("invalid or expired reset token")
+)
+
+// TokenStore keeps refresh tokens, by hash only, and the IDs of access
+// tokens revoked before their expiry. Refresh tokens issued from one login
+// share a family and a session; rotating one hands out the next token of
+// the family and keeps the session alive.
+type TokenStore interface {
+	CreateSession(session *Session) error
+	CreateRefreshToken(token *RefreshToken) error
+	// RotateRefreshToken fills in next's user and family even when it
+	// returns ErrRefreshTokenReused.
+	RotateRefreshToken(oldHash string, next *RefreshToken) error
+	// RevokeRefreshFamily also ends the family's session.
+	RevokeRefreshFamily(userID int, tokenHash string) error
+	RevokeAccessToken(jti string, expiresAt time.Time) error
+	CreatePasswordResetToken(token *PasswordResetToken) error
+	// ResetPassword returns the ID of the user whose password it set.
+	ResetPassword(tokenHash, hashedPassword string) (int, error)
+}
+
+// AccessTokenStatus tells whether an unexpired access token may still be
+// used, and if not, why.
+type AccessTokenStatus int
+
+const (
+	AccessTokenActive AccessTokenStatus = iota
+	AccessTokenRevoked
+	AccessTokenUserSuspended
+	AccessTokenSessionEnded
+)
+
+type RefreshToken struct {
+	UserID    int
+	FamilyID  string
+	SessionID int
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+// PasswordResetToken is a single-use token mailed to a user who forgot
+// their password. Only its hash is stored.
+type PasswordResetToken struct {
+	UserID    int
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type RefreshPayload struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type LogoutPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type ForgotPasswordPayload struct {
+	Email string `json:"email" validate:"required"`
+}
+
+type ResetPasswordPayload struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=6"`
+}
@@ -0,0 +1,49 @@
+package models
+
+import "errors"
+
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotEnroled = errors.New("start enrolment first")
+	ErrInvalidTwoFactor    = errors.New("invalid two-factor code")
+	ErrChallengeInvalid    = errors.New("invalid or expired login challenge")
+)
+
+// TwoFactorStore keeps the TOTP secrets and recovery codes of users.
+// Recovery codes are stored as hashes only.
+type TwoFactorStore interface {
+	GetTwoFactor(userID int) (*TwoFactor, error)
+	// SetPendingTwoFactor stores a secret that only takes effect once
+	// EnableTwoFactor confirms it.
+	SetPendingTwoFactor(userID int, secret string) error
+	EnableTwoFactor(userID int, recoveryCodeHashes []string) error
+	DisableTwoFactor(userID int) error
+	// UseTOTPStep records step as used, reporting false when it or a later
+	// step was already used so codes cannot be replayed.
+	UseTOTPStep(userID int, step int64) (bool, error)
+	// UseRecoveryCode consumes an unused recovery code, reporting whether
+	// one matched.
+	UseRecoveryCode(userID int, codeHash string) (bool, error)
+}
+
+type TwoFactor struct {
+	Secret  string
+	Enabled bool
+}
+
+type TwoFactorCodePayload struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// TwoFactorDisablePayload takes either a current code or a recovery code.
+type TwoFactorDisablePayload struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type TwoFactorLoginPayload struct {
+	ChallengeToken string `json:"challenge_token" validate:"required"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
@@ -1,21 +1,69 @@
 package models
 
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrUserSuspended         = errors.New("account suspended")
+	ErrPasswordResetRequired = errors.New("password reset required")
+	ErrEmailExists           = errors.New("email already exists")
+	ErrEmailNotVerified      = errors.New("email not verified")
+	ErrVerificationInvalid   = errors.New("invalid or expired verification token")
+)
+
+// Email verification policies. Unverified users can do everything under
+// VerifyPolicyOff, everything but create notes under VerifyPolicyNotes and
+// cannot log in under VerifyPolicyLogin.
+const (
+	VerifyPolicyOff   = "off"
+	VerifyPolicyNotes = "notes"
+	VerifyPolicyLogin = "login"
+)
+
 type UserStore interface {
 	CreateUser(user *UserRegisterPayload) error
+	// GetUserByEmail matches email regardless of case.
 	GetUserByEmail(email string) (*User, error)
 	GetUserByID(id int) (*User, error)
+	// MarkEmailVerified verifies the user's email if it is still email.
+	MarkEmailVerified(id int, email string) error
+}
+
+// UserAdminStore manages every account regardless of its owner. It backs
+// the admin API only.
+type UserAdminStore interface {
+	GetUserByID(id int) (*User, error)
+	GetUsers(opts *UserListOptions) (*UserList, error)
+	SetUserRole(id int, role string) error
+	SetUserSuspended(id int, suspended bool) error
+	RequirePasswordReset(id int) error
+	DeleteUser(id int) error
+}
+
+// ProfileStore lets users manage their own account.
+type ProfileStore interface {
+	GetUserByID(id int) (*User, error)
+	UpdateProfile(id int, profile *UserProfilePatch) error
+	UpdatePassword(id int, hashedPassword string, keepSessionID int) error
 }
 
 type User struct {
-	ID       int    `json:"id"`
-	Email    string `json:"email"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Role     string `json:"role"`
+	ID                    int        `json:"id"`
+	Email                 string     `json:"email"`
+	Username              string     `json:"username"`
+	Password              string     `json:"-"`
+	Role                  string     `json:"role"`
+	SuspendedAt           *time.Time `json:"suspended_at"`
+	PasswordResetRequired bool       `json:"password_reset_required"`
+	VerifiedAt            *time.Time `json:"verified_at"`
+	TwoFactorEnabled      bool       `json:"two_factor_enabled"`
+	CreatedAt             time.Time  `json:"created_at"`
 }
 
 type UserRegisterPayload struct {
-	Email    string `json:"email" validate:"required"`
+	Email    string `json:"email" validate:"required,email"`
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
 }
@@ -24,3 +72,43 @@ type UserLoginPayload struct {
 	Email    string `json:"email" validate:"required"`
 	Password string `json:"password" validate:"required"`
 }
+
+type VerifyEmailPayload struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type ResendVerificationPayload struct {
+	Email string `json:"email" validate:"required"`
+}
+
+// UserProfilePatch changes only the fields that are present.
+type UserProfilePatch struct {
+	Email    *string `json:"email" validate:"omitempty,email"`
+	Username *string `json:"username" validate:"omitempty,min=1"`
+}
+
+type UserPasswordPayload struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,min=6"`
+}
+
+// UserListOptions filters and pages the admin user list. Query matches
+// email or username case-insensitively; After is the last ID of the
+// previous page.
+type UserListOptions struct {
+	Limit     int
+	After     int
+	Query     string
+	Role      string
+	Suspended *bool
+}
+
+type UserList struct {
+	Users []*User
+	Total int
+	Next  *int
+}
+
+type UserRolePayload struct {
+	Role string `json:"role" validate:"required"`
+}
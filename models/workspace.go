@@ -0,0 +1,132 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrWorkspaceNotFound  = errors.New("workspace not found")
+	ErrWorkspaceRole      = errors.New("your workspace role does not allow this")
+	ErrWorkspaceLastOwner = errors.New("a workspace needs at least one owner")
+	ErrWorkspaceNotebook  = errors.New("workspace notes cannot be filed in notebooks")
+	ErrWorkspaceNoteShare = errors.New("workspace notes are shared by inviting members to the workspace")
+	ErrMemberNotFound     = errors.New("member not found")
+	ErrAlreadyMember      = errors.New("user is already a member of the workspace")
+	ErrInvitationNotFound = errors.New("invitation not found or expired")
+	ErrInvitationEmail    = errors.New("this invitation is for another email address")
+)
+
+// Workspace member roles, from least to most. Owners and admins manage
+// members and can do anything owners of personal notes can to the
+// workspace's notes; editors write notes and viewers read them. Only owners
+// can delete the workspace or make other owners.
+const (
+	WorkspaceViewer = "viewer"
+	WorkspaceEditor = "editor"
+	WorkspaceAdmin  = "admin"
+	WorkspaceOwner  = "owner"
+)
+
+var workspaceRanks = map[string]int{
+	WorkspaceViewer: 1,
+	WorkspaceEditor: 2,
+	WorkspaceAdmin:  3,
+	WorkspaceOwner:  4,
+}
+
+func IsValidWorkspaceRole(role string) bool {
+	_, ok := workspaceRanks[role]
+	return ok
+}
+
+// WorkspaceRolePermits reports whether a member with role have may do what
+// needs role need. An empty have grants nothing.
+func WorkspaceRolePermits(have, need string) bool {
+	return workspaceRanks[have] > 0 && workspaceRanks[have] >= workspaceRanks[need]
+}
+
+// WorkspaceStore methods take the ID of the authenticated caller and fail
+// with ErrWorkspaceNotFound for workspaces they are not a member of, and
+// with ErrWorkspaceRole when their role is too low. Members can only give
+// out roles up to their own, and only change or remove members whose role
+// is not above theirs. Anyone but the last owner can leave.
+type WorkspaceStore interface {
+	// CreateWorkspace makes the caller the new workspace's owner.
+	CreateWorkspace(userID int, workspace *WorkspacePayload) (*Workspace, error)
+	GetWorkspaces(userID int) ([]*Workspace, error)
+	GetWorkspace(userID, id int) (*Workspace, error)
+	UpdateWorkspace(userID, id int, workspace *WorkspacePayload) error
+	// DeleteWorkspace deletes the workspace with all of its notes.
+	DeleteWorkspace(userID, id int) error
+	GetMembers(userID, id int) ([]*WorkspaceMember, error)
+	UpdateMemberRole(userID, id, memberID int, role string) error
+	RemoveMember(userID, id, memberID int) error
+	// CreateInvitation replaces any pending invitation of the same email.
+	CreateInvitation(userID int, invitation *WorkspaceInvitation) error
+	GetInvitations(userID, id int) ([]*WorkspaceInvitation, error)
+	// SetInvitationDelivery records whether the email of the invitation with
+	// tokenHash went out. It does nothing once the invitation was replaced.
+	SetInvitationDelivery(tokenHash, delivery string) error
+	DeleteInvitation(userID, id, invitationID int) error
+	// AcceptInvitation adds the caller to the workspace of an unexpired
+	// invitation sent to their email, and uses the invitation up.
+	AcceptInvitation(userID int, tokenHash string) (*Workspace, error)
+}
+
+// Workspace is a shared collection of notes. Role is the caller's role in
+// it.
+type Workspace struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Role        string    `json:"role"`
+	MemberCount int       `json:"member_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type WorkspacePayload struct {
+	Name string `json:"name" validate:"required,max=100"`
+}
+
+type WorkspaceMember struct {
+	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WorkspaceRolePayload struct {
+	Role string `json:"role" validate:"required"`
+}
+
+// WorkspaceInvitation lets whoever registered with Email join the workspace
+// as Role. Only a hash of its token is stored; the token is emailed.
+type WorkspaceInvitation struct {
+	ID          int       `json:"id"`
+	WorkspaceID int       `json:"workspace_id"`
+	Email       string    `json:"email"`
+	Role        string    `json:"role"`
+	TokenHash   string    `json:"-"`
+	InvitedBy   int       `json:"invited_by"`
+	Delivery    string    `json:"delivery"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Delivery states of invitation emails, in WorkspaceInvitation.Delivery.
+const (
+	InvitationQueued = "queued"
+	InvitationSent   = "sent"
+	InvitationFailed = "failed"
+)
+
+type WorkspaceInvitationPayload struct {
+	Email string `json:"email" validate:"required,email"`
+	Role  string `json:"role" validate:"required"`
+}
+
+type AcceptInvitationPayload struct {
+	Token string `json:"token" validate:"required"`
+}
@@ -0,0 +1,165 @@
+// Package oidctest runs an in-process OpenID Connect issuer for tests.
+package oidctest
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"go-note/jwtkeys"
+	"go-note/oidc"
+	"go-note/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Issuer signs in whoever Identity is set to, without asking, and
+// implements just enough of OpenID Connect for the authorization code flow
+// with PKCE.
+type Issuer struct {
+	*httptest.Server
+	ClientID string
+
+	mu       sync.Mutex
+	identity oidc.Identity
+	keys     *jwtkeys.KeySet
+	grants   map[string]grant
+}
+
+type grant struct {
+	identity    oidc.Identity
+	redirectURI string
+	nonce       string
+	challenge   string
+}
+
+// NewIssuer starts an issuer for clientID. Close it when done.
+func NewIssuer(clientID string) *Issuer {
+	i := &Issuer{ClientID: clientID, grants: make(map[string]grant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", i.handleDiscovery)
+	mux.HandleFunc("/authorize", i.handleAuthorize)
+	mux.HandleFunc("/token", i.handleToken)
+	mux.HandleFunc("/jwks", i.handleJWKS)
+	i.Server = httptest.NewServer(mux)
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	i.keys, err = jwtkeys.New(i.URL, clientID, key)
+	if err != nil {
+		panic(err)
+	}
+
+	return i
+}
+
+// SetIdentity sets who signs in at the authorization endpoint from now on.
+func (i *Issuer) SetIdentity(identity oidc.Identity) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.identity = identity
+}
+
+func (i *Issuer) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 i.URL,
+		"authorization_endpoint": i.URL + "/authorize",
+		"token_endpoint":         i.URL + "/token",
+		"jwks_uri":               i.URL + "/jwks",
+	})
+}
+
+// handleAuthorize redirects straight back to the client with a code.
+func (i *Issuer) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != i.ClientID || query.Get("response_type") != "code" ||
+		query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code, err := utils.RandomToken(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	i.mu.Lock()
+	i.grants[code] = grant{
+		identity:    i.identity,
+		redirectURI: query.Get("redirect_uri"),
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+	}
+	i.mu.Unlock()
+
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	redirect.RawQuery = params.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (i *Issuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	code := r.PostForm.Get("code")
+
+	i.mu.Lock()
+	g, ok := i.grants[code]
+	delete(i.grants, code)
+	i.mu.Unlock()
+
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("client_id") != i.ClientID ||
+		r.PostForm.Get("redirect_uri") != g.redirectURI || oidc.Challenge(r.PostForm.Get("code_verifier")) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := i.keys.Sign(jwt.MapClaims{
+		"sub":            g.identity.Subject,
+		"aud":            i.ClientID,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"nonce":          g.nonce,
+		"email":          g.identity.Email,
+		"email_verified": g.identity.EmailVerified,
+		"name":           g.identity.Name,
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "unused",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+func (i *Issuer) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, i.keys.JWKS())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,26 @@
+package admin
+
+import (
+	"go-note/models"
+	"go-note/utils"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type Handler struct{}
+
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// RegisterRoutes expects router to already require the admin role.
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+
+	router.HandleFunc("/roles", h.HandleGetRoles).Methods("GET")
+
+}
+
+func (h *Handler) HandleGetRoles(w http.ResponseWriter, r *http.Request) {
+	utils.ResponseJSON(w, http.StatusOK, "Roles fetched successfully", models.RolePermissions)
+}
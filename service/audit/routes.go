@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+type Handler struct {
+	store models.AuditStore
+}
+
+func NewHandler(store models.AuditStore) *Handler {
+	return &Handler{store: store}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.Handle("/me/audit", middlewares.JWTMiddleware(middlewares.SessionOnly(http.HandlerFunc(h.HandleGetMyAudit)))).Methods("GET")
+}
+
+// RegisterAdminRoutes expects router to already require the admin role.
+func (h *Handler) RegisterAdminRoutes(router *mux.Router) {
+	router.HandleFunc("/audit", h.HandleGetAudit).Methods("GET")
+}
+
+// HandleGetMyAudit lists the audit log of the authenticated user's own
+// account, filtered by action, since and until.
+func (h *Handler) HandleGetMyAudit(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	opts, ok := listOptions(w, r)
+	if !ok {
+		return
+	}
+	opts.UserID = userID
+
+	h.respondEvents(w, opts)
+}
+
+// HandleGetAudit lists the whole audit log, additionally filtered by
+// user_id, actor_id and ip.
+func (h *Handler) HandleGetAudit(w http.ResponseWriter, r *http.Request) {
+	opts, ok := listOptions(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	for key, field := range map[string]*int{"user_id": &opts.UserID, "actor_id": &opts.ActorID} {
+		if value := query.Get(key); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil || id < 1 {
+				utils.ResponseJSON(w, http.StatusBadRequest, "invalid "+key, false)
+				return
+			}
+			*field = id
+		}
+	}
+	opts.IP = query.Get("ip")
+
+	h.respondEvents(w, opts)
+}
+
+// listOptions reads the filters and paging shared by both listings.
+func listOptions(w http.ResponseWriter, r *http.Request) (*models.AuditListOptions, bool) {
+	query := r.URL.Query()
+	opts := &models.AuditListOptions{
+		Limit:  defaultPageSize,
+		Action: query.Get("action"),
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			utils.ResponseJSON(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxPageSize), false)
+			return nil, false
+		}
+		opts.Limit = n
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		before, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			utils.ResponseJSON(w, http.StatusBadRequest, "invalid cursor", false)
+			return nil, false
+		}
+		opts.Before = before
+	}
+
+	for key, field := range map[string]*time.Time{"since": &opts.Since, "until": &opts.Until} {
+		if value := query.Get(key); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				utils.ResponseJSON(w, http.StatusBadRequest, key+" must be an RFC 3339 time", false)
+				return nil, false
+			}
+			*field = t
+		}
+	}
+
+	return opts, true
+}
+
+func (h *Handler) respondEvents(w http.ResponseWriter, opts *models.AuditListOptions) {
+	list, err := h.store.GetAuditEvents(opts)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	page := utils.Pagination{Count: len(list.Events), Total: list.Total}
+	if list.Next != nil {
+		page.NextCursor = strconv.FormatInt(*list.Next, 10)
+	}
+
+	utils.ResponsePageJSON(w, http.StatusOK, "Audit log fetched successfully", list.Events, page)
+}
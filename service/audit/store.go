@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-note/models"
+	"strings"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// CreateAuditEvents appends events in a single insert.
+func (s *Store) CreateAuditEvents(events []*models.AuditEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	values := make([]string, 0, len(events))
+	args := make([]interface{}, 0, len(events)*8)
+	for _, e := range events {
+		details, err := json.Marshal(e.Details)
+		if err != nil {
+			return err
+		}
+		if e.Details == nil {
+			details = []byte("{}")
+		}
+
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8))
+		args = append(args, e.Action, nullID(e.ActorID), nullID(e.UserID), e.Target, e.IP, e.UserAgent, string(details), e.CreatedAt)
+	}
+
+	sqlQuery := `INSERT INTO audit_log (action, actor_id, user_id, target, ip, user_agent, details, created_at) VALUES ` +
+		strings.Join(values, ", ")
+	_, err := s.db.Exec(sqlQuery, args...)
+
+	return err
+}
+
+// GetAuditEvents pages through the log newest first.
+func (s *Store) GetAuditEvents(opts *models.AuditListOptions) (*models.AuditList, error) {
+	where := []string{"TRUE"}
+	args := []interface{}{}
+
+	if opts.UserID > 0 {
+		args = append(args, opts.UserID)
+		where = append(where, fmt.Sprintf("user_id = $%d", len(args)))
+	}
+	if opts.ActorID > 0 {
+		args = append(args, opts.ActorID)
+		where = append(where, fmt.Sprintf("actor_id = $%d", len(args)))
+	}
+	if opts.Action != "" {
+		args = append(args, opts.Action)
+		where = append(where, fmt.Sprintf("action = $%d", len(args)))
+	}
+	if opts.IP != "" {
+		args = append(args, opts.IP)
+		where = append(where, fmt.Sprintf("ip = $%d", len(args)))
+	}
+	if !opts.Since.IsZero() {
+		args = append(args, opts.Since)
+		where = append(where, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !opts.Until.IsZero() {
+		args = append(args, opts.Until)
+		where = append(where, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+
+	total := 0
+	countQuery := `SELECT COUNT(*) FROM audit_log WHERE ` + strings.Join(where, " AND ")
+	err := s.db.QueryRow(countQuery, args...).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Before > 0 {
+		args = append(args, opts.Before)
+		where = append(where, fmt.Sprintf("id < $%d", len(args)))
+	}
+
+	args = append(args, opts.Limit+1)
+	sqlQuery := fmt.Sprintf(`SELECT id, action, COALESCE(actor_id, 0), COALESCE(user_id, 0), target, ip, user_agent, details, created_at
+		FROM audit_log WHERE %s ORDER BY id DESC LIMIT $%d`, strings.Join(where, " AND "), len(args))
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*models.AuditEvent, 0)
+	for rows.Next() {
+		e := new(models.AuditEvent)
+		var details []byte
+		err := rows.Scan(&e.ID, &e.Action, &e.ActorID, &e.UserID, &e.Target, &e.IP, &e.UserAgent, &details, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(details, &e.Details); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := &models.AuditList{Events: events, Total: total}
+	if len(events) > opts.Limit {
+		list.Events = events[:opts.Limit]
+		list.Next = &list.Events[opts.Limit-1].ID
+	}
+
+	return list, nil
+}
+
+// nullID stores 0 as NULL, meaning no user.
+func nullID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+
+	return id
+}
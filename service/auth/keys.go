@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"encoding/json"
+	"go-note/jwtkeys"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// SetKeySet sets the keys access, verification and challenge tokens are
+// signed with. Until it is called no tokens can be issued.
+func (h *Handler) SetKeySet(ks *jwtkeys.KeySet) {
+	h.keys = ks
+}
+
+// RegisterWellKnownRoutes registers the JWKS document on the root router,
+// outside the API prefix where clients expect it.
+func (h *Handler) RegisterWellKnownRoutes(router *mux.Router) {
+	router.HandleFunc("/.well-known/jwks.json", h.HandleJWKS).Methods("GET")
+}
+
+// HandleJWKS publishes the public keys tokens are verified with, so other
+// services can check access tokens themselves. It is a bare JWKS document
+// rather than the usual response envelope.
+func (h *Handler) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	set := jwtkeys.JWKS{Keys: []jwtkeys.JWK{}}
+	if h.keys != nil {
+		set = h.keys.JWKS()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"go-note/limiter"
+	"go-note/models"
+	"go-note/utils"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SetLoginLimiters sets how failed logins are tracked per account and per
+// client IP address. Both default to in-memory limiters, which only see the
+// attempts made against this instance.
+func (h *Handler) SetLoginLimiters(account, ip limiter.Limiter) {
+	h.accountLimiter = account
+	h.ipLimiter = ip
+}
+
+// loginKeys returns the limiter keys of a login attempt for email.
+func loginKeys(r *http.Request, email string) (string, string) {
+	return "account:" + strings.ToLower(strings.TrimSpace(email)), "ip:" + utils.ClientIP(r)
+}
+
+// checkLockout responds with 429 and reports false while either key is
+// locked out.
+func (h *Handler) checkLockout(w http.ResponseWriter, accountKey, ipKey string) bool {
+	wait, err := h.accountLimiter.Check(accountKey)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return false
+	}
+
+	ipWait, err := h.ipLimiter.Check(ipKey)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return false
+	}
+	if ipWait > wait {
+		wait = ipWait
+	}
+
+	if wait <= 0 {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	utils.ResponseJSON(w, http.StatusTooManyRequests, "too many failed login attempts, try again later", false)
+
+	return false
+}
+
+// recordLoginFailure audits a failed attempt to log in as email, of the
+// account userID when there is one, and counts it against the account and
+// the client IP address. The attempt itself has already failed, so limiter
+// errors are only logged.
+func (h *Handler) recordLoginFailure(r *http.Request, email string, userID int, reason string) {
+	h.auditLoginFailure(r, email, userID, reason)
+
+	accountKey, ipKey := loginKeys(r, email)
+	h.recordFailure(r, h.accountLimiter, accountKey, userID)
+	h.recordFailure(r, h.ipLimiter, ipKey, userID)
+}
+
+// auditLoginFailure records a refused login without counting it towards a
+// lockout, for accounts that exist but may not log in.
+func (h *Handler) auditLoginFailure(r *http.Request, email string, userID int, reason string) {
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditLoginFailed,
+		UserID:  userID,
+		Details: map[string]string{"email": email, "reason": reason},
+	})
+}
+
+// recordLoginSuccess forgets the failed attempts on the account. The IP
+// address keeps its count so one valid account cannot be used to keep
+// guessing at others.
+func (h *Handler) recordLoginSuccess(accountKey string) {
+	if err := h.accountLimiter.Reset(accountKey); err != nil {
+		log.Println("resetting login attempts:", err)
+	}
+}
+
+func (h *Handler) recordFailure(r *http.Request, l limiter.Limiter, key string, userID int) {
+	lock, err := l.Fail(key)
+	if err != nil {
+		log.Println("recording failed login:", err)
+		return
+	}
+
+	if lock > 0 {
+		h.auditLog.Record(r, &models.AuditEvent{
+			Action: models.AuditLoginLockedOut,
+			UserID: userID,
+			Target: key,
+			Details: map[string]string{
+				"until": time.Now().Add(lock).UTC().Format(time.RFC3339),
+			},
+		})
+	}
+}
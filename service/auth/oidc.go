@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"go-note/models"
+	"go-note/oidc"
+	"go-note/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+const (
+	oidcStatePurpose = "oidc_state"
+	oidcStateCookie  = "oidc_state"
+	// oidcStateTTL bounds how long a user may spend at the provider.
+	oidcStateTTL = 10 * time.Minute
+)
+
+// SetIdentityStore enables OpenID Connect logins, linking provider accounts
+// to users through store.
+func (h *Handler) SetIdentityStore(store models.IdentityStore) {
+	h.identities = store
+}
+
+// AddOIDCProvider serves provider under /auth/oidc/{name}/.
+func (h *Handler) AddOIDCProvider(name string, provider *oidc.Provider) {
+	if h.oidcProviders == nil {
+		h.oidcProviders = make(map[string]*oidc.Provider)
+	}
+	h.oidcProviders[name] = provider
+}
+
+// HandleOIDCLogin sends the user to the provider to sign in. The state,
+// nonce and PKCE verifier travel in a signed cookie so the callback can
+// check them without server-side storage.
+func (h *Handler) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := h.oidcProvider(w, name)
+	if !ok {
+		return
+	}
+
+	state, err := utils.RandomToken(16)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+	nonce, err := utils.RandomToken(16)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadGateway, err.Error(), false)
+		return
+	}
+
+	stateToken, err := h.signPurposeToken(oidcStatePurpose, 0, jwt.MapClaims{
+		"provider": name,
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+	}, oidcStateTTL)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    stateToken,
+		Path:     "/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(provider.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// HandleOIDCCallback finishes a login started by HandleOIDCLogin and
+// responds like Login User.
+func (h *Handler) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := h.oidcProvider(w, name)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		utils.ResponseJSON(w, http.StatusUnauthorized, "login refused by provider: "+reason, false)
+		return
+	}
+
+	claims, ok := h.oidcState(r, name)
+	if !ok {
+		utils.ResponseJSON(w, http.StatusBadRequest, models.ErrOIDCStateInvalid.Error(), false)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+
+	verifier, _ := claims["verifier"].(string)
+	nonce, _ := claims["nonce"].(string)
+	identity, err := provider.Exchange(r.Context(), query.Get("code"), verifier, nonce)
+	if errors.Is(err, oidc.ErrInvalidIDToken) {
+		utils.ResponseJSON(w, http.StatusUnauthorized, err.Error(), false)
+		return
+	}
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadGateway, err.Error(), false)
+		return
+	}
+
+	u, err := h.userForIdentity(r, name, provider, identity)
+	switch err {
+	case nil:
+	case models.ErrIdentityEmailUnverified, models.ErrIdentityNoAccount, models.ErrIdentityLinkUnverified:
+		utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+		return
+	case models.ErrEmailExists:
+		utils.ResponseJSON(w, http.StatusConflict, err.Error(), false)
+		return
+	default:
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	if err := h.checkAccount(u); err != nil {
+		h.auditLoginFailure(r, u.Email, u.ID, err.Error())
+		utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+		return
+	}
+
+	if u.TwoFactorEnabled {
+		h.respondChallenge(w, u)
+		return
+	}
+
+	h.respondLogin(w, r, u, "oidc:"+name)
+}
+
+func (h *Handler) oidcProvider(w http.ResponseWriter, name string) (*oidc.Provider, bool) {
+	provider, ok := h.oidcProviders[name]
+	if !ok || h.identities == nil {
+		utils.ResponseJSON(w, http.StatusNotFound, "unknown identity provider", false)
+		return nil, false
+	}
+
+	return provider, true
+}
+
+// oidcState returns the claims of the state cookie when it was issued for
+// this provider and matches the state the provider sent back.
+func (h *Handler) oidcState(r *http.Request, name string) (jwt.MapClaims, bool) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return nil, false
+	}
+
+	_, claims, err := h.parsePurposeToken(oidcStatePurpose, cookie.Value)
+	if err != nil {
+		return nil, false
+	}
+
+	state, _ := claims["state"].(string)
+	if claims["provider"] != name || state == "" ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(r.URL.Query().Get("state"))) != 1 {
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// userForIdentity returns the user linked to identity. An unlinked identity
+// is linked to the account with its email, provided both the provider and
+// the account have verified that email, or gets a new account when the
+// provider allows signups.
+func (h *Handler) userForIdentity(r *http.Request, name string, provider *oidc.Provider, identity *oidc.Identity) (*models.User, error) {
+	u, err := h.identities.GetUserByIdentity(name, identity.Subject)
+	if err != sql.ErrNoRows {
+		return u, err
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, models.ErrIdentityEmailUnverified
+	}
+
+	external := &models.ExternalIdentity{Provider: name, Subject: identity.Subject, Email: identity.Email}
+
+	u, err = h.store.GetUserByEmail(identity.Email)
+	if err == nil {
+		if u.VerifiedAt == nil {
+			return nil, models.ErrIdentityLinkUnverified
+		}
+		if err := h.identities.LinkIdentity(u.ID, external); err != nil {
+			return nil, err
+		}
+		h.auditLog.Record(r, &models.AuditEvent{
+			Action:  models.AuditIdentityLinked,
+			ActorID: u.ID,
+			UserID:  u.ID,
+			Target:  "identity:" + name,
+		})
+		return u, nil
+	}
+
+	if !provider.AllowSignup {
+		return nil, models.ErrIdentityNoAccount
+	}
+
+	// The account gets a random password; the user can choose one through
+	// Forgot Password.
+	password, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	username := identity.Name
+	if username == "" {
+		username, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	u, err = h.identities.CreateUserWithIdentity(&models.UserRegisterPayload{
+		Email:    identity.Email,
+		Username: username,
+		Password: hashedPassword,
+	}, external)
+	if err != nil {
+		return nil, err
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditRegistered,
+		ActorID: u.ID,
+		UserID:  u.ID,
+		Target:  "identity:" + name,
+	})
+	return u, nil
+}
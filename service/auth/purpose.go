@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signPurposeToken signs a short-lived token for userID carrying extra
+// claims. Its audience is the purpose, which keeps it from being accepted
+// anywhere but where parsePurposeToken expects that purpose, JWTMiddleware
+// included.
+func (h *Handler) signPurposeToken(purpose string, userID int, extra jwt.MapClaims, ttl time.Duration) (string, error) {
+	if h.keys == nil {
+		return "", fmt.Errorf("no signing key configured")
+	}
+
+	claims := jwt.MapClaims{
+		"sub": strconv.Itoa(userID),
+		"aud": purpose,
+		"exp": time.Now().Add(ttl).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+
+	return h.keys.Sign(claims)
+}
+
+func (h *Handler) parsePurposeToken(purpose, tokenString string) (int, jwt.MapClaims, error) {
+	if h.keys == nil {
+		return 0, nil, fmt.Errorf("no signing key configured")
+	}
+
+	claims, err := h.keys.Parse(tokenString, purpose)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	sub, _ := claims.GetSubject()
+	userID, err := strconv.Atoi(sub)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid subject: %v", err)
+	}
+
+	return userID, claims, nil
+}
@@ -1,28 +1,130 @@
 package auth
 
 import (
+	"database/sql"
 	"fmt"
+	"go-note/auditlog"
+	"go-note/jwtkeys"
+	"go-note/limiter"
+	"go-note/mailer"
 	"go-note/middlewares"
 	"go-note/models"
+	"go-note/oidc"
 	"go-note/utils"
+	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/gorilla/mux"
 )
 
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+	DefaultResetTokenTTL   = time.Hour
+)
+
 type Handler struct {
-	store models.UserStore
+	store           models.UserStore
+	tokens          models.TokenStore
+	sessions        models.SessionStore
+	twoFactor       models.TwoFactorStore
+	mail            mailer.Mailer
+	mailQueue       *mailer.Queue
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	resetURL        string
+	resetTokenTTL   time.Duration
+	verifyPolicy    string
+	verifyURL       string
+	verifyTokenTTL  time.Duration
+	totpIssuer      string
+	accountLimiter  limiter.Limiter
+	ipLimiter       limiter.Limiter
+	keys            *jwtkeys.KeySet
+	identities      models.IdentityStore
+	oidcProviders   map[string]*oidc.Provider
+	auditLog        auditlog.Recorder
+}
+
+// NewHandler returns a handler that logs outgoing emails until SetMailer is
+// called, runs password reset and resent verification emails on its own
+// queue until SetMailQueue is called, tracks failed logins in memory until SetLoginLimiters is called and
+// logs audit events until SetAuditRecorder is called.
+func NewHandler(store models.UserStore, tokens models.TokenStore, twoFactor models.TwoFactorStore) *Handler {
+	return &Handler{
+		store:           store,
+		tokens:          tokens,
+		twoFactor:       twoFactor,
+		mail:            mailer.NewLogMailer(log.Writer(), ""),
+		mailQueue:       mailer.NewQueue(mailer.DefaultQueueSize),
+		accessTokenTTL:  DefaultAccessTokenTTL,
+		refreshTokenTTL: DefaultRefreshTokenTTL,
+		resetTokenTTL:   DefaultResetTokenTTL,
+		verifyPolicy:    models.VerifyPolicyNotes,
+		verifyTokenTTL:  DefaultVerificationTTL,
+		totpIssuer:      DefaultTOTPIssuer,
+		accountLimiter:  limiter.NewMemory(limiter.DefaultAccountPolicy),
+		ipLimiter:       limiter.NewMemory(limiter.DefaultIPPolicy),
+		auditLog:        auditlog.NewLogRecorder(log.Writer()),
+	}
+}
+
+// SetAuditRecorder sets where logins, registrations, password resets and
+// logouts are recorded.
+func (h *Handler) SetAuditRecorder(rec auditlog.Recorder) {
+	h.auditLog = rec
+}
+
+func (h *Handler) SetMailer(m mailer.Mailer) {
+	h.mail = m
+}
+
+// SetSessionStore sets the store logout ends the current session in.
+// Without one, logout only revokes the access token and the refresh token
+// it is given.
+func (h *Handler) SetSessionStore(store models.SessionStore) {
+	h.sessions = store
 }
 
-func NewHandler(store models.UserStore) *Handler {
-	return &Handler{store: store}
+// SetMailQueue sets the queue password reset and resent verification emails
+// are sent from.
+func (h *Handler) SetMailQueue(q *mailer.Queue) {
+	h.mailQueue = q
+}
+
+// SetPasswordReset sets the page reset emails link to, which receives the
+// token as its token query parameter, and how long reset tokens stay valid.
+// Without a URL the email contains the bare token.
+func (h *Handler) SetPasswordReset(resetURL string, ttl time.Duration) {
+	h.resetURL = resetURL
+	h.resetTokenTTL = ttl
+}
+
+// SetTokenTTLs sets how long issued access and refresh tokens stay valid.
+func (h *Handler) SetTokenTTLs(access, refresh time.Duration) {
+	h.accessTokenTTL = access
+	h.refreshTokenTTL = refresh
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/auth/login", h.HandleLogin).Methods("POST")
 	router.HandleFunc("/auth/register", h.HandleRegister).Methods("POST")
+	router.HandleFunc("/auth/refresh", h.HandleRefresh).Methods("POST")
+	router.HandleFunc("/auth/forgot-password", h.HandleForgotPassword).Methods("POST")
+	router.HandleFunc("/auth/reset-password", h.HandleResetPassword).Methods("POST")
+	router.HandleFunc("/auth/verify", h.HandleVerifyEmail).Methods("POST")
+	router.HandleFunc("/auth/verify/resend", h.HandleResendVerification).Methods("POST")
+	router.HandleFunc("/auth/2fa/login", h.HandleTwoFactorLogin).Methods("POST")
+	router.Handle("/auth/2fa/enroll", sessionOnly(h.HandleEnrollTwoFactor)).Methods("POST")
+	router.Handle("/auth/2fa/confirm", sessionOnly(h.HandleConfirmTwoFactor)).Methods("POST")
+	router.Handle("/auth/2fa/disable", sessionOnly(h.HandleDisableTwoFactor)).Methods("POST")
+	router.HandleFunc("/auth/oidc/{provider}/login", h.HandleOIDCLogin).Methods("GET")
+	router.HandleFunc("/auth/oidc/{provider}/callback", h.HandleOIDCCallback).Methods("GET")
+	router.Handle("/auth/logout", middlewares.JWTMiddleware(http.HandlerFunc(h.HandleLogout))).Methods("POST")
 }
 
 func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
@@ -38,30 +140,79 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	accountKey, ipKey := loginKeys(r, user.Email)
+	if !h.checkLockout(w, accountKey, ipKey) {
+		return
+	}
+
 	u, err := h.store.GetUserByEmail(user.Email)
 	if err != nil {
+		h.recordLoginFailure(r, user.Email, 0, "unknown email")
 		utils.ResponseJSON(w, http.StatusBadRequest, "invalid email or password", false)
 		return
 	}
-
 	if !utils.ComparePasswords(u.Password, []byte(user.Password)) {
+		h.recordLoginFailure(r, user.Email, u.ID, "wrong password")
 		utils.ResponseJSON(w, http.StatusBadRequest, "invalid email or password", false)
 		return
 	}
 
-	secret := []byte(os.Getenv("SECRET_KEY"))
-	token, err := middlewares.CreateJWT(secret, u.ID)
+	if err := h.checkAccount(u); err != nil {
+		h.auditLoginFailure(r, u.Email, u.ID, err.Error())
+		utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+		return
+	}
+
+	if u.TwoFactorEnabled {
+		h.respondChallenge(w, u)
+		return
+	}
+
+	h.recordLoginSuccess(accountKey)
+	h.respondLogin(w, r, u, "password")
+}
+
+// respondLogin starts a new session and refresh token family for u and
+// responds with the first token pair. method is recorded in the audit log.
+func (h *Handler) respondLogin(w http.ResponseWriter, r *http.Request, u *models.User, method string) {
+	familyID, err := utils.RandomToken(16)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	userAgent := r.UserAgent()
+	session := &models.Session{
+		UserID:    u.ID,
+		FamilyID:  familyID,
+		Device:    describeDevice(userAgent),
+		UserAgent: userAgent,
+		IP:        utils.ClientIP(r),
+		ExpiresAt: time.Now().Add(h.refreshTokenTTL),
+	}
+	if err := h.tokens.CreateSession(session); err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	refresh := &models.RefreshToken{UserID: u.ID, FamilyID: familyID, SessionID: session.ID}
+	response, err := h.issueTokens(refresh, h.tokens.CreateRefreshToken)
 	if err != nil {
 		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
 		return
 	}
-	response := map[string]interface{}{
-		"token": token,
-		"user": map[string]string{
-			"email":    u.Email,
-			"username": u.Username,
-		},
+	response["user"] = map[string]string{
+		"email":    u.Email,
+		"username": u.Username,
 	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditLoginSucceeded,
+		ActorID: u.ID,
+		UserID:  u.ID,
+		Target:  "session:" + strconv.Itoa(session.ID),
+		Details: map[string]string{"method": method},
+	})
 	utils.ResponseJSON(w, http.StatusOK, "success", response)
 }
 
@@ -95,9 +246,287 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		Username: user.Username,
 		Password: hashedPassword,
 	})
+	if err == models.ErrEmailExists {
+		utils.ResponseJSON(w, http.StatusBadRequest, "email already exists", user.Email)
+		return
+	}
 	if err != nil {
 		utils.ResponseJSON(w, http.StatusInternalServerError, "error", err)
 		return
 	}
+
+	u, err := h.store.GetUserByEmail(user.Email)
+	if err != nil {
+		log.Println("loading registered user:", err)
+		utils.ResponseJSON(w, http.StatusCreated, "register successfully", false)
+		return
+	}
+	h.auditLog.Record(r, &models.AuditEvent{Action: models.AuditRegistered, ActorID: u.ID, UserID: u.ID})
+
+	if h.verifyPolicy != models.VerifyPolicyOff {
+		if err := h.sendVerification(u); err != nil {
+			log.Println("sending verification email:", err)
+		}
+	}
+
 	utils.ResponseJSON(w, http.StatusCreated, "register successfully", false)
 }
+
+// HandleRefresh trades a refresh token for a new access token and the next
+// refresh token of the same family. Each refresh token works only once.
+func (h *Handler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	var payload models.RefreshPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return
+	}
+
+	oldHash := utils.HashToken(payload.RefreshToken)
+	refresh := &models.RefreshToken{}
+	response, err := h.issueTokens(refresh, func(next *models.RefreshToken) error {
+		return h.tokens.RotateRefreshToken(oldHash, next)
+	})
+	if err == models.ErrRefreshTokenReused {
+		h.auditLog.Record(r, &models.AuditEvent{
+			Action: models.AuditRefreshReused,
+			UserID: refresh.UserID,
+		})
+	}
+	if err != nil {
+		switch err {
+		case models.ErrRefreshTokenInvalid, models.ErrRefreshTokenReused:
+			utils.ResponseJSON(w, http.StatusUnauthorized, err.Error(), false)
+		case models.ErrUserSuspended, models.ErrPasswordResetRequired, models.ErrEmailNotVerified:
+			utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+		default:
+			utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		}
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditSessionRefreshed,
+		ActorID: refresh.UserID,
+		UserID:  refresh.UserID,
+		Target:  "session:" + strconv.Itoa(refresh.SessionID),
+	})
+	utils.ResponseJSON(w, http.StatusOK, "success", response)
+}
+
+// HandleLogout ends the session of the request, revoking its access and
+// refresh tokens, and, when given, the session of another refresh token.
+func (h *Handler) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload models.LogoutPayload
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := utils.ParseJSON(r, &payload); err != nil {
+			utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+			return
+		}
+	}
+
+	if payload.RefreshToken != "" {
+		err := h.tokens.RevokeRefreshFamily(userID, utils.HashToken(payload.RefreshToken))
+		if err != nil {
+			utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+			return
+		}
+	}
+
+	if sessionID := middlewares.GetSessionFromContext(r.Context()); sessionID != 0 && h.sessions != nil {
+		err := h.sessions.RevokeSession(userID, sessionID)
+		if err != nil && err != sql.ErrNoRows {
+			utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+			return
+		}
+	}
+
+	jti, expiresAt := middlewares.GetTokenFromContext(r.Context())
+	if jti != "" {
+		if err := h.tokens.RevokeAccessToken(jti, expiresAt); err != nil {
+			utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+			return
+		}
+	}
+
+	event := &models.AuditEvent{Action: models.AuditLogout, ActorID: userID, UserID: userID}
+	if sessionID := middlewares.GetSessionFromContext(r.Context()); sessionID != 0 {
+		event.Target = "session:" + strconv.Itoa(sessionID)
+	}
+	h.auditLog.Record(r, event)
+
+	utils.ResponseJSON(w, http.StatusOK, "logout success", false)
+}
+
+// HandleForgotPassword mails a reset link to the address if it belongs to an
+// account. The lookup and the email happen on the mail queue, so neither the
+// response nor how long it takes reveals which emails are registered.
+func (h *Handler) HandleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload models.ForgotPasswordPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return
+	}
+
+	email := payload.Email
+	if !h.mailQueue.Go(func() { h.mailPasswordReset(email) }) {
+		log.Println("sending password reset: mail queue full")
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "if the email is registered, a reset link has been sent", false)
+}
+
+// HandleResetPassword sets a new password using a token from a reset email.
+// Each token works once, and all sessions of the user are signed out.
+func (h *Handler) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload models.ResetPasswordPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(payload.Password)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	userID, err := h.tokens.ResetPassword(utils.HashToken(payload.Token), hashedPassword)
+	if err == models.ErrResetTokenInvalid {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{Action: models.AuditPasswordReset, ActorID: userID, UserID: userID})
+
+	utils.ResponseJSON(w, http.StatusOK, "password reset successfully", false)
+}
+
+// mailPasswordReset sends a reset link to the account with email, if there
+// is one that isn't suspended.
+func (h *Handler) mailPasswordReset(email string) {
+	u, err := h.store.GetUserByEmail(email)
+	if err != nil || u.SuspendedAt != nil {
+		return
+	}
+
+	if err := h.sendPasswordReset(u); err != nil {
+		log.Println("sending password reset:", err)
+	}
+}
+
+func (h *Handler) sendPasswordReset(u *models.User) error {
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	err = h.tokens.CreatePasswordResetToken(&models.PasswordResetToken{
+		UserID:    u.ID,
+		TokenHash: utils.HashToken(token),
+		ExpiresAt: time.Now().Add(h.resetTokenTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := token
+	if h.resetURL != "" {
+		link = h.resetURL + "?token=" + url.QueryEscape(token)
+	}
+
+	return h.mail.Send(&mailer.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the following to choose a new password. It expires in %s.\n\n%s\n\n"+
+			"If you did not ask to reset your password you can ignore this email.\n", u.Username, h.resetTokenTTL, link),
+	})
+}
+
+// issueTokens generates a refresh token, lets save persist it (filling in
+// the user, family and session when rotating) and signs an access token with the
+// user's current role to go with it.
+func (h *Handler) issueTokens(refresh *models.RefreshToken, save func(*models.RefreshToken) error) (map[string]interface{}, error) {
+	refreshToken, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh.TokenHash = utils.HashToken(refreshToken)
+	refresh.ExpiresAt = time.Now().Add(h.refreshTokenTTL)
+	if err := save(refresh); err != nil {
+		return nil, err
+	}
+
+	u, err := h.store.GetUserByID(refresh.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.checkAccount(u); err != nil {
+		return nil, err
+	}
+
+	if h.keys == nil {
+		return nil, fmt.Errorf("no signing key configured")
+	}
+
+	token, _, err := middlewares.CreateJWT(h.keys, u.ID, refresh.SessionID, u.Role, u.VerifiedAt != nil, h.accessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(h.accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// sessionOnly authenticates handler with an access token, refusing personal
+// access tokens.
+func sessionOnly(handler http.HandlerFunc) http.Handler {
+	return middlewares.JWTMiddleware(middlewares.SessionOnly(handler))
+}
+
+// checkAccount rejects users that an admin has suspended or flagged for a
+// password reset, and unverified users when the policy requires
+// verification to log in.
+func (h *Handler) checkAccount(u *models.User) error {
+	if u.SuspendedAt != nil {
+		return models.ErrUserSuspended
+	}
+	if u.PasswordResetRequired {
+		return models.ErrPasswordResetRequired
+	}
+	if u.VerifiedAt == nil && h.verifyPolicy == models.VerifyPolicyLogin {
+		return models.ErrEmailNotVerified
+	}
+
+	return nil
+}
@@ -2,22 +2,40 @@ package auth
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"go-note/models"
+	"go-note/utils"
+	"time"
 )
 
+var errNoSecretBox = errors.New("no TOTP encryption key configured")
+
+const userColumns = `id, email, username, password, role, suspended_at, password_reset_required, created_at, verified_at, totp_enabled_at IS NOT NULL`
+
 type Store struct {
-	db *sql.DB
+	db      *sql.DB
+	secrets *utils.SecretBox
 }
 
 func NewStore(db *sql.DB) *Store {
 	return &Store{db: db}
 }
 
+// SetSecretBox sets the key TOTP secrets are encrypted with. It is required:
+// the api refuses to start without a valid TOTP_ENCRYPTION_KEY, and until it
+// is set every read or write of a stored secret fails with errNoSecretBox.
+func (s *Store) SetSecretBox(box *utils.SecretBox) {
+	s.secrets = box
+}
+
 func (s *Store) CreateUser(user *models.UserRegisterPayload) error {
 	fmt.Println(user, "call me coks")
 	sqlQuery := `INSERT INTO users (email, username, password) VALUES ($1, $2, $3)`
 	_, err := s.db.Exec(sqlQuery, user.Email, user.Username, user.Password)
+	if utils.IsUniqueViolation(err) {
+		return models.ErrEmailExists
+	}
 	if err != nil {
 		return err
 	}
@@ -25,8 +43,9 @@ func (s *Store) CreateUser(user *models.UserRegisterPayload) error {
 	return nil
 }
 
+// GetUserByEmail matches email regardless of case.
 func (s *Store) GetUserByEmail(email string) (*models.User, error) {
-	sqlQuery := `SELECT * FROM users WHERE email = $1`
+	sqlQuery := `SELECT ` + userColumns + ` FROM users WHERE lower(email) = lower($1)`
 
 	rows, err := s.db.Query(sqlQuery, email)
 	if err != nil {
@@ -49,7 +68,7 @@ func (s *Store) GetUserByEmail(email string) (*models.User, error) {
 }
 
 func (s *Store) GetUserByID(id int) (*models.User, error) {
-	rows, err := s.db.Query("SELECT * FROM users WHERE id = ?", id)
+	rows, err := s.db.Query(`SELECT `+userColumns+` FROM users WHERE id = $1`, id)
 	if err != nil {
 		return nil, err
 	}
@@ -69,6 +88,462 @@ func (s *Store) GetUserByID(id int) (*models.User, error) {
 	return u, nil
 }
 
+// MarkEmailVerified records the first verification of the user's email. It
+// fails with ErrVerificationInvalid when the user changed their email since
+// the verification was sent.
+func (s *Store) MarkEmailVerified(id int, email string) error {
+	sqlQuery := `UPDATE users SET verified_at = COALESCE(verified_at, now()) WHERE id = $1 AND lower(email) = lower($2)`
+	res, err := s.db.Exec(sqlQuery, id, email)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrVerificationInvalid
+	}
+
+	return nil
+}
+
+func (s *Store) CreateSession(session *models.Session) error {
+	sqlQuery := `
+		INSERT INTO sessions (user_id, family_id, device, user_agent, ip, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, last_seen_at`
+	return s.db.QueryRow(sqlQuery, session.UserID, session.FamilyID, session.Device, session.UserAgent, session.IP, session.ExpiresAt).
+		Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
+}
+
+// CheckAccessToken looks up in a single query whether the token's jti was
+// revoked, its user suspended or its session ended. It records the session
+// as seen at most once a minute, so most requests do not write.
+func (s *Store) CheckAccessToken(jti string, userID, sessionID int) (models.AccessTokenStatus, error) {
+	sqlQuery := `
+		WITH touched AS (
+			UPDATE sessions SET last_seen_at = now()
+			WHERE id = $3 AND user_id = $2 AND revoked_at IS NULL AND expires_at > now()
+				AND last_seen_at < now() - interval '1 minute'
+		)
+		SELECT
+			EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1),
+			EXISTS (SELECT 1 FROM users WHERE id = $2 AND suspended_at IS NOT NULL),
+			EXISTS (SELECT 1 FROM sessions WHERE id = $3 AND user_id = $2 AND revoked_at IS NULL AND expires_at > now())`
+	var revoked, suspended, active bool
+	if err := s.db.QueryRow(sqlQuery, jti, userID, sessionID).Scan(&revoked, &suspended, &active); err != nil {
+		return models.AccessTokenActive, err
+	}
+
+	switch {
+	case revoked:
+		return models.AccessTokenRevoked, nil
+	case suspended:
+		return models.AccessTokenUserSuspended, nil
+	case !active:
+		return models.AccessTokenSessionEnded, nil
+	}
+
+	return models.AccessTokenActive, nil
+}
+
+func (s *Store) CreateRefreshToken(token *models.RefreshToken) error {
+	sqlQuery := `INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)`
+	_, err := s.db.Exec(sqlQuery, token.UserID, token.FamilyID, token.TokenHash, token.ExpiresAt)
+
+	return err
+}
+
+// RotateRefreshToken marks the token with oldHash as used and stores next in
+// its family, filling in next's user, family and session. Presenting a token
+// that was already used revokes the whole family and ends its session.
+func (s *Store) RotateRefreshToken(oldHash string, next *models.RefreshToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	var expiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	sqlQuery := `
+		SELECT id, user_id, family_id, expires_at, used_at, revoked_at
+		FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE`
+	err = tx.QueryRow(sqlQuery, oldHash).Scan(&id, &next.UserID, &next.FamilyID, &expiresAt, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return models.ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	if usedAt.Valid {
+		if err := revokeFamily(tx, next.FamilyID); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return models.ErrRefreshTokenReused
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return models.ErrRefreshTokenInvalid
+	}
+
+	sqlQuery = `
+		UPDATE sessions SET last_seen_at = now(), expires_at = $2
+		WHERE family_id = $1 AND revoked_at IS NULL
+		RETURNING id`
+	err = tx.QueryRow(sqlQuery, next.FamilyID, next.ExpiresAt).Scan(&next.SessionID)
+	if err == sql.ErrNoRows {
+		return models.ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE refresh_tokens SET used_at = now() WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	sqlQuery = `INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)`
+	_, err = tx.Exec(sqlQuery, next.UserID, next.FamilyID, next.TokenHash, next.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RevokeRefreshFamily revokes every refresh token issued alongside the
+// user's token with tokenHash and ends their session.
+func (s *Store) RevokeRefreshFamily(userID int, tokenHash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	familyID := ""
+	sqlQuery := `SELECT family_id FROM refresh_tokens WHERE token_hash = $1 AND user_id = $2`
+	err = tx.QueryRow(sqlQuery, tokenHash, userID).Scan(&familyID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := revokeFamily(tx, familyID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func revokeFamily(tx *sql.Tx, familyID string) error {
+	sqlQuery := `UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.Exec(sqlQuery, familyID); err != nil {
+		return err
+	}
+
+	sqlQuery = `UPDATE sessions SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL`
+	_, err := tx.Exec(sqlQuery, familyID)
+
+	return err
+}
+
+func (s *Store) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < now()`)
+	if err != nil {
+		return err
+	}
+
+	sqlQuery := `INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	_, err = s.db.Exec(sqlQuery, jti, expiresAt)
+
+	return err
+}
+
+// CreatePasswordResetToken stores a new reset token, dropping the user's
+// expired or used ones.
+func (s *Store) CreatePasswordResetToken(token *models.PasswordResetToken) error {
+	sqlQuery := `DELETE FROM password_reset_tokens WHERE user_id = $1 AND (used_at IS NOT NULL OR expires_at < now())`
+	_, err := s.db.Exec(sqlQuery, token.UserID)
+	if err != nil {
+		return err
+	}
+
+	sqlQuery = `INSERT INTO password_reset_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`
+	_, err = s.db.Exec(sqlQuery, token.UserID, token.TokenHash, token.ExpiresAt)
+
+	return err
+}
+
+// ResetPassword consumes the reset token with tokenHash and sets the user's
+// password, returning the user's ID. Every other reset token, refresh token,
+// session and personal access token of the user stops working.
+func (s *Store) ResetPassword(tokenHash, hashedPassword string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	sqlQuery := `
+		UPDATE password_reset_tokens SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id`
+	err = tx.QueryRow(sqlQuery, tokenHash).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrResetTokenInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	sqlQuery = `UPDATE password_reset_tokens SET used_at = now() WHERE user_id = $1 AND used_at IS NULL`
+	if _, err := tx.Exec(sqlQuery, userID); err != nil {
+		return 0, err
+	}
+
+	sqlQuery = `UPDATE users SET password = $1, password_reset_required = false WHERE id = $2`
+	if _, err := tx.Exec(sqlQuery, hashedPassword, userID); err != nil {
+		return 0, err
+	}
+
+	sqlQuery = `UPDATE refresh_tokens SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.Exec(sqlQuery, userID); err != nil {
+		return 0, err
+	}
+
+	sqlQuery = `UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.Exec(sqlQuery, userID); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM personal_access_tokens WHERE user_id = $1`, userID); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// GetTwoFactor decrypts the user's TOTP secret. Secrets stored in plaintext
+// before encryption was introduced are encrypted on first read.
+func (s *Store) GetTwoFactor(userID int) (*models.TwoFactor, error) {
+	var secret sql.NullString
+	tf := new(models.TwoFactor)
+	sqlQuery := `SELECT totp_secret, totp_enabled_at IS NOT NULL FROM users WHERE id = $1`
+	err := s.db.QueryRow(sqlQuery, userID).Scan(&secret, &tf.Enabled)
+	if err != nil {
+		return nil, err
+	}
+	if !secret.Valid {
+		return tf, nil
+	}
+	if s.secrets == nil {
+		return nil, errNoSecretBox
+	}
+
+	plaintext, sealed, err := s.secrets.Open(secret.String)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting TOTP secret: %v", err)
+	}
+	tf.Secret = plaintext
+
+	if !sealed {
+		encrypted, err := s.secrets.Seal(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		sqlQuery = `UPDATE users SET totp_secret = $1 WHERE id = $2 AND totp_secret = $3`
+		if _, err := s.db.Exec(sqlQuery, encrypted, userID, secret.String); err != nil {
+			return nil, err
+		}
+	}
+
+	return tf, nil
+}
+
+// SetPendingTwoFactor stores secret encrypted.
+func (s *Store) SetPendingTwoFactor(userID int, secret string) error {
+	if s.secrets == nil {
+		return errNoSecretBox
+	}
+	encrypted, err := s.secrets.Seal(secret)
+	if err != nil {
+		return err
+	}
+
+	sqlQuery := `UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE id = $2 AND totp_enabled_at IS NULL`
+	res, err := s.db.Exec(sqlQuery, encrypted, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrTwoFactorEnabled
+	}
+
+	return nil
+}
+
+// EnableTwoFactor turns on the pending secret and replaces the user's
+// recovery codes.
+func (s *Store) EnableTwoFactor(userID int, recoveryCodeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqlQuery := `UPDATE users SET totp_enabled_at = now() WHERE id = $1 AND totp_secret IS NOT NULL AND totp_enabled_at IS NULL`
+	res, err := tx.Exec(sqlQuery, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrTwoFactorEnabled
+	}
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryCodeHashes {
+		_, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) DisableTwoFactor(userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqlQuery := `UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0 WHERE id = $1`
+	if _, err := tx.Exec(sqlQuery, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) UseTOTPStep(userID int, step int64) (bool, error) {
+	sqlQuery := `UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1`
+	res, err := s.db.Exec(sqlQuery, step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *Store) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	sqlQuery := `
+		UPDATE recovery_codes SET used_at = now()
+		WHERE id = (
+			SELECT id FROM recovery_codes
+			WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+			LIMIT 1 FOR UPDATE
+		)`
+	res, err := s.db.Exec(sqlQuery, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *Store) GetUserByIdentity(provider, subject string) (*models.User, error) {
+	sqlQuery := `
+		SELECT ` + userColumns + ` FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2)`
+	rows, err := s.db.Query(sqlQuery, provider, subject)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+
+	return scanRowsIntoUser(rows)
+}
+
+func (s *Store) LinkIdentity(userID int, identity *models.ExternalIdentity) error {
+	sqlQuery := `INSERT INTO user_identities (provider, subject, user_id, email) VALUES ($1, $2, $3, $4)`
+	_, err := s.db.Exec(sqlQuery, identity.Provider, identity.Subject, userID, identity.Email)
+
+	return err
+}
+
+// CreateUserWithIdentity creates an account whose email the provider has
+// already verified, so it starts out verified.
+func (s *Store) CreateUserWithIdentity(user *models.UserRegisterPayload, identity *models.ExternalIdentity) (*models.User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	id := 0
+	sqlQuery := `INSERT INTO users (email, username, password, verified_at) VALUES ($1, $2, $3, now()) RETURNING id`
+	err = tx.QueryRow(sqlQuery, user.Email, user.Username, user.Password).Scan(&id)
+	if utils.IsUniqueViolation(err) {
+		return nil, models.ErrEmailExists
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sqlQuery = `INSERT INTO user_identities (provider, subject, user_id, email) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(sqlQuery, identity.Provider, identity.Subject, id, identity.Email); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.GetUserByID(id)
+}
+
 func scanRowsIntoUser(rows *sql.Rows) (*models.User, error) {
 	user := new(models.User)
 
@@ -78,6 +553,11 @@ func scanRowsIntoUser(rows *sql.Rows) (*models.User, error) {
 		&user.Username,
 		&user.Password,
 		&user.Role,
+		&user.SuspendedAt,
+		&user.PasswordResetRequired,
+		&user.CreatedAt,
+		&user.VerifiedAt,
+		&user.TwoFactorEnabled,
 	)
 	if err != nil {
 		return nil, err
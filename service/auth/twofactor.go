@@ -0,0 +1,309 @@
+package auth
+
+import (
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator"
+)
+
+const (
+	DefaultTOTPIssuer = "go-note"
+	// challengeTTL bounds how long a user has to enter their code after the
+	// password step of a login.
+	challengeTTL       = 5 * time.Minute
+	challengePurpose   = "2fa_challenge"
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+// SetTwoFactorIssuer sets the issuer authenticator apps show next to codes.
+func (h *Handler) SetTwoFactorIssuer(issuer string) {
+	h.totpIssuer = issuer
+}
+
+// HandleEnrollTwoFactor generates a new TOTP secret for the user. It only
+// takes effect after HandleConfirmTwoFactor accepts a code for it.
+func (h *Handler) HandleEnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	u, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	err = h.twoFactor.SetPendingTwoFactor(userID, secret)
+	if err == models.ErrTwoFactorEnabled {
+		utils.ResponseJSON(w, http.StatusConflict, err.Error(), false)
+		return
+	}
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "scan the URI and confirm with a code", map[string]string{
+		"secret":      secret,
+		"otpauth_uri": utils.TOTPURI(h.totpIssuer, u.Email, secret),
+	})
+}
+
+// HandleConfirmTwoFactor enables two-factor authentication once the user
+// proves their authenticator works, returning recovery codes. The codes are
+// shown only this once.
+func (h *Handler) HandleConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload models.TwoFactorCodePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return
+	}
+
+	tf, err := h.twoFactor.GetTwoFactor(userID)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+	if tf.Enabled {
+		utils.ResponseJSON(w, http.StatusConflict, models.ErrTwoFactorEnabled.Error(), false)
+		return
+	}
+	if tf.Secret == "" {
+		utils.ResponseJSON(w, http.StatusBadRequest, models.ErrTwoFactorNotEnroled.Error(), false)
+		return
+	}
+
+	if err := h.checkSecondFactor(userID, tf, payload.Code, ""); err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	err = h.twoFactor.EnableTwoFactor(userID, hashes)
+	if err == models.ErrTwoFactorEnabled {
+		utils.ResponseJSON(w, http.StatusConflict, err.Error(), false)
+		return
+	}
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{Action: models.AuditTwoFactorEnabled, ActorID: userID, UserID: userID})
+	utils.ResponseJSON(w, http.StatusOK, "two-factor authentication enabled", map[string][]string{
+		"recovery_codes": codes,
+	})
+}
+
+// HandleDisableTwoFactor turns two-factor authentication off given a
+// current code or an unused recovery code.
+func (h *Handler) HandleDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload models.TwoFactorDisablePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	tf, err := h.twoFactor.GetTwoFactor(userID)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+	if !tf.Enabled {
+		utils.ResponseJSON(w, http.StatusBadRequest, models.ErrTwoFactorNotEnabled.Error(), false)
+		return
+	}
+
+	if err := h.checkSecondFactor(userID, tf, payload.Code, payload.RecoveryCode); err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	if err := h.twoFactor.DisableTwoFactor(userID); err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{Action: models.AuditTwoFactorDisabled, ActorID: userID, UserID: userID})
+	utils.ResponseJSON(w, http.StatusOK, "two-factor authentication disabled", false)
+}
+
+// HandleTwoFactorLogin completes a login started by HandleLogin for a user
+// with two-factor authentication, trading the challenge token and a code or
+// recovery code for the usual token pair. Wrong codes count towards the same
+// lockout as wrong passwords.
+func (h *Handler) HandleTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var payload models.TwoFactorLoginPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return
+	}
+
+	userID, _, err := h.parsePurposeToken(challengePurpose, payload.ChallengeToken)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusUnauthorized, models.ErrChallengeInvalid.Error(), false)
+		return
+	}
+
+	u, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusUnauthorized, models.ErrChallengeInvalid.Error(), false)
+		return
+	}
+
+	if err := h.checkAccount(u); err != nil {
+		h.auditLoginFailure(r, u.Email, u.ID, err.Error())
+		utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+		return
+	}
+
+	tf, err := h.twoFactor.GetTwoFactor(userID)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+	if !tf.Enabled {
+		utils.ResponseJSON(w, http.StatusUnauthorized, models.ErrChallengeInvalid.Error(), false)
+		return
+	}
+
+	accountKey, ipKey := loginKeys(r, u.Email)
+	if !h.checkLockout(w, accountKey, ipKey) {
+		return
+	}
+
+	if err := h.checkSecondFactor(userID, tf, payload.Code, payload.RecoveryCode); err != nil {
+		if err == models.ErrInvalidTwoFactor {
+			h.recordLoginFailure(r, u.Email, u.ID, "wrong two-factor code")
+		}
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	h.recordLoginSuccess(accountKey)
+	h.respondLogin(w, r, u, "2fa")
+}
+
+// respondChallenge answers the password step of a login for a user with
+// two-factor authentication.
+func (h *Handler) respondChallenge(w http.ResponseWriter, u *models.User) {
+	challenge, err := h.signPurposeToken(challengePurpose, u.ID, nil, challengeTTL)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "two-factor authentication required", map[string]interface{}{
+		"two_factor_required": true,
+		"challenge_token":     challenge,
+		"expires_in":          int(challengeTTL.Seconds()),
+	})
+}
+
+// checkSecondFactor accepts a TOTP code that has not been used before or,
+// when no code is given, an unused recovery code.
+func (h *Handler) checkSecondFactor(userID int, tf *models.TwoFactor, code, recoveryCode string) error {
+	if code != "" {
+		step, ok := utils.ValidateTOTP(tf.Secret, code, time.Now())
+		if !ok {
+			return models.ErrInvalidTwoFactor
+		}
+
+		fresh, err := h.twoFactor.UseTOTPStep(userID, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return models.ErrInvalidTwoFactor
+		}
+
+		return nil
+	}
+
+	if recoveryCode != "" {
+		used, err := h.twoFactor.UseRecoveryCode(userID, utils.HashToken(normalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			return err
+		}
+		if !used {
+			return models.ErrInvalidTwoFactor
+		}
+
+		return nil
+	}
+
+	return models.ErrInvalidTwoFactor
+}
+
+func writeTwoFactorError(w http.ResponseWriter, err error) {
+	if err == models.ErrInvalidTwoFactor {
+		utils.ResponseJSON(w, http.StatusUnauthorized, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+}
+
+// generateRecoveryCodes returns codes formatted like "abcde-fghij" along
+// with the hashes to store.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		secret, err := utils.GenerateTOTPSecret()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(secret[:recoveryCodeLength])
+		codes[i] = code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+		hashes[i] = utils.HashToken(code)
+	}
+
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"fmt"
+	"go-note/mailer"
+	"go-note/models"
+	"go-note/utils"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const DefaultVerificationTTL = 48 * time.Hour
+
+// verifyPurpose is the audience of verification tokens so they cannot be
+// mistaken for any other token signed with the same keys.
+const verifyPurpose = "verify_email"
+
+// SetEmailVerification sets the verification policy, the page verification
+// emails link to, which receives the token as its token query parameter, and
+// how long verification links stay valid. Without a URL the email contains
+// the bare token.
+func (h *Handler) SetEmailVerification(policy, verifyURL string, ttl time.Duration) {
+	h.verifyPolicy = policy
+	h.verifyURL = verifyURL
+	h.verifyTokenTTL = ttl
+}
+
+// HandleVerifyEmail marks the email in a verification token as verified.
+// Tokens for an address the user has since changed are rejected.
+func (h *Handler) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var payload models.VerifyEmailPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return
+	}
+
+	userID, email, err := h.parseVerificationToken(payload.Token)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, models.ErrVerificationInvalid.Error(), false)
+		return
+	}
+
+	err = h.store.MarkEmailVerified(userID, email)
+	if err == models.ErrVerificationInvalid {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "email verified", false)
+}
+
+// HandleResendVerification mails a new verification link to the address if
+// it belongs to an unverified account. Like forgot-password, the lookup and
+// the email happen on the mail queue so the response does not reveal
+// whether the email is registered.
+func (h *Handler) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	var payload models.ResendVerificationPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return
+	}
+
+	email := payload.Email
+	if !h.mailQueue.Go(func() { h.mailVerification(email) }) {
+		log.Println("sending verification email: mail queue full")
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "if the email is registered and unverified, a verification link has been sent", false)
+}
+
+// mailVerification sends a new verification link to the account with email,
+// if there is one that is still unverified.
+func (h *Handler) mailVerification(email string) {
+	u, err := h.store.GetUserByEmail(email)
+	if err != nil || u.VerifiedAt != nil {
+		return
+	}
+
+	if err := h.sendVerification(u); err != nil {
+		log.Println("sending verification email:", err)
+	}
+}
+
+func (h *Handler) sendVerification(u *models.User) error {
+	token, err := h.createVerificationToken(u, h.verifyTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := token
+	if h.verifyURL != "" {
+		link = h.verifyURL + "?token=" + url.QueryEscape(token)
+	}
+
+	return h.mail.Send(&mailer.Message{
+		To:      u.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the following to verify your email. It expires in %s.\n\n%s\n\n"+
+			"If you did not create an account you can ignore this email.\n", u.Username, h.verifyTokenTTL, link),
+	})
+}
+
+// createVerificationToken signs the user's ID and current email so the
+// token stops working once the email changes.
+func (h *Handler) createVerificationToken(u *models.User, ttl time.Duration) (string, error) {
+	return h.signPurposeToken(verifyPurpose, u.ID, jwt.MapClaims{"email": u.Email}, ttl)
+}
+
+func (h *Handler) parseVerificationToken(tokenString string) (int, string, error) {
+	userID, claims, err := h.parsePurposeToken(verifyPurpose, tokenString)
+	if err != nil {
+		return 0, "", err
+	}
+
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return 0, "", fmt.Errorf("missing email claim")
+	}
+
+	return userID, email, nil
+}
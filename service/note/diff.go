@@ -0,0 +1,171 @@
+package note
+
+import (
+	"fmt"
+	"go-note/models"
+	"strings"
+)
+
+const diffContext = 3
+
+// maxDiffCells bounds the table diffLines builds, which grows with the
+// product of the line counts between the common prefix and suffix.
+const maxDiffCells = 4 << 20
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+	a, b int // line index in a and b before this op
+}
+
+// unifiedDiff returns the line-based unified diff turning a into b, or an
+// empty string when they are equal. It fails with models.ErrDiffTooLarge
+// when too many lines changed to diff them.
+func unifiedDiff(fromName, toName, a, b string) (string, error) {
+	ops, err := diffLines(splitLines(a), splitLines(b))
+	if err != nil {
+		return "", err
+	}
+
+	changed := false
+	for _, op := range ops {
+		if op.kind != ' ' {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return "", nil
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+
+	for start := 0; start < len(ops); {
+		// Find the next change and open a hunk with up to diffContext
+		// lines of leading context.
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		begin := max(first-diffContext, start)
+
+		// Extend the hunk until a run of unchanged lines is long enough
+		// to separate it from the next change.
+		end := first
+		for i := first; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				end = i + 1
+				continue
+			}
+			if i-end >= 2*diffContext {
+				break
+			}
+		}
+		end = min(end+diffContext, len(ops))
+
+		writeHunk(&out, ops[begin:end])
+		start = end
+	}
+
+	return out.String(), nil
+}
+
+func writeHunk(out *strings.Builder, ops []diffOp) {
+	aCount, bCount := 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			aCount++
+		}
+		if op.kind != '-' {
+			bCount++
+		}
+	}
+
+	aStart, bStart := ops[0].a+1, ops[0].b+1
+	if aCount == 0 {
+		aStart--
+	}
+	if bCount == 0 {
+		bStart--
+	}
+
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+	for _, op := range ops {
+		out.WriteByte(op.kind)
+		out.WriteString(op.line)
+		out.WriteByte('\n')
+	}
+}
+
+// diffLines computes a minimal edit script between a and b from their
+// longest common subsequence. Only the lines between the common prefix and
+// suffix go into the table, and it refuses to build one of more than
+// maxDiffCells entries.
+func diffLines(a, b []string) ([]diffOp, error) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	n, m := len(a)-prefix-suffix, len(b)-prefix-suffix
+	if n > 0 && m > 0 && (n+1)*(m+1) > maxDiffCells {
+		return nil, models.ErrDiffTooLarge
+	}
+
+	// lcs[i*(m+1)+j] is the length of the longest common subsequence of
+	// the changed lines from a[prefix+i] and b[prefix+j] on.
+	width := m + 1
+	lcs := make([]int32, (n+1)*width)
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[prefix+i] == b[prefix+j] {
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			} else {
+				lcs[i*width+j] = max(lcs[(i+1)*width+j], lcs[i*width+j+1])
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b)-prefix-suffix)
+	for k := 0; k < prefix; k++ {
+		ops = append(ops, diffOp{' ', a[k], k, k})
+	}
+
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && a[prefix+i] == b[prefix+j]:
+			ops = append(ops, diffOp{' ', a[prefix+i], prefix + i, prefix + j})
+			i++
+			j++
+		case i < n && (j == m || lcs[(i+1)*width+j] >= lcs[i*width+j+1]):
+			ops = append(ops, diffOp{'-', a[prefix+i], prefix + i, prefix + j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[prefix+j], prefix + i, prefix + j})
+			j++
+		}
+	}
+
+	for k := 0; k < suffix; k++ {
+		ops = append(ops, diffOp{' ', a[prefix+n+k], prefix + n + k, prefix + m + k})
+	}
+
+	return ops, nil
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,114 @@
+package note
+
+import (
+	"fmt"
+	"go-note/models"
+	"go-note/utils"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func noteETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// parseIfMatch returns the note versions named by the If-Match header, or
+// nil when the header is absent or "*". Weak and malformed tags can never
+// match, so ok is false when no listed tag could.
+func parseIfMatch(r *http.Request) (versions []int, present bool, ok bool) {
+	header := strings.TrimSpace(strings.Join(r.Header.Values("If-Match"), ","))
+	if header == "" {
+		return nil, false, true
+	}
+	if header == "*" {
+		return nil, true, true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+
+		version, err := strconv.Atoi(tag[1 : len(tag)-1])
+		if err == nil && version >= 1 {
+			versions = append(versions, version)
+		}
+	}
+
+	return versions, true, len(versions) > 0
+}
+
+// notModified reports whether the If-None-Match header matches the note,
+// using the weak comparison RFC 9110 prescribes for GET.
+func notModified(r *http.Request, note *models.Note) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	etag := noteETag(note.Version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkIfMatch reads If-Match for a write, answering 412 for tags that can
+// never match and 428 when the handler requires the header and it is missing.
+func (h *Handler) checkIfMatch(w http.ResponseWriter, r *http.Request) ([]int, bool) {
+	versions, present, ok := parseIfMatch(r)
+	if !ok {
+		utils.ResponseJSON(w, http.StatusPreconditionFailed, models.ErrVersionMismatch.Error(), false)
+		return nil, false
+	}
+	if !present && h.requireIfMatch {
+		utils.ResponseJSON(w, http.StatusPreconditionRequired, "If-Match header required", false)
+		return nil, false
+	}
+
+	return versions, true
+}
+
+// matchVersion picks the version a conditional write passes to the store,
+// which checks it while holding the note's lock. With several tags listed
+// it is the note's current version if that is one of them.
+func (h *Handler) matchVersion(userID, id int, versions []int) (int, error) {
+	switch len(versions) {
+	case 0:
+		return 0, nil
+	case 1:
+		return versions[0], nil
+	}
+
+	note, err := h.store.GetNoteByID(userID, id)
+	if err != nil {
+		return 0, err
+	}
+	if !matchesVersion(versions, note.Version) {
+		return 0, models.ErrVersionMismatch
+	}
+
+	return note.Version, nil
+}
+
+// matchesVersion reports whether version satisfies the versions of an
+// If-Match header, where nil stands for any version.
+func matchesVersion(versions []int, version int) bool {
+	if versions == nil {
+		return true
+	}
+
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+
+	return false
+}
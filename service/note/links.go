@@ -0,0 +1,248 @@
+package note
+
+import (
+	"database/sql"
+	"go-note/limiter"
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/utils"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/gorilla/mux"
+)
+
+// LinkPasswordHeader carries the password of a protected public link.
+const LinkPasswordHeader = "X-Link-Password"
+
+// SetLinkLimiter sets the limiter that locks a password-protected public
+// link after repeated wrong passwords.
+func (h *Handler) SetLinkLimiter(l limiter.Limiter) {
+	h.linkLimiter = l
+}
+
+// RegisterPublicRoutes adds the routes that serve public links. They take no
+// authentication, so router must not require it.
+func (h *Handler) RegisterPublicRoutes(router *mux.Router) {
+	router.HandleFunc("/public/notes/{token}", h.HandleGetPublicNote).Methods("GET")
+}
+
+// HandleCreateNoteLink publishes a note of the caller under a new random
+// token, optionally expiring or protected by a password. The token itself is
+// only returned here.
+func (h *Handler) HandleCreateNoteLink(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	var payload models.NoteLinkPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, "invalid payload", errors.Error())
+		return
+	}
+
+	if payload.ExpiresAt != nil && !payload.ExpiresAt.After(time.Now()) {
+		utils.ResponseJSON(w, http.StatusBadRequest, "expires_at must be in the future", false)
+		return
+	}
+
+	secret, err := utils.RandomToken(32)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+	token := models.NoteLinkPrefix + secret
+
+	link := &models.NoteLink{
+		NoteID:    id,
+		TokenHash: utils.HashToken(token),
+		ExpiresAt: payload.ExpiresAt,
+	}
+	if payload.Password != "" {
+		link.PasswordHash, err = utils.HashPassword(payload.Password)
+		if err != nil {
+			utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+			return
+		}
+	}
+
+	if err := h.store.CreateNoteLink(userID, link); err != nil {
+		writeLinkError(w, err)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditNoteLinkCreated,
+		ActorID: userID,
+		UserID:  userID,
+		Target:  "note:" + strconv.Itoa(id),
+		Details: map[string]string{"link": strconv.Itoa(link.ID), "password": strconv.FormatBool(link.HasPassword)},
+	})
+	utils.ResponseJSON(w, http.StatusCreated, "Link created, copy it now as it will not be shown again", struct {
+		*models.NoteLink
+		Token string `json:"token"`
+	}{link, token})
+}
+
+// HandleGetNoteLinks lists the public links of a note of the caller with
+// their view counts.
+func (h *Handler) HandleGetNoteLinks(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	links, err := h.store.GetNoteLinks(userID, id)
+	if err != nil {
+		writeLinkError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", links)
+}
+
+// HandleDeleteNoteLink revokes a public link at once.
+func (h *Handler) HandleDeleteNoteLink(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	linkID, err := strconv.Atoi(mux.Vars(r)["link"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, "invalid link", false)
+		return
+	}
+
+	if err := h.store.DeleteNoteLink(userID, id, linkID); err != nil {
+		writeLinkError(w, err)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditNoteLinkRevoked,
+		ActorID: userID,
+		UserID:  userID,
+		Target:  "note:" + strconv.Itoa(id),
+		Details: map[string]string{"link": strconv.Itoa(linkID)},
+	})
+	utils.ResponseJSON(w, http.StatusOK, "delete success", linkID)
+}
+
+// HandleGetPublicNote serves the note behind a public link to anyone with
+// its token, and the password in LinkPasswordHeader when the link has one.
+// Unknown and revoked tokens and trashed notes look the same: 404.
+func (h *Handler) HandleGetPublicNote(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	link, err := h.store.GetNoteLinkByToken(utils.HashToken(mux.Vars(r)["token"]))
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusNotFound, models.ErrLinkNotFound.Error(), false)
+		return
+	}
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	if link.Expired(time.Now()) {
+		utils.ResponseJSON(w, http.StatusGone, models.ErrLinkExpired.Error(), false)
+		return
+	}
+
+	if link.HasPassword && !h.checkLinkPassword(w, r, link) {
+		return
+	}
+
+	note, err := h.store.ViewNoteLink(link.ID)
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusNotFound, models.ErrLinkNotFound.Error(), false)
+		return
+	}
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", note)
+}
+
+// checkLinkPassword responds with 401 and reports false unless the request
+// carries the link's password, and with 429 while the link is locked out
+// after too many wrong ones.
+func (h *Handler) checkLinkPassword(w http.ResponseWriter, r *http.Request, link *models.NoteLink) bool {
+	key := "link:" + strconv.Itoa(link.ID)
+
+	wait, err := h.linkLimiter.Check(key)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		utils.ResponseJSON(w, http.StatusTooManyRequests, "too many wrong passwords, try again later", false)
+		return false
+	}
+
+	password := r.Header.Get(LinkPasswordHeader)
+	if password == "" {
+		utils.ResponseJSON(w, http.StatusUnauthorized, "this link requires a password", false)
+		return false
+	}
+
+	if !utils.ComparePasswords(link.PasswordHash, []byte(password)) {
+		if _, err := h.linkLimiter.Fail(key); err != nil {
+			log.Println("recording wrong link password:", err)
+		}
+		utils.ResponseJSON(w, http.StatusUnauthorized, "wrong password", false)
+		return false
+	}
+
+	if err := h.linkLimiter.Reset(key); err != nil {
+		log.Println("resetting link password failures:", err)
+	}
+
+	return true
+}
+
+func writeLinkError(w http.ResponseWriter, err error) {
+	switch err {
+	case sql.ErrNoRows:
+		utils.ResponseJSON(w, http.StatusNotFound, "note not found", false)
+	case models.ErrLinkNotFound:
+		utils.ResponseJSON(w, http.StatusNotFound, err.Error(), false)
+	case models.ErrNoteOwnerOnly:
+		utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+	default:
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+	}
+}
@@ -0,0 +1,205 @@
+package note
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/utils"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-playground/validator"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+
+	maxPatchSize     = 1 << 20
+	maxPatchAttempts = 3
+)
+
+// patchDocument is the view of a note that PATCH requests operate on.
+type patchDocument struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	NotebookID  *int     `json:"notebook_id"`
+	Tags        []string `json:"tags"`
+}
+
+// HandlePatchNote applies a JSON Merge Patch or JSON Patch, chosen by
+// Content-Type, to the note and validates the result like a PUT. Without
+// If-Match, a concurrent change makes the patch be re-applied to the newer
+// note a few times before giving up.
+func (h *Handler) HandlePatchNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != jsonPatchType {
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		utils.ResponseJSON(w, http.StatusUnsupportedMediaType, "content type must be "+mergePatchType+" or "+jsonPatchType, false)
+		return
+	}
+
+	versions, ok := h.checkIfMatch(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Body == nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, "missing request body", false)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPatchSize))
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		current, err := h.store.GetNoteByID(userID, id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				utils.ResponseJSON(w, http.StatusNotFound, "note not found", false)
+				return
+			}
+			utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+			return
+		}
+
+		if !matchesVersion(versions, current.Version) {
+			utils.ResponseJSON(w, http.StatusPreconditionFailed, models.ErrVersionMismatch.Error(), false)
+			return
+		}
+
+		patched, err := applyPatch(current, mediaType, body)
+		if err != nil {
+			utils.ResponseJSON(w, http.StatusUnprocessableEntity, err.Error(), false)
+			return
+		}
+
+		payload := models.NotePayload{
+			Title:       patched.Title,
+			Description: patched.Description,
+			NotebookID:  patched.NotebookID,
+			Tags:        patched.Tags,
+		}
+		trimTags(&payload)
+		if err := utils.Validate.Struct(payload); err != nil {
+			errors := err.(validator.ValidationErrors)
+			utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+			return
+		}
+
+		version, err := h.store.PatchNote(userID, id, notePatch(current, &payload), current.Version)
+		if err == models.ErrVersionMismatch && versions == nil && attempt < maxPatchAttempts {
+			continue
+		}
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				utils.ResponseJSON(w, http.StatusNotFound, "note not found", false)
+			case models.ErrNoteReadOnly, models.ErrNoteOwnerOnly:
+				utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+			case models.ErrVersionMismatch:
+				utils.ResponseJSON(w, http.StatusPreconditionFailed, err.Error(), false)
+			case models.ErrNotebookNotFound, models.ErrWorkspaceNotebook:
+				utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+			default:
+				utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+			}
+			return
+		}
+
+		w.Header().Set("ETag", noteETag(version))
+		utils.ResponseJSON(w, http.StatusOK, "update success", id)
+		return
+	}
+}
+
+func applyPatch(note *models.Note, mediaType string, patch []byte) (*patchDocument, error) {
+	doc, err := json.Marshal(patchDocument{
+		Title:       note.Title,
+		Description: note.Description,
+		NotebookID:  note.NotebookID,
+		Tags:        note.Tags,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if mediaType == mergePatchType {
+		doc, err = utils.MergePatch(doc, patch)
+	} else {
+		doc, err = utils.ApplyJSONPatch(doc, patch)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	patched := new(patchDocument)
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(patched); err != nil {
+		return nil, err
+	}
+
+	return patched, nil
+}
+
+// notePatch keeps only the fields of payload that differ from the note.
+func notePatch(note *models.Note, payload *models.NotePayload) *models.NotePatch {
+	patch := new(models.NotePatch)
+
+	if payload.Title != note.Title {
+		patch.Title = &payload.Title
+	}
+	if payload.Description != note.Description {
+		patch.Description = &payload.Description
+	}
+	if !sameNotebook(payload.NotebookID, note.NotebookID) {
+		patch.SetNotebook = true
+		patch.NotebookID = payload.NotebookID
+	}
+	if !sameTags(payload.Tags, note.Tags) {
+		patch.Tags = payload.Tags
+		if patch.Tags == nil {
+			patch.Tags = []string{}
+		}
+	}
+
+	return patch
+}
+
+func sameNotebook(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a, b = lowerAll(a), lowerAll(b)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, "\x00") == strings.Join(b, "\x00")
+}
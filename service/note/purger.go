@@ -0,0 +1,35 @@
+package note
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+type trashPurger interface {
+	PurgeTrash(before time.Time) (int64, error)
+}
+
+// StartPurger permanently deletes notes that have been in the trash longer
+// than retention, checking every interval until ctx is cancelled.
+func StartPurger(ctx context.Context, store trashPurger, retention, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			n, err := store.PurgeTrash(time.Now().Add(-retention))
+			if err != nil {
+				log.Println("trash purge failed:", err)
+			} else if n > 0 {
+				log.Printf("trash purge: removed %d notes", n)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -2,21 +2,63 @@ package note
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go-note/auditlog"
+	"go-note/limiter"
 	"go-note/middlewares"
 	"go-note/models"
 	"go-note/utils"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/gorilla/mux"
 )
 
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
 type Handler struct {
-	store models.NoteStore
+	store                models.NoteStore
+	requireIfMatch       bool
+	requireVerifiedEmail bool
+	auditLog             auditlog.Recorder
+	linkLimiter          limiter.Limiter
 }
 
+// NewHandler returns a handler that logs audit events until
+// SetAuditRecorder is called and limits link passwords in memory.
 func NewHandler(store models.NoteStore) *Handler {
-	return &Handler{store: store}
+	return &Handler{
+		store:       store,
+		auditLog:    auditlog.NewLogRecorder(log.Writer()),
+		linkLimiter: limiter.NewMemory(limiter.DefaultLinkPolicy),
+	}
+}
+
+// SetAuditRecorder sets where note deletions, shares and public links are
+// recorded.
+func (h *Handler) SetAuditRecorder(rec auditlog.Recorder) {
+	h.auditLog = rec
+}
+
+// SetRequireIfMatch makes PUT and DELETE on a note fail with 428 unless the
+// client sends If-Match.
+func (h *Handler) SetRequireIfMatch(require bool) {
+	h.requireIfMatch = require
+}
+
+// SetRequireVerifiedEmail makes note creation fail with 403 for users whose
+// access token says their email is unverified.
+func (h *Handler) SetRequireVerifiedEmail(require bool) {
+	h.requireVerifiedEmail = require
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) {
@@ -24,29 +66,65 @@ func (h *Handler) RegisterRoutes(router *mux.Router) {
 	noteRouter := router.PathPrefix("/notes").Subrouter()
 	noteRouter.Use(middlewares.JWTMiddleware)
 
-	noteRouter.HandleFunc("/", h.HandleCreateNote).Methods("POST")
-	noteRouter.HandleFunc("/", h.HandleGetNotes).Methods("GET")
-	noteRouter.HandleFunc("/{id}", h.HandleGetNoteByID).Methods("GET")
-	noteRouter.HandleFunc("/{id}", h.HandleUpdateNote).Methods("PUT")
-	noteRouter.HandleFunc("/{id}", h.HandleDeleteNote).Methods("DELETE")
+	noteRouter.Handle("/", middlewares.Permit(models.PermNotesWrite, h.HandleCreateNote)).Methods("POST")
+	noteRouter.Handle("/", middlewares.Permit(models.PermNotesRead, h.HandleGetNotes)).Methods("GET")
+	noteRouter.Handle("/search", middlewares.Permit(models.PermNotesRead, h.HandleSearchNotes)).Methods("GET")
+	noteRouter.Handle("/trash", middlewares.Permit(models.PermNotesRead, h.HandleGetTrash)).Methods("GET")
+	noteRouter.Handle("/trash/{id}/restore", middlewares.Permit(models.PermNotesWrite, h.HandleRestoreNote)).Methods("POST")
+	noteRouter.Handle("/trash/{id}", middlewares.Permit(models.PermNotesWrite, h.HandlePurgeNote)).Methods("DELETE")
+	noteRouter.Handle("/shared", middlewares.Permit(models.PermNotesRead, h.HandleGetSharedNotes)).Methods("GET")
+	noteRouter.Handle("/{id}", middlewares.Permit(models.PermNotesRead, h.HandleGetNoteByID)).Methods("GET")
+	noteRouter.Handle("/{id}", middlewares.Permit(models.PermNotesWrite, h.HandleUpdateNote)).Methods("PUT")
+	noteRouter.Handle("/{id}", middlewares.Permit(models.PermNotesWrite, h.HandlePatchNote)).Methods("PATCH")
+	noteRouter.Handle("/{id}", middlewares.Permit(models.PermNotesWrite, h.HandleDeleteNote)).Methods("DELETE")
+	noteRouter.Handle("/{id}/notebook", middlewares.Permit(models.PermNotesWrite, h.HandleMoveNote)).Methods("PUT")
+	noteRouter.Handle("/{id}/revisions", middlewares.Permit(models.PermNotesRead, h.HandleGetRevisions)).Methods("GET")
+	noteRouter.Handle("/{id}/revisions/diff", middlewares.Permit(models.PermNotesRead, h.HandleDiffRevisions)).Methods("GET")
+	noteRouter.Handle("/{id}/revisions/{rev:[0-9]+}", middlewares.Permit(models.PermNotesRead, h.HandleGetRevision)).Methods("GET")
+	noteRouter.Handle("/{id}/revisions/{rev:[0-9]+}/restore", middlewares.Permit(models.PermNotesWrite, h.HandleRestoreRevision)).Methods("POST")
+	noteRouter.Handle("/{id}/shares", middlewares.Permit(models.PermNotesRead, h.HandleGetNoteShares)).Methods("GET")
+	noteRouter.Handle("/{id}/shares", middlewares.Permit(models.PermNotesWrite, h.HandleShareNote)).Methods("POST")
+	noteRouter.Handle("/{id}/shares/{user:[0-9]+}", middlewares.Permit(models.PermNotesWrite, h.HandleRevokeNoteShare)).Methods("DELETE")
+	noteRouter.Handle("/{id}/links", middlewares.Permit(models.PermNotesRead, h.HandleGetNoteLinks)).Methods("GET")
+	noteRouter.Handle("/{id}/links", middlewares.Permit(models.PermNotesWrite, h.HandleCreateNoteLink)).Methods("POST")
+	noteRouter.Handle("/{id}/links/{link:[0-9]+}", middlewares.Permit(models.PermNotesWrite, h.HandleDeleteNoteLink)).Methods("DELETE")
 
 }
 
 func (h *Handler) HandleCreateNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	if h.requireVerifiedEmail && !middlewares.IsEmailVerified(r.Context()) {
+		utils.ResponseJSON(w, http.StatusForbidden, models.ErrEmailNotVerified.Error(), false)
+		return
+	}
+
 	var note models.NotePayload
 	if err := utils.ParseJSON(r, &note); err != nil {
 		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
 		return
 	}
 
+	trimTags(&note)
 	if err := utils.Validate.Struct(note); err != nil {
 		errors := err.(validator.ValidationErrors)
 		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
 		return
 	}
 
-	err := h.store.CreateNote(&note)
+	err := h.store.CreateNote(userID, &note)
 	if err != nil {
+		if err == models.ErrNotebookNotFound || err == models.ErrWorkspaceNotFound || err == models.ErrWorkspaceNotebook {
+			utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+			return
+		}
+		if err == models.ErrWorkspaceRole {
+			utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+			return
+		}
 		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
 		return
 	}
@@ -55,23 +133,112 @@ func (h *Handler) HandleCreateNote(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) HandleGetNotes(w http.ResponseWriter, r *http.Request) {
-	notes, err := h.store.GetNotes()
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	opts, err := parseListOptions(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	list, err := h.store.GetNotes(userID, opts)
+	if err == models.ErrWorkspaceNotFound {
+		utils.ResponseJSON(w, http.StatusNotFound, err.Error(), false)
+		return
+	}
 	if err != nil {
 		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
 		return
 	}
 
-	utils.ResponseJSON(w, http.StatusOK, "success", notes)
+	page := utils.Pagination{Count: len(list.Notes), Total: list.Total}
+	if list.Next != nil {
+		page.NextCursor = encodeCursor(list.Next)
+	}
+
+	utils.ResponsePageJSON(w, http.StatusOK, "success", list.Notes, page)
+}
+
+func (h *Handler) HandleSearchNotes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	opts := &models.NoteSearchOptions{
+		Query: strings.TrimSpace(query.Get("q")),
+		Limit: defaultPageSize,
+	}
+	if opts.Query == "" {
+		utils.ResponseJSON(w, http.StatusBadRequest, "missing search query", false)
+		return
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			utils.ResponseJSON(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize), false)
+			return
+		}
+		opts.Limit = n
+	}
+
+	if offset := query.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			utils.ResponseJSON(w, http.StatusBadRequest, "offset must be a non-negative integer", false)
+			return
+		}
+		opts.Offset = n
+	}
+
+	results, err := h.store.SearchNotes(userID, opts)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	for _, result := range results {
+		result.TitleHighlight = markHighlight(result.TitleHighlight)
+		result.DescriptionHighlight = markHighlight(result.DescriptionHighlight)
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", results)
+}
+
+// highlightMarks escapes note content while turning the highlight
+// delimiters into <mark> tags, so highlights are safe to render as HTML.
+var highlightMarks = strings.NewReplacer(
+	models.HighlightStart, "<mark>",
+	models.HighlightStop, "</mark>",
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&#34;",
+	"'", "&#39;",
+)
+
+func markHighlight(highlight string) string {
+	return highlightMarks.Replace(highlight)
 }
 
 func (h *Handler) HandleGetNoteByID(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
 	id, err := utils.GetQueryID(r)
 	if err != nil {
 		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
 		return
 	}
 
-	notes, err := h.store.GetNoteByID(id)
+	note, err := h.store.GetNoteByID(userID, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			utils.ResponseJSON(w, http.StatusNotFound, "note not found", false)
@@ -81,57 +248,500 @@ func (h *Handler) HandleGetNoteByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	utils.ResponseJSON(w, http.StatusOK, "success", notes)
+	w.Header().Set("ETag", noteETag(note.Version))
+	if notModified(r, note) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", note)
 }
 
 func (h *Handler) HandleUpdateNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
 	id, err := utils.GetQueryID(r)
 	if err != nil {
 		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
 		return
 	}
 
+	versions, ok := h.checkIfMatch(w, r)
+	if !ok {
+		return
+	}
+
 	var note models.NotePayload
 	if err := utils.ParseJSON(r, &note); err != nil {
 		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
 		return
 	}
 
+	trimTags(&note)
 	if err := utils.Validate.Struct(note); err != nil {
 		errors := err.(validator.ValidationErrors)
 		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
 		return
 	}
 
-	err = h.store.UpdateNote(id, &note)
+	version, err := h.matchVersion(userID, id, versions)
+	if err == nil {
+		version, err = h.store.UpdateNote(userID, id, &note, version)
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			utils.ResponseJSON(w, http.StatusNotFound, "note not found", false)
 			return
 		}
+		if err == models.ErrNoteReadOnly || err == models.ErrNoteOwnerOnly {
+			utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+			return
+		}
+		if err == models.ErrVersionMismatch {
+			utils.ResponseJSON(w, http.StatusPreconditionFailed, err.Error(), false)
+			return
+		}
+		if err == models.ErrNotebookNotFound || err == models.ErrWorkspaceNotebook {
+			utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+			return
+		}
 		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
 		return
 	}
 
+	w.Header().Set("ETag", noteETag(version))
 	utils.ResponseJSON(w, http.StatusOK, "update success", id)
 }
 
 func (h *Handler) HandleDeleteNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
 	id, err := utils.GetQueryID(r)
 	if err != nil {
 		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
 		return
 	}
 
-	err = h.store.DeleteNote(id)
+	versions, ok := h.checkIfMatch(w, r)
+	if !ok {
+		return
+	}
+
+	version, err := h.matchVersion(userID, id, versions)
+	if err == nil {
+		err = h.store.DeleteNote(userID, id, version)
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			utils.ResponseJSON(w, http.StatusNotFound, "note not found", false)
 			return
 		}
+		if err == models.ErrNoteReadOnly || err == models.ErrNoteOwnerOnly {
+			utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+			return
+		}
+		if err == models.ErrVersionMismatch {
+			utils.ResponseJSON(w, http.StatusPreconditionFailed, err.Error(), false)
+			return
+		}
 		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
 		return
 	}
 
+	h.recordDeletion(r, models.AuditNoteDeleted, userID, id)
 	utils.ResponseJSON(w, http.StatusOK, "delete success", id)
 }
+
+func (h *Handler) HandleMoveNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	var payload models.NoteMovePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	err = h.store.MoveNote(userID, id, payload.NotebookID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			utils.ResponseJSON(w, http.StatusNotFound, "note not found", false)
+			return
+		}
+		if err == models.ErrNoteOwnerOnly {
+			utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+			return
+		}
+		if err == models.ErrNotebookNotFound || err == models.ErrWorkspaceNotebook {
+			utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+			return
+		}
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "move success", id)
+}
+
+func (h *Handler) HandleGetTrash(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	notes, err := h.store.GetTrash(userID)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", notes)
+}
+
+func (h *Handler) HandleRestoreNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	err = h.store.RestoreNote(userID, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			utils.ResponseJSON(w, http.StatusNotFound, "note not found in trash", false)
+			return
+		}
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "restore success", id)
+}
+
+func (h *Handler) HandlePurgeNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	err = h.store.PurgeNote(userID, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			utils.ResponseJSON(w, http.StatusNotFound, "note not found in trash", false)
+			return
+		}
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	h.recordDeletion(r, models.AuditNotePurged, userID, id)
+	utils.ResponseJSON(w, http.StatusOK, "delete success", id)
+}
+
+// recordDeletion audits userID moving note id to the trash or deleting it
+// for good.
+func (h *Handler) recordDeletion(r *http.Request, action string, userID, id int) {
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  action,
+		ActorID: userID,
+		UserID:  userID,
+		Target:  "note:" + strconv.Itoa(id),
+	})
+}
+
+func (h *Handler) HandleGetRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	revisions, err := h.store.GetRevisions(userID, id)
+	if err != nil {
+		writeRevisionError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", revisions)
+}
+
+func (h *Handler) HandleGetRevision(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	rev, err := strconv.Atoi(mux.Vars(r)["rev"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, "invalid revision", false)
+		return
+	}
+
+	revision, err := h.store.GetRevision(userID, id, rev)
+	if err != nil {
+		writeRevisionError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", revision)
+}
+
+// HandleDiffRevisions returns a unified diff from revision ?from to
+// revision ?to. Each revision is rendered as its title, a blank line and its
+// description.
+func (h *Handler) HandleDiffRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	query := r.URL.Query()
+	from, err := strconv.Atoi(query.Get("from"))
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, "from must be a revision number", false)
+		return
+	}
+	to, err := strconv.Atoi(query.Get("to"))
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, "to must be a revision number", false)
+		return
+	}
+
+	a, err := h.store.GetRevision(userID, id, from)
+	if err != nil {
+		writeRevisionError(w, err)
+		return
+	}
+	b, err := h.store.GetRevision(userID, id, to)
+	if err != nil {
+		writeRevisionError(w, err)
+		return
+	}
+
+	text, err := unifiedDiff(
+		fmt.Sprintf("revision %d", from),
+		fmt.Sprintf("revision %d", to),
+		a.Title+"\n\n"+a.Description,
+		b.Title+"\n\n"+b.Description,
+	)
+	if err == models.ErrDiffTooLarge {
+		utils.ResponseJSON(w, http.StatusUnprocessableEntity, err.Error(), false)
+		return
+	}
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	diff := &models.NoteDiff{From: from, To: to, Diff: text}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", diff)
+}
+
+func (h *Handler) HandleRestoreRevision(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	rev, err := strconv.Atoi(mux.Vars(r)["rev"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, "invalid revision", false)
+		return
+	}
+
+	err = h.store.RestoreRevision(userID, id, rev)
+	if err != nil {
+		writeRevisionError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "restore success", id)
+}
+
+func writeRevisionError(w http.ResponseWriter, err error) {
+	switch err {
+	case sql.ErrNoRows:
+		utils.ResponseJSON(w, http.StatusNotFound, "note not found", false)
+	case models.ErrRevisionNotFound:
+		utils.ResponseJSON(w, http.StatusNotFound, err.Error(), false)
+	case models.ErrNoteReadOnly:
+		utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+	default:
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+	}
+}
+
+// parseListOptions reads the paging, sorting and filter query parameters of
+// GET /notes. Notes are listed newest first unless asked otherwise.
+func parseListOptions(r *http.Request) (*models.NoteListOptions, error) {
+	query := r.URL.Query()
+	opts := &models.NoteListOptions{
+		Limit:    defaultPageSize,
+		Sort:     models.NoteSortCreated,
+		Order:    models.SortDesc,
+		Title:    query.Get("title"),
+		Tags:     query["tag"],
+		TagMatch: models.TagMatchAll,
+	}
+
+	if notebook := query.Get("notebook_id"); notebook != "" {
+		id, err := strconv.Atoi(notebook)
+		if err != nil {
+			return nil, fmt.Errorf("notebook_id must be an integer")
+		}
+		opts.NotebookID = &id
+		opts.Descendants = query.Get("descendants") == "true"
+	}
+
+	if workspace := query.Get("workspace_id"); workspace != "" {
+		id, err := strconv.Atoi(workspace)
+		if err != nil {
+			return nil, fmt.Errorf("workspace_id must be an integer")
+		}
+		opts.WorkspaceID = &id
+	}
+
+	if match := query.Get("tag_match"); match != "" {
+		if match != models.TagMatchAll && match != models.TagMatchAny {
+			return nil, fmt.Errorf("tag_match must be all or any")
+		}
+		opts.TagMatch = match
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		opts.Limit = n
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		switch sort {
+		case models.NoteSortCreated, models.NoteSortUpdated, models.NoteSortTitle:
+			opts.Sort = sort
+		default:
+			return nil, fmt.Errorf("sort must be one of created, updated, title")
+		}
+		if sort == models.NoteSortTitle {
+			opts.Order = models.SortAsc
+		}
+	}
+
+	if order := query.Get("order"); order != "" {
+		if order != models.SortAsc && order != models.SortDesc {
+			return nil, fmt.Errorf("order must be asc or desc")
+		}
+		opts.Order = order
+	}
+
+	timeFilters := map[string]**time.Time{
+		"created_after":  &opts.CreatedAfter,
+		"created_before": &opts.CreatedBefore,
+		"updated_after":  &opts.UpdatedAfter,
+		"updated_before": &opts.UpdatedBefore,
+	}
+	for name, dst := range timeFilters {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+		}
+		*dst = &t
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil || after.Sort != opts.Sort || after.Order != opts.Order {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		opts.After = after
+	}
+
+	return opts, nil
+}
+
+func encodeCursor(cursor *models.NoteCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*models.NoteCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := new(models.NoteCursor)
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+
+	// Timestamp values are cast in SQL, so a tampered one must fail here
+	// rather than in the query.
+	if cursor.Sort == models.NoteSortCreated || cursor.Sort == models.NoteSortUpdated {
+		if _, err := time.Parse(time.RFC3339, cursor.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	return cursor, nil
+}
+
+func trimTags(note *models.NotePayload) {
+	for i, tag := range note.Tags {
+		note.Tags[i] = strings.TrimSpace(tag)
+	}
+}
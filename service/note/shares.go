@@ -0,0 +1,150 @@
+package note
+
+import (
+	"database/sql"
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/utils"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator"
+	"github.com/gorilla/mux"
+)
+
+// HandleGetSharedNotes lists the notes other users shared with the caller,
+// each with the permission it was shared at.
+func (h *Handler) HandleGetSharedNotes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	notes, err := h.store.GetSharedNotes(userID)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", notes)
+}
+
+// HandleGetNoteShares lists who the owner shared the note with.
+func (h *Handler) HandleGetNoteShares(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	shares, err := h.store.GetNoteShares(userID, id)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", shares)
+}
+
+// HandleShareNote gives another user, named by email or username, viewer
+// or editor access to a note of the caller.
+func (h *Handler) HandleShareNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	var payload models.NoteSharePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	payload.User = strings.TrimSpace(payload.User)
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return
+	}
+
+	if !models.IsValidSharePermission(payload.Permission) {
+		utils.ResponseJSON(w, http.StatusBadRequest, "permission must be viewer or editor", false)
+		return
+	}
+
+	share, err := h.store.ShareNote(userID, id, &payload)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditNoteShared,
+		ActorID: userID,
+		UserID:  share.UserID,
+		Target:  "note:" + strconv.Itoa(id),
+		Details: map[string]string{"permission": share.Permission},
+	})
+	utils.ResponseJSON(w, http.StatusCreated, "share success", share)
+}
+
+// HandleRevokeNoteShare takes a user's access to the note away. Owners can
+// remove anyone; other users can only remove themselves.
+func (h *Handler) HandleRevokeNoteShare(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	shareUserID, err := strconv.Atoi(mux.Vars(r)["user"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, "invalid user", false)
+		return
+	}
+
+	if err := h.store.RevokeNoteShare(userID, id, shareUserID); err != nil {
+		writeShareError(w, err)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditNoteUnshared,
+		ActorID: userID,
+		UserID:  shareUserID,
+		Target:  "note:" + strconv.Itoa(id),
+	})
+	utils.ResponseJSON(w, http.StatusOK, "delete success", shareUserID)
+}
+
+func writeShareError(w http.ResponseWriter, err error) {
+	switch err {
+	case sql.ErrNoRows:
+		utils.ResponseJSON(w, http.StatusNotFound, "note not found", false)
+	case models.ErrShareNotFound, models.ErrShareUserNotFound:
+		utils.ResponseJSON(w, http.StatusNotFound, err.Error(), false)
+	case models.ErrNoteOwnerOnly:
+		utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+	case models.ErrShareSelf, models.ErrShareUserAmbiguous, models.ErrWorkspaceNoteShare:
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+	default:
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+	}
+}
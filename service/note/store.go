@@ -2,122 +2,1270 @@ package note
 
 import (
 	"database/sql"
+	"fmt"
 	"go-note/models"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
-type Store struct {
-	db *sql.DB
+const noteColumns = `id, title, description, user_id, notebook_id, workspace_id, version, created_at, updated_at, deleted_at`
+
+var sortColumns = map[string]string{
+	models.NoteSortCreated: "created_at",
+	models.NoteSortUpdated: "updated_at",
+	models.NoteSortTitle:   "title",
+}
+
+var sortCasts = map[string]string{
+	models.NoteSortCreated: "::timestamptz",
+	models.NoteSortUpdated: "::timestamptz",
+	models.NoteSortTitle:   "",
+}
+
+const revisionColumns = `note_id, revision, title, description, created_at`
+
+const linkColumns = `id, note_id, token_hash, COALESCE(password_hash, ''), expires_at, views, last_viewed_at, created_at`
+
+// DefaultRevisionLimit is how many revisions are kept per note unless
+// SetRevisionLimit says otherwise.
+const DefaultRevisionLimit = 50
+
+type Store struct {
+	db            *sql.DB
+	revisionLimit int
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db, revisionLimit: DefaultRevisionLimit}
+}
+
+// SetRevisionLimit bounds the number of revisions kept per note.
+func (s *Store) SetRevisionLimit(limit int) {
+	s.revisionLimit = limit
+}
+
+// CreateNote adds a note owned by userID, or by the workspace in
+// note.WorkspaceID when the user may write there.
+func (s *Store) CreateNote(userID int, note *models.NotePayload) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if note.WorkspaceID != nil {
+		if note.NotebookID != nil {
+			return models.ErrWorkspaceNotebook
+		}
+		if err := checkWorkspaceRole(tx, userID, *note.WorkspaceID, models.WorkspaceEditor); err != nil {
+			return err
+		}
+	}
+	if err := checkNotebook(tx, userID, note.NotebookID); err != nil {
+		return err
+	}
+
+	id := 0
+	sqlQuery := `INSERT INTO notes (title, description, user_id, notebook_id, workspace_id) VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	err = tx.QueryRow(sqlQuery, note.Title, note.Description, userID, note.NotebookID, note.WorkspaceID).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	if err := setNoteTags(tx, userID, note.WorkspaceID, id, note.Tags); err != nil {
+		return err
+	}
+
+	sqlQuery = `INSERT INTO note_revisions (note_id, revision, title, description) VALUES ($1, 1, $2, $3)`
+	_, err = tx.Exec(sqlQuery, id, note.Title, note.Description)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) GetNotes(userID int, opts *models.NoteListOptions) (*models.NoteList, error) {
+	column := sortColumns[opts.Sort]
+	direction, comparison := "ASC", ">"
+	if opts.Order == models.SortDesc {
+		direction, comparison = "DESC", "<"
+	}
+
+	if opts.WorkspaceID != nil {
+		if err := checkWorkspaceRole(s.db, userID, *opts.WorkspaceID, models.WorkspaceViewer); err != nil {
+			return nil, err
+		}
+	}
+
+	where, args := noteFilters(userID, opts)
+
+	total := 0
+	countQuery := `SELECT COUNT(*) FROM notes WHERE ` + strings.Join(where, " AND ")
+	err := s.db.QueryRow(countQuery, args...).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.After != nil {
+		args = append(args, opts.After.Value, opts.After.ID)
+		where = append(where, fmt.Sprintf("(%s, id) %s ($%d%s, $%d)",
+			column, comparison, len(args)-1, sortCasts[opts.Sort], len(args)))
+	}
+
+	args = append(args, opts.Limit+1)
+	sqlQuery := fmt.Sprintf(`SELECT %s FROM notes WHERE %s ORDER BY %s %s, id %s LIMIT $%d`,
+		noteColumns, strings.Join(where, " AND "), column, direction, direction, len(args))
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := make([]*models.Note, 0)
+	for rows.Next() {
+		note, err := scanRowsIntoNotes(rows)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := &models.NoteList{Notes: notes, Total: total}
+	if len(notes) > opts.Limit {
+		list.Notes = notes[:opts.Limit]
+		list.Next = cursorAfter(list.Notes[opts.Limit-1], opts)
+	}
+
+	if err := s.loadTags(list.Notes...); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// GetNoteByID returns a note the user owns, can see through a workspace or
+// that is shared with them.
+func (s *Store) GetNoteByID(userID, id int) (*models.Note, error) {
+	note := new(models.Note)
+	var permission string
+
+	sqlQuery := `SELECT ` + noteColumns + `, ` + notePermission(2) + ` FROM notes WHERE id = $1 AND deleted_at IS NULL`
+	err := s.db.QueryRow(sqlQuery, id, userID).Scan(
+		&note.ID,
+		&note.Title,
+		&note.Description,
+		&note.UserID,
+		&note.NotebookID,
+		&note.WorkspaceID,
+		&note.Version,
+		&note.CreatedAt,
+		&note.UpdatedAt,
+		&note.DeletedAt,
+		&permission,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if permission == "" {
+		return nil, sql.ErrNoRows
+	}
+	setPermission(note, userID, permission)
+
+	if err := s.loadTags(note); err != nil {
+		return nil, err
+	}
+
+	return note, nil
+}
+
+// UpdateNote overwrites the note, returning its new version, and records
+// the new content as a revision when the title or description changed. A
+// non-zero version must match the note's current version. Editors may
+// change everything but the notebook, which belongs to the owner; workspace
+// notes have none.
+func (s *Store) UpdateNote(userID, id int, note *models.NotePayload, version int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	current, err := lockNote(tx, userID, id, version, models.ShareEditor)
+	if err != nil {
+		return 0, err
+	}
+
+	if note.NotebookID != nil {
+		if err := checkRefile(current, userID, note.NotebookID); err != nil {
+			return 0, err
+		}
+	}
+	if err := checkNotebook(tx, current.UserID, note.NotebookID); err != nil {
+		return 0, err
+	}
+
+	sqlQuery := `
+		UPDATE notes SET title = $1, description = $2, notebook_id = COALESCE($3, notebook_id),
+			version = version + 1, updated_at = now()
+		WHERE id = $4
+		RETURNING version`
+	newVersion := 0
+	err = tx.QueryRow(sqlQuery, note.Title, note.Description, note.NotebookID, id).Scan(&newVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	if note.Title != current.Title || note.Description != current.Description {
+		if err := s.recordRevision(tx, current, note.Title, note.Description); err != nil {
+			return 0, err
+		}
+	}
+
+	if note.Tags != nil {
+		if err := setNoteTags(tx, current.UserID, current.WorkspaceID, id, note.Tags); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newVersion, nil
+}
+
+// PatchNote writes only the columns patch changes and returns the note's
+// new version. A patch that changes nothing leaves the note and its version
+// alone. A non-zero version must match the note's current version. Only
+// the owner may move the note to another notebook, and workspace notes stay
+// out of notebooks.
+func (s *Store) PatchNote(userID, id int, patch *models.NotePatch, version int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	current, err := lockNote(tx, userID, id, version, models.ShareEditor)
+	if err != nil {
+		return 0, err
+	}
+
+	var set []string
+	args := []interface{}{id}
+	column := func(name string, value interface{}) {
+		args = append(args, value)
+		set = append(set, fmt.Sprintf("%s = $%d", name, len(args)))
+	}
+
+	title, description := current.Title, current.Description
+	if patch.Title != nil && *patch.Title != current.Title {
+		title = *patch.Title
+		column("title", title)
+	}
+	if patch.Description != nil && *patch.Description != current.Description {
+		description = *patch.Description
+		column("description", description)
+	}
+	if patch.SetNotebook && !sameNotebook(patch.NotebookID, current.NotebookID) {
+		if err := checkRefile(current, userID, patch.NotebookID); err != nil {
+			return 0, err
+		}
+		if err := checkNotebook(tx, userID, patch.NotebookID); err != nil {
+			return 0, err
+		}
+		column("notebook_id", patch.NotebookID)
+	}
+
+	retag := false
+	if patch.Tags != nil {
+		tags, err := noteTagNames(tx, id)
+		if err != nil {
+			return 0, err
+		}
+		retag = !sameTags(patch.Tags, tags)
+	}
+
+	if len(set) == 0 && !retag {
+		return current.Version, nil
+	}
+
+	newVersion := 0
+	set = append(set, "version = version + 1", "updated_at = now()")
+	sqlQuery := `UPDATE notes SET ` + strings.Join(set, ", ") + ` WHERE id = $1 RETURNING version`
+	err = tx.QueryRow(sqlQuery, args...).Scan(&newVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	if title != current.Title || description != current.Description {
+		if err := s.recordRevision(tx, current, title, description); err != nil {
+			return 0, err
+		}
+	}
+
+	if retag {
+		if err := setNoteTags(tx, current.UserID, current.WorkspaceID, id, patch.Tags); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newVersion, nil
+}
+
+// DeleteNote moves the note to the trash. A non-zero version must match the
+// note's current version.
+func (s *Store) DeleteNote(userID, id int, version int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockNote(tx, userID, id, version, models.ShareOwner); err != nil {
+		return err
+	}
+
+	sqlQuery := `UPDATE notes SET deleted_at = now(), version = version + 1 WHERE id = $1`
+	_, err = tx.Exec(sqlQuery, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) GetRevisions(userID, noteID int) ([]*models.NoteRevision, error) {
+	if err := checkAccess(s.db, userID, noteID, models.ShareViewer); err != nil {
+		return nil, err
+	}
+
+	sqlQuery := `SELECT ` + revisionColumns + ` FROM note_revisions WHERE note_id = $1 ORDER BY revision DESC`
+	rows, err := s.db.Query(sqlQuery, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := make([]*models.NoteRevision, 0)
+	for rows.Next() {
+		revision, err := scanRowsIntoRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (s *Store) GetRevision(userID, noteID, revision int) (*models.NoteRevision, error) {
+	if err := checkAccess(s.db, userID, noteID, models.ShareViewer); err != nil {
+		return nil, err
+	}
+
+	sqlQuery := `SELECT ` + revisionColumns + ` FROM note_revisions WHERE note_id = $1 AND revision = $2`
+	rows, err := s.db.Query(sqlQuery, noteID, revision)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, models.ErrRevisionNotFound
+	}
+
+	return scanRowsIntoRevision(rows)
+}
+
+// RestoreRevision rolls the note's content back to an earlier revision. The
+// rollback is itself recorded as a new revision.
+func (s *Store) RestoreRevision(userID, noteID, revision int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := lockNote(tx, userID, noteID, 0, models.ShareEditor)
+	if err != nil {
+		return err
+	}
+
+	var title, description string
+	sqlQuery := `SELECT title, description FROM note_revisions WHERE note_id = $1 AND revision = $2`
+	err = tx.QueryRow(sqlQuery, noteID, revision).Scan(&title, &description)
+	if err == sql.ErrNoRows {
+		return models.ErrRevisionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if title == current.Title && description == current.Description {
+		return tx.Commit()
+	}
+
+	sqlQuery = `UPDATE notes SET title = $1, description = $2, version = version + 1, updated_at = now() WHERE id = $3`
+	_, err = tx.Exec(sqlQuery, title, description, noteID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.recordRevision(tx, current, title, description); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetTrash lists the user's trashed notes and those of the workspaces they
+// administer, most recently deleted first.
+func (s *Store) GetTrash(userID int) ([]*models.Note, error) {
+	sqlQuery := `SELECT ` + noteColumns + ` FROM notes WHERE ` + managedBy(1) + ` AND deleted_at IS NOT NULL ORDER BY deleted_at DESC, id DESC`
+	rows, err := s.db.Query(sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := make([]*models.Note, 0)
+	for rows.Next() {
+		note, err := scanRowsIntoNotes(rows)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadTags(notes...); err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
+
+func (s *Store) RestoreNote(userID, id int) error {
+	sqlQuery := `UPDATE notes SET deleted_at = NULL WHERE id = $1 AND ` + managedBy(2) + ` AND deleted_at IS NOT NULL`
+	res, err := s.db.Exec(sqlQuery, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// PurgeNote permanently deletes a note that is already in the trash.
+func (s *Store) PurgeNote(userID, id int) error {
+	sqlQuery := `DELETE FROM notes WHERE id = $1 AND ` + managedBy(2) + ` AND deleted_at IS NOT NULL`
+	res, err := s.db.Exec(sqlQuery, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// PurgeTrash permanently deletes every note trashed before the given time,
+// across all users. It is meant for the background purger only.
+func (s *Store) PurgeTrash(before time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM notes WHERE deleted_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// MoveNote puts the note into another notebook, or at the root when
+// notebookID is nil.
+func (s *Store) MoveNote(userID, id int, notebookID *int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := lockNote(tx, userID, id, 0, models.ShareOwner)
+	if err != nil {
+		return err
+	}
+
+	if err := checkRefile(current, userID, notebookID); err != nil {
+		return err
+	}
+	if err := checkNotebook(tx, userID, notebookID); err != nil {
+		return err
+	}
+
+	sqlQuery := `UPDATE notes SET notebook_id = $1, version = version + 1, updated_at = now() WHERE id = $2`
+	_, err = tx.Exec(sqlQuery, notebookID, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func NewStore(db *sql.DB) *Store {
-	return &Store{db: db}
+// SearchNotes matches the user's own notes, the notes of their workspaces
+// and the notes shared with them.
+func (s *Store) SearchNotes(userID int, opts *models.NoteSearchOptions) ([]*models.NoteSearchResult, error) {
+	sqlQuery := `
+		SELECT ` + noteColumns + `, ` + notePermission(1) + `,
+			ts_rank(search, q) AS rank,
+			ts_headline('english', translate(title, $5, ''), q, $6),
+			ts_headline('english', translate(description, $5, ''), q, $7)
+		FROM notes, websearch_to_tsquery('english', $2) AS q
+		WHERE deleted_at IS NULL AND search @@ q AND (
+			(user_id = $1 AND workspace_id IS NULL)
+			OR workspace_id IN (SELECT workspace_id FROM workspace_members WHERE user_id = $1)
+			OR id IN (SELECT note_id FROM note_shares WHERE user_id = $1))
+		ORDER BY rank DESC, id DESC
+		LIMIT $3 OFFSET $4`
+	delimiters := "StartSel=" + models.HighlightStart + ", StopSel=" + models.HighlightStop
+	rows, err := s.db.Query(sqlQuery, userID, opts.Query, opts.Limit, opts.Offset,
+		models.HighlightStart+models.HighlightStop, delimiters+", HighlightAll=true", delimiters+", MaxFragments=2")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*models.NoteSearchResult, 0)
+	for rows.Next() {
+		result := new(models.NoteSearchResult)
+		var permission string
+		err := rows.Scan(
+			&result.ID,
+			&result.Title,
+			&result.Description,
+			&result.UserID,
+			&result.NotebookID,
+			&result.WorkspaceID,
+			&result.Version,
+			&result.CreatedAt,
+			&result.UpdatedAt,
+			&result.DeletedAt,
+			&permission,
+			&result.Rank,
+			&result.TitleHighlight,
+			&result.DescriptionHighlight,
+		)
+		if err != nil {
+			return nil, err
+		}
+		setPermission(&result.Note, userID, permission)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	notes := make([]*models.Note, len(results))
+	for i, result := range results {
+		notes[i] = &result.Note
+	}
+	if err := s.loadTags(notes...); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// ShareNote grants the user named by share access to a note of userID, or
+// changes the access they already have.
+func (s *Store) ShareNote(userID, noteID int, share *models.NoteSharePayload) (*models.NoteShare, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := lockNote(tx, userID, noteID, 0, models.ShareOwner)
+	if err != nil {
+		return nil, err
+	}
+	if current.WorkspaceID != nil {
+		return nil, models.ErrWorkspaceNoteShare
+	}
+
+	result := &models.NoteShare{NoteID: noteID, Permission: share.Permission}
+	if err := findShareUser(tx, share.User, result); err != nil {
+		return nil, err
+	}
+	if result.UserID == userID {
+		return nil, models.ErrShareSelf
+	}
+
+	sqlQuery := `
+		INSERT INTO note_shares (note_id, user_id, permission) VALUES ($1, $2, $3)
+		ON CONFLICT (note_id, user_id) DO UPDATE SET permission = EXCLUDED.permission
+		RETURNING created_at`
+	err = tx.QueryRow(sqlQuery, noteID, result.UserID, result.Permission).Scan(&result.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetNoteShares lists who a note of userID is shared with, oldest share
+// first.
+func (s *Store) GetNoteShares(userID, noteID int) ([]*models.NoteShare, error) {
+	if err := checkAccess(s.db, userID, noteID, models.ShareOwner); err != nil {
+		return nil, err
+	}
+
+	sqlQuery := `
+		SELECT s.note_id, s.user_id, u.email, u.username, s.permission, s.created_at
+		FROM note_shares s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.note_id = $1
+		ORDER BY s.created_at, s.user_id`
+	rows, err := s.db.Query(sqlQuery, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := make([]*models.NoteShare, 0)
+	for rows.Next() {
+		share := new(models.NoteShare)
+		err := rows.Scan(&share.NoteID, &share.UserID, &share.Email, &share.Username, &share.Permission, &share.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+
+	return shares, rows.Err()
 }
 
-func (s *Store) CreateNote(note *models.NotePayload) error {
-	sqlQuery := `INSERT INTO notes (title, description, user_id) VALUES ($1, $2, $3) RETURNING id`
-	_, err := s.db.Exec(sqlQuery, note.Title, note.Description, note.UserID)
+// RevokeNoteShare takes shareUserID's access to the note away at once. It
+// fails with models.ErrShareNotFound when the note is not shared with them.
+func (s *Store) RevokeNoteShare(userID, noteID, shareUserID int) error {
+	if shareUserID != userID {
+		if err := checkAccess(s.db, userID, noteID, models.ShareOwner); err != nil {
+			return err
+		}
+	}
+
+	res, err := s.db.Exec(`DELETE FROM note_shares WHERE note_id = $1 AND user_id = $2`, noteID, shareUserID)
 	if err != nil {
 		return err
 	}
 
-	return err
+	if err := requireAffected(res); err != nil {
+		return models.ErrShareNotFound
+	}
+
+	return nil
 }
 
-func (s *Store) GetNotes() ([]*models.Note, error) {
-	sqlQuery := `SELECT * FROM notes`
-	rows, err := s.db.Query(sqlQuery)
+// GetSharedNotes lists the notes other users shared with userID, most
+// recently updated first.
+func (s *Store) GetSharedNotes(userID int) ([]*models.Note, error) {
+	sqlQuery := `
+		SELECT ` + noteColumns + `, ` + sharedPermission(1) + `
+		FROM notes
+		WHERE id IN (SELECT note_id FROM note_shares WHERE user_id = $1) AND deleted_at IS NULL
+		ORDER BY updated_at DESC, id DESC`
+	rows, err := s.db.Query(sqlQuery, userID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	notes := make([]*models.Note, 0)
 	for rows.Next() {
-		note, err := scanRowsIntoNotes(rows)
+		note := new(models.Note)
+		err := rows.Scan(
+			&note.ID,
+			&note.Title,
+			&note.Description,
+			&note.UserID,
+			&note.NotebookID,
+			&note.WorkspaceID,
+			&note.Version,
+			&note.CreatedAt,
+			&note.UpdatedAt,
+			&note.DeletedAt,
+			&note.Permission,
+		)
 		if err != nil {
 			return nil, err
 		}
 		notes = append(notes, note)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	return notes, nil
+	if err := s.loadTags(notes...); err != nil {
+		return nil, err
+	}
 
+	return notes, nil
 }
 
-func (s *Store) GetNoteByID(id int) (*models.Note, error) {
+// CreateNoteLink publishes a note of userID under link.TokenHash and fills
+// in the link's ID and creation time.
+func (s *Store) CreateNoteLink(userID int, link *models.NoteLink) error {
+	if err := checkAccess(s.db, userID, link.NoteID, models.ShareOwner); err != nil {
+		return err
+	}
+
+	var password *string
+	if link.PasswordHash != "" {
+		password = &link.PasswordHash
+	}
 
-	exists, err := checkID(id, s.db)
+	sqlQuery := `
+		INSERT INTO note_links (note_id, token_hash, password_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+	err := s.db.QueryRow(sqlQuery, link.NoteID, link.TokenHash, password, link.ExpiresAt).Scan(&link.ID, &link.CreatedAt)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if !exists {
-		return nil, sql.ErrNoRows
+	link.HasPassword = password != nil
+
+	return nil
+}
+
+// GetNoteLinks lists the public links of a note of userID, newest first.
+func (s *Store) GetNoteLinks(userID, noteID int) ([]*models.NoteLink, error) {
+	if err := checkAccess(s.db, userID, noteID, models.ShareOwner); err != nil {
+		return nil, err
 	}
 
-	sqlQuery := `SELECT * FROM notes WHERE id = $1`
-	rows, err := s.db.Query(sqlQuery, id)
+	sqlQuery := `SELECT ` + linkColumns + ` FROM note_links WHERE note_id = $1 ORDER BY created_at DESC, id DESC`
+	rows, err := s.db.Query(sqlQuery, noteID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	note := new(models.Note)
+	links := make([]*models.NoteLink, 0)
 	for rows.Next() {
-		note, err = scanRowsIntoNotes(rows)
+		link, err := scanRowIntoLink(rows)
 		if err != nil {
 			return nil, err
 		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+// DeleteNoteLink revokes a public link of a note of userID. It fails with
+// models.ErrLinkNotFound when the note has no such link.
+func (s *Store) DeleteNoteLink(userID, noteID, linkID int) error {
+	if err := checkAccess(s.db, userID, noteID, models.ShareOwner); err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(`DELETE FROM note_links WHERE id = $1 AND note_id = $2`, linkID, noteID)
+	if err != nil {
+		return err
+	}
+
+	if err := requireAffected(res); err != nil {
+		return models.ErrLinkNotFound
+	}
+
+	return nil
+}
+
+func (s *Store) GetNoteLinkByToken(tokenHash string) (*models.NoteLink, error) {
+	sqlQuery := `
+		SELECT ` + linkColumns + ` FROM note_links
+		WHERE token_hash = $1
+			AND note_id IN (SELECT id FROM notes WHERE deleted_at IS NULL)`
+
+	return scanRowIntoLink(s.db.QueryRow(sqlQuery, tokenHash))
+}
+
+func (s *Store) ViewNoteLink(linkID int) (*models.PublicNote, error) {
+	note := new(models.PublicNote)
+
+	sqlQuery := `
+		WITH viewed AS (
+			UPDATE note_links SET views = views + 1, last_viewed_at = now()
+			WHERE id = $1 AND note_id IN (SELECT id FROM notes WHERE deleted_at IS NULL)
+			RETURNING note_id
+		)
+		SELECT n.title, n.description, n.updated_at
+		FROM notes n JOIN viewed v ON v.note_id = n.id
+		WHERE n.deleted_at IS NULL`
+	err := s.db.QueryRow(sqlQuery, linkID).Scan(&note.Title, &note.Description, &note.UpdatedAt)
+	if err != nil {
+		return nil, err
 	}
 
 	return note, nil
 }
 
-func (s *Store) UpdateNote(id int, note *models.NotePayload) error {
+// findShareUser fills in the user to share with, looked up by email when
+// name contains an @ and by username otherwise.
+func findShareUser(tx *sql.Tx, name string, share *models.NoteShare) error {
+	sqlQuery := `SELECT id, email, username FROM users WHERE username = $1 LIMIT 2`
+	if strings.Contains(name, "@") {
+		sqlQuery = `SELECT id, email, username FROM users WHERE lower(email) = lower($1) LIMIT 2`
+	}
 
-	exists, err := checkID(id, s.db)
+	rows, err := tx.Query(sqlQuery, name)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return sql.ErrNoRows
+	defer rows.Close()
+
+	found := 0
+	for rows.Next() {
+		if err := rows.Scan(&share.UserID, &share.Email, &share.Username); err != nil {
+			return err
+		}
+		found++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	switch found {
+	case 0:
+		return models.ErrShareUserNotFound
+	case 1:
+		return nil
+	default:
+		return models.ErrShareUserAmbiguous
+	}
+}
+
+// lockNote locks an active note the user has at least need access to for
+// the rest of the transaction and returns its owner and current content. It
+// fails like checkAccess, and with models.ErrVersionMismatch when version is
+// non-zero and differs from the note's.
+func lockNote(tx *sql.Tx, userID, id, version int, need string) (*models.Note, error) {
+	note := &models.Note{ID: id}
+	var permission string
+
+	sqlQuery := `SELECT user_id, notebook_id, workspace_id, title, description, version, ` + notePermission(2) + `
+		FROM notes WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`
+	err := tx.QueryRow(sqlQuery, id, userID).Scan(&note.UserID, &note.NotebookID, &note.WorkspaceID, &note.Title, &note.Description, &note.Version, &permission)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := requireAccess(permission, need); err != nil {
+		return nil, err
+	}
+
+	if version != 0 && version != note.Version {
+		return nil, models.ErrVersionMismatch
+	}
+
+	return note, nil
+}
+
+// recordRevision stores title and description as the note's next revision
+// and prunes revisions beyond the store's limit. Notes created before
+// revisions existed get their previous content saved first.
+func (s *Store) recordRevision(tx *sql.Tx, previous *models.Note, title, description string) error {
+	sqlQuery := `
+		INSERT INTO note_revisions (note_id, revision, title, description)
+		SELECT $1, 1, $2, $3
+		WHERE NOT EXISTS (SELECT 1 FROM note_revisions WHERE note_id = $1)`
+	_, err := tx.Exec(sqlQuery, previous.ID, previous.Title, previous.Description)
+	if err != nil {
+		return err
 	}
 
-	sqlQuery := `UPDATE notes SET title = $1, description = $2, user_id = $3 WHERE id = $4`
-	_, err = s.db.Exec(sqlQuery, note.Title, note.Description, note.UserID, id)
+	sqlQuery = `
+		INSERT INTO note_revisions (note_id, revision, title, description)
+		SELECT $1, MAX(revision) + 1, $2, $3 FROM note_revisions WHERE note_id = $1`
+	_, err = tx.Exec(sqlQuery, previous.ID, title, description)
 	if err != nil {
 		return err
 	}
 
+	sqlQuery = `
+		DELETE FROM note_revisions
+		WHERE note_id = $1 AND revision <= (SELECT MAX(revision) FROM note_revisions WHERE note_id = $1) - $2`
+	_, err = tx.Exec(sqlQuery, previous.ID, s.revisionLimit)
+
 	return err
 }
 
-func (s *Store) DeleteNote(id int) error {
+// checkNotebook fails with models.ErrNotebookNotFound unless notebookID is
+// nil or one of the user's notebooks.
+func checkNotebook(tx *sql.Tx, userID int, notebookID *int) error {
+	if notebookID == nil {
+		return nil
+	}
 
-	exists, err := checkID(id, s.db)
+	exists := false
+	sqlQuery := `SELECT EXISTS (SELECT 1 FROM notebooks WHERE id = $1 AND user_id = $2)`
+	err := tx.QueryRow(sqlQuery, *notebookID, userID).Scan(&exists)
 	if err != nil {
 		return err
 	}
 	if !exists {
-		return sql.ErrNoRows
+		return models.ErrNotebookNotFound
+	}
+
+	return nil
+}
+
+// setNoteTags replaces the tags of a note, creating any that don't exist
+// yet. Notes of a workspace take the workspace's tags, other notes the tags
+// of userID, their owner. Names are matched case-insensitively.
+func setNoteTags(tx *sql.Tx, userID int, workspaceID *int, noteID int, names []string) error {
+	_, err := tx.Exec(`DELETE FROM note_tags WHERE note_id = $1`, noteID)
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	owner, ownerID := "user_id", userID
+	if workspaceID != nil {
+		owner, ownerID = "workspace_id", *workspaceID
 	}
 
-	sqlQuery := `DELETE FROM notes WHERE id = $1`
-	_, err = s.db.Exec(sqlQuery, id)
+	sqlQuery := `
+		INSERT INTO tags (` + owner + `, name)
+		SELECT DISTINCT ON (lower(name)) $1, name FROM unnest($2::text[]) AS name
+		ON CONFLICT (` + owner + `, lower(name)) DO NOTHING`
+	_, err = tx.Exec(sqlQuery, ownerID, pq.Array(names))
 	if err != nil {
 		return err
 	}
 
+	sqlQuery = `
+		INSERT INTO note_tags (note_id, tag_id)
+		SELECT $1, id FROM tags WHERE ` + owner + ` = $2 AND lower(name) = ANY($3)`
+	_, err = tx.Exec(sqlQuery, noteID, ownerID, pq.Array(lowerAll(names)))
 	return err
 }
 
-func checkID(id int, db *sql.DB) (bool, error) {
-	exists := false
+// noteTagNames returns the names of the tags on a note.
+func noteTagNames(tx *sql.Tx, noteID int) ([]string, error) {
+	sqlQuery := `
+		SELECT t.name FROM note_tags nt
+		JOIN tags t ON t.id = nt.tag_id
+		WHERE nt.note_id = $1`
+	rows, err := tx.Query(sqlQuery, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// loadTags fills in the tag names of the given notes with a single query.
+func (s *Store) loadTags(notes ...*models.Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*models.Note, len(notes))
+	ids := make([]int64, 0, len(notes))
+	for _, note := range notes {
+		note.Tags = make([]string, 0)
+		byID[note.ID] = note
+		ids = append(ids, int64(note.ID))
+	}
+
+	sqlQuery := `
+		SELECT nt.note_id, t.name
+		FROM note_tags nt
+		JOIN tags t ON t.id = nt.tag_id
+		WHERE nt.note_id = ANY($1)
+		ORDER BY lower(t.name)`
+	rows, err := s.db.Query(sqlQuery, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var noteID int
+		var name string
+		if err := rows.Scan(&noteID, &name); err != nil {
+			return err
+		}
+		if note, ok := byID[noteID]; ok {
+			note.Tags = append(note.Tags, name)
+		}
+	}
+
+	return rows.Err()
+}
+
+func uniqueFold(names []string) map[string]bool {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[strings.ToLower(name)] = true
+	}
+
+	return seen
+}
+
+func lowerAll(names []string) []string {
+	lowered := make([]string, len(names))
+	for i, name := range names {
+		lowered[i] = strings.ToLower(name)
+	}
+
+	return lowered
+}
+
+// rowQuerier is what checkAccess needs from *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// checkAccess succeeds when the note id exists outside the trash and userID
+// has at least need access to it. Notes the user can't see are
+// indistinguishable from missing ones.
+func checkAccess(q rowQuerier, userID, id int, need string) error {
+	var permission string
+
+	sqlQuery := `SELECT ` + notePermission(2) + ` FROM notes WHERE id = $1 AND deleted_at IS NULL`
+	err := q.QueryRow(sqlQuery, id, userID).Scan(&permission)
+	if err != nil {
+		return err
+	}
+
+	return requireAccess(permission, need)
+}
+
+// requireAccess fails with sql.ErrNoRows when permission grants no access,
+// and with models.ErrNoteReadOnly or models.ErrNoteOwnerOnly when it grants
+// less than need.
+func requireAccess(permission, need string) error {
+	switch {
+	case permission == "":
+		return sql.ErrNoRows
+	case models.SharePermits(permission, need):
+		return nil
+	case need == models.ShareOwner:
+		return models.ErrNoteOwnerOnly
+	default:
+		return models.ErrNoteReadOnly
+	}
+}
+
+// notePermission selects the access the user in query parameter param has
+// to each note, or an empty string for none. Workspace notes are only reachable through
+// membership: owners and admins get owner access, editors and viewers the
+// same as through a share. Personal notes are the owner's and otherwise
+// reachable through shares.
+func notePermission(param int) string {
+	return fmt.Sprintf(`CASE
+		WHEN notes.workspace_id IS NOT NULL THEN COALESCE((
+			SELECT CASE m.role WHEN 'editor' THEN 'editor' WHEN 'viewer' THEN 'viewer' ELSE 'owner' END
+			FROM workspace_members m WHERE m.workspace_id = notes.workspace_id AND m.user_id = $%[1]d), '')
+		WHEN notes.user_id = $%[1]d THEN 'owner'
+		ELSE %[2]s
+	END`, param, sharedPermission(param))
+}
+
+// sharedPermission selects the permission a share grants the user in query
+// parameter param on each note, or an empty string when the note is not
+// shared with them.
+func sharedPermission(param int) string {
+	return fmt.Sprintf(`COALESCE((SELECT s.permission FROM note_shares s WHERE s.note_id = notes.id AND s.user_id = $%d), '')`, param)
+}
+
+// managedBy is the condition on notes the user in query parameter param may
+// trash, restore and purge: their personal notes and the notes of the
+// workspaces they own or administer.
+func managedBy(param int) string {
+	return fmt.Sprintf(`((user_id = $%[1]d AND workspace_id IS NULL) OR workspace_id IN (
+		SELECT workspace_id FROM workspace_members WHERE user_id = $%[1]d AND role IN ('owner', 'admin')))`, param)
+}
+
+// setPermission reports permission on notes the user doesn't own
+// personally.
+func setPermission(note *models.Note, userID int, permission string) {
+	if note.WorkspaceID != nil || note.UserID != userID {
+		note.Permission = permission
+	}
+}
+
+// checkWorkspaceRole fails with models.ErrWorkspaceNotFound unless userID
+// is a member of the workspace, and with models.ErrWorkspaceRole when their
+// role is below need.
+func checkWorkspaceRole(q rowQuerier, userID, workspaceID int, need string) error {
+	var role string
+	sqlQuery := `SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2`
+	err := q.QueryRow(sqlQuery, workspaceID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return models.ErrWorkspaceNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if !models.WorkspaceRolePermits(role, need) {
+		return models.ErrWorkspaceRole
+	}
+
+	return nil
+}
+
+// checkRefile fails when userID may not put the locked note current into
+// notebookID: workspace notes stay out of notebooks and only the owner
+// files a personal note.
+func checkRefile(current *models.Note, userID int, notebookID *int) error {
+	switch {
+	case sameNotebook(notebookID, current.NotebookID):
+		return nil
+	case current.WorkspaceID != nil:
+		return models.ErrWorkspaceNotebook
+	case current.UserID != userID:
+		return models.ErrNoteOwnerOnly
+	default:
+		return nil
+	}
+}
+
+// noteFilters builds the WHERE conditions shared by the count and page
+// queries of GetNotes.
+func noteFilters(userID int, opts *models.NoteListOptions) ([]string, []interface{}) {
+	where := []string{"deleted_at IS NULL"}
+	args := []interface{}{userID}
+
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if opts.WorkspaceID != nil {
+		add("workspace_id = $%d", *opts.WorkspaceID)
+		where = append(where, "workspace_id IN (SELECT workspace_id FROM workspace_members WHERE user_id = $1)")
+	} else {
+		where = append(where, "user_id = $1", "workspace_id IS NULL")
+	}
+
+	if opts.Title != "" {
+		add("title ILIKE '%%' || $%d || '%%'", opts.Title)
+	}
+	if len(opts.Tags) > 0 {
+		tagged := `id IN (
+			SELECT nt.note_id FROM note_tags nt
+			JOIN tags t ON t.id = nt.tag_id
+			WHERE lower(t.name) = ANY($%d)`
+		if opts.TagMatch == models.TagMatchAll {
+			tagged += fmt.Sprintf(` GROUP BY nt.note_id HAVING COUNT(DISTINCT t.id) = %d`, len(uniqueFold(opts.Tags)))
+		}
+		add(tagged+`)`, pq.Array(lowerAll(opts.Tags)))
+	}
+	if opts.NotebookID != nil {
+		if opts.Descendants {
+			add(`notebook_id IN (
+				WITH RECURSIVE subtree AS (
+					SELECT id FROM notebooks WHERE id = $%d
+					UNION ALL
+					SELECT nb.id FROM notebooks nb JOIN subtree ON nb.parent_id = subtree.id
+				)
+				SELECT id FROM subtree)`, *opts.NotebookID)
+		} else {
+			add("notebook_id = $%d", *opts.NotebookID)
+		}
+	}
+	if opts.CreatedAfter != nil {
+		add("created_at >= $%d", *opts.CreatedAfter)
+	}
+	if opts.CreatedBefore != nil {
+		add("created_at < $%d", *opts.CreatedBefore)
+	}
+	if opts.UpdatedAfter != nil {
+		add("updated_at >= $%d", *opts.UpdatedAfter)
+	}
+	if opts.UpdatedBefore != nil {
+		add("updated_at < $%d", *opts.UpdatedBefore)
+	}
+
+	return where, args
+}
+
+func cursorAfter(note *models.Note, opts *models.NoteListOptions) *models.NoteCursor {
+	cursor := &models.NoteCursor{Sort: opts.Sort, Order: opts.Order, ID: note.ID}
+
+	switch opts.Sort {
+	case models.NoteSortUpdated:
+		cursor.Value = note.UpdatedAt.Format(time.RFC3339Nano)
+	case models.NoteSortTitle:
+		cursor.Value = note.Title
+	default:
+		cursor.Value = note.CreatedAt.Format(time.RFC3339Nano)
+	}
+
+	return cursor
+}
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
 
-	sqlQuery := `SELECT EXISTS (SELECT * FROM notes WHERE id = $1)`
-	err := db.QueryRow(sqlQuery, id).Scan(&exists)
+	return nil
+}
+
+func scanRowsIntoRevision(rows *sql.Rows) (*models.NoteRevision, error) {
+	revision := new(models.NoteRevision)
+
+	err := rows.Scan(
+		&revision.NoteID,
+		&revision.Revision,
+		&revision.Title,
+		&revision.Description,
+		&revision.CreatedAt,
+	)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	return exists, nil
+	return revision, nil
 }
 
 func scanRowsIntoNotes(rows *sql.Rows) (*models.Note, error) {
@@ -128,6 +1276,12 @@ func scanRowsIntoNotes(rows *sql.Rows) (*models.Note, error) {
 		&note.Title,
 		&note.Description,
 		&note.UserID,
+		&note.NotebookID,
+		&note.WorkspaceID,
+		&note.Version,
+		&note.CreatedAt,
+		&note.UpdatedAt,
+		&note.DeletedAt,
 	)
 	if err != nil {
 		return nil, err
@@ -136,3 +1290,29 @@ func scanRowsIntoNotes(rows *sql.Rows) (*models.Note, error) {
 	return note, nil
 
 }
+
+// rowScanner is a *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRowIntoLink(row rowScanner) (*models.NoteLink, error) {
+	link := new(models.NoteLink)
+
+	err := row.Scan(
+		&link.ID,
+		&link.NoteID,
+		&link.TokenHash,
+		&link.PasswordHash,
+		&link.ExpiresAt,
+		&link.Views,
+		&link.LastViewedAt,
+		&link.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	link.HasPassword = link.PasswordHash != ""
+
+	return link, nil
+}
@@ -0,0 +1,182 @@
+package notebook
+
+import (
+	"database/sql"
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/utils"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/validator"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store models.NotebookStore
+}
+
+func NewHandler(store models.NotebookStore) *Handler {
+	return &Handler{store: store}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+
+	notebookRouter := router.PathPrefix("/notebooks").Subrouter()
+	notebookRouter.Use(middlewares.JWTMiddleware)
+
+	notebookRouter.Handle("/", middlewares.Permit(models.PermNotesWrite, h.HandleCreateNotebook)).Methods("POST")
+	notebookRouter.Handle("/", middlewares.Permit(models.PermNotesRead, h.HandleGetNotebooks)).Methods("GET")
+	notebookRouter.Handle("/{id}", middlewares.Permit(models.PermNotesRead, h.HandleGetNotebookByID)).Methods("GET")
+	notebookRouter.Handle("/{id}", middlewares.Permit(models.PermNotesWrite, h.HandleUpdateNotebook)).Methods("PUT")
+	notebookRouter.Handle("/{id}", middlewares.Permit(models.PermNotesWrite, h.HandleDeleteNotebook)).Methods("DELETE")
+
+}
+
+func (h *Handler) HandleCreateNotebook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	notebook, ok := parseNotebookPayload(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.store.CreateNotebook(userID, notebook)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusCreated, "create success", false)
+}
+
+func (h *Handler) HandleGetNotebooks(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	notebooks, err := h.store.GetNotebooks(userID)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", notebooks)
+}
+
+// HandleGetNotebookByID returns a notebook. With ?descendants=true its
+// sub-notebooks are nested under "children".
+func (h *Handler) HandleGetNotebookByID(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	descendants := r.URL.Query().Get("descendants") == "true"
+	notebook, err := h.store.GetNotebookByID(userID, id, descendants)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", notebook)
+}
+
+func (h *Handler) HandleUpdateNotebook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	notebook, ok := parseNotebookPayload(w, r)
+	if !ok {
+		return
+	}
+
+	err = h.store.UpdateNotebook(userID, id, notebook)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "update success", id)
+}
+
+// HandleDeleteNotebook deletes a notebook. ?notes=cascade also deletes its
+// sub-notebooks and notes; the default moves them up to the parent.
+func (h *Handler) HandleDeleteNotebook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	mode := r.URL.Query().Get("notes")
+	switch mode {
+	case "":
+		mode = models.NotebookDeleteRehome
+	case models.NotebookDeleteRehome, models.NotebookDeleteCascade:
+	default:
+		utils.ResponseJSON(w, http.StatusBadRequest, "notes must be rehome or cascade", false)
+		return
+	}
+
+	err = h.store.DeleteNotebook(userID, id, mode)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "delete success", id)
+}
+
+func parseNotebookPayload(w http.ResponseWriter, r *http.Request) (*models.NotebookPayload, bool) {
+	var notebook models.NotebookPayload
+	if err := utils.ParseJSON(r, &notebook); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return nil, false
+	}
+
+	notebook.Name = strings.TrimSpace(notebook.Name)
+	if err := utils.Validate.Struct(notebook); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return nil, false
+	}
+
+	return &notebook, true
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch err {
+	case sql.ErrNoRows:
+		utils.ResponseJSON(w, http.StatusNotFound, "notebook not found", false)
+	case models.ErrNotebookNotFound:
+		utils.ResponseJSON(w, http.StatusBadRequest, "parent notebook not found", false)
+	case models.ErrNotebookCycle:
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+	default:
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+	}
+}
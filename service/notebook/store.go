@@ -0,0 +1,234 @@
+package notebook
+
+import (
+	"database/sql"
+	"go-note/models"
+)
+
+const notebookColumns = `
+	nb.id, nb.name, nb.user_id, nb.parent_id, nb.created_at, nb.updated_at,
+	(SELECT COUNT(*) FROM notes WHERE notebook_id = nb.id AND deleted_at IS NULL)`
+
+// subtreeQuery selects the IDs of notebook $1 and all of its descendants,
+// provided $1 belongs to user $2.
+const subtreeQuery = `
+	WITH RECURSIVE subtree AS (
+		SELECT id FROM notebooks WHERE id = $1 AND user_id = $2
+		UNION ALL
+		SELECT nb.id FROM notebooks nb JOIN subtree ON nb.parent_id = subtree.id
+	)
+	SELECT id FROM subtree`
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) CreateNotebook(userID int, notebook *models.NotebookPayload) error {
+	if err := checkParent(s.db, userID, 0, notebook.ParentID); err != nil {
+		return err
+	}
+
+	sqlQuery := `INSERT INTO notebooks (user_id, parent_id, name) VALUES ($1, $2, $3)`
+	_, err := s.db.Exec(sqlQuery, userID, notebook.ParentID, notebook.Name)
+
+	return err
+}
+
+func (s *Store) GetNotebooks(userID int) ([]*models.Notebook, error) {
+	sqlQuery := `SELECT ` + notebookColumns + ` FROM notebooks nb WHERE nb.user_id = $1 ORDER BY lower(nb.name), nb.id`
+	rows, err := s.db.Query(sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notebooks := make([]*models.Notebook, 0)
+	for rows.Next() {
+		notebook, err := scanRowsIntoNotebook(rows)
+		if err != nil {
+			return nil, err
+		}
+		notebooks = append(notebooks, notebook)
+	}
+
+	return notebooks, rows.Err()
+}
+
+// GetNotebookByID returns the notebook, and with descendants set its whole
+// subtree nested under Children.
+func (s *Store) GetNotebookByID(userID, id int, descendants bool) (*models.Notebook, error) {
+	sqlQuery := `SELECT ` + notebookColumns + ` FROM notebooks nb WHERE nb.id = $1 AND nb.user_id = $2`
+	if descendants {
+		sqlQuery = `SELECT ` + notebookColumns + ` FROM notebooks nb WHERE nb.id IN (` + subtreeQuery + `) ORDER BY lower(nb.name), nb.id`
+	}
+
+	rows, err := s.db.Query(sqlQuery, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[int]*models.Notebook)
+	ordered := make([]*models.Notebook, 0)
+	for rows.Next() {
+		notebook, err := scanRowsIntoNotebook(rows)
+		if err != nil {
+			return nil, err
+		}
+		byID[notebook.ID] = notebook
+		ordered = append(ordered, notebook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	root, ok := byID[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	for _, notebook := range ordered {
+		if notebook.ID == id || notebook.ParentID == nil {
+			continue
+		}
+		if parent, ok := byID[*notebook.ParentID]; ok {
+			parent.Children = append(parent.Children, notebook)
+		}
+	}
+
+	return root, nil
+}
+
+func (s *Store) UpdateNotebook(userID, id int, notebook *models.NotebookPayload) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	exists := false
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM notebooks WHERE id = $1 AND user_id = $2)`, id, userID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+
+	if err := checkParent(tx, userID, id, notebook.ParentID); err != nil {
+		return err
+	}
+
+	sqlQuery := `UPDATE notebooks SET name = $1, parent_id = $2, updated_at = now() WHERE id = $3 AND user_id = $4`
+	_, err = tx.Exec(sqlQuery, notebook.Name, notebook.ParentID, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteNotebook removes a notebook either re-homing its contents to its
+// parent or deleting the whole subtree along with its notes.
+func (s *Store) DeleteNotebook(userID, id int, mode string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var parentID sql.NullInt64
+	err = tx.QueryRow(`SELECT parent_id FROM notebooks WHERE id = $1 AND user_id = $2 FOR UPDATE`, id, userID).Scan(&parentID)
+	if err != nil {
+		return err
+	}
+
+	if mode == models.NotebookDeleteCascade {
+		_, err = tx.Exec(`UPDATE notes SET deleted_at = now(), notebook_id = NULL WHERE notebook_id IN (`+subtreeQuery+`) AND deleted_at IS NULL`, id, userID)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err = tx.Exec(`UPDATE notes SET notebook_id = $1 WHERE notebook_id = $2`, parentID, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE notebooks SET parent_id = $1 WHERE parent_id = $2`, parentID, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM notebooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// checkParent makes sure parentID is one of the user's notebooks and, when
+// moving notebook id, not id itself or one of its descendants.
+func checkParent(db queryer, userID, id int, parentID *int) error {
+	if parentID == nil {
+		return nil
+	}
+
+	exists := false
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM notebooks WHERE id = $1 AND user_id = $2)`, *parentID, userID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return models.ErrNotebookNotFound
+	}
+
+	if id == 0 {
+		return nil
+	}
+
+	cycle := false
+	err = db.QueryRow(`SELECT $3 IN (`+subtreeQuery+`)`, id, userID, *parentID).Scan(&cycle)
+	if err != nil {
+		return err
+	}
+	if cycle {
+		return models.ErrNotebookCycle
+	}
+
+	return nil
+}
+
+func scanRowsIntoNotebook(rows *sql.Rows) (*models.Notebook, error) {
+	notebook := new(models.Notebook)
+	var parentID sql.NullInt64
+
+	err := rows.Scan(
+		&notebook.ID,
+		&notebook.Name,
+		&notebook.UserID,
+		&parentID,
+		&notebook.CreatedAt,
+		&notebook.UpdatedAt,
+		&notebook.NoteCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		notebook.ParentID = &id
+	}
+
+	return notebook, nil
+}
@@ -0,0 +1,228 @@
+package tag
+
+import (
+	"database/sql"
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/utils"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store models.TagStore
+}
+
+func NewHandler(store models.TagStore) *Handler {
+	return &Handler{store: store}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+
+	tagRouter := router.PathPrefix("/tags").Subrouter()
+	tagRouter.Use(middlewares.JWTMiddleware)
+
+	tagRouter.Handle("/", middlewares.Permit(models.PermNotesWrite, h.HandleCreateTag)).Methods("POST")
+	tagRouter.Handle("/", middlewares.Permit(models.PermNotesRead, h.HandleGetTags)).Methods("GET")
+	tagRouter.Handle("/{id}", middlewares.Permit(models.PermNotesRead, h.HandleGetTagByID)).Methods("GET")
+	tagRouter.Handle("/{id}", middlewares.Permit(models.PermNotesWrite, h.HandleUpdateTag)).Methods("PUT")
+	tagRouter.Handle("/{id}", middlewares.Permit(models.PermNotesWrite, h.HandleDeleteTag)).Methods("DELETE")
+	tagRouter.Handle("/{id}/merge", middlewares.Permit(models.PermNotesWrite, h.HandleMergeTag)).Methods("POST")
+
+}
+
+func (h *Handler) HandleCreateTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	tag, ok := parseTagPayload(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.store.CreateTag(userID, tag)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusCreated, "create success", false)
+}
+
+func (h *Handler) HandleGetTags(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var workspaceID *int
+	if workspace := r.URL.Query().Get("workspace_id"); workspace != "" {
+		id, err := strconv.Atoi(workspace)
+		if err != nil {
+			utils.ResponseJSON(w, http.StatusBadRequest, "workspace_id must be an integer", false)
+			return
+		}
+		workspaceID = &id
+	}
+
+	tags, err := h.store.GetTags(userID, workspaceID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", tags)
+}
+
+func (h *Handler) HandleGetTagByID(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	tag, err := h.store.GetTagByID(userID, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", tag)
+}
+
+// HandleUpdateTag renames a tag. Notes reference tags by ID, so the new name
+// shows up on every tagged note at once.
+func (h *Handler) HandleUpdateTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	tag, ok := parseTagPayload(w, r)
+	if !ok {
+		return
+	}
+
+	err = h.store.UpdateTag(userID, id, tag)
+	if err == models.ErrTagExists {
+		utils.ResponseJSON(w, http.StatusConflict, "tag already exists, merge the tags instead", false)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "update success", id)
+}
+
+func (h *Handler) HandleDeleteTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	err = h.store.DeleteTag(userID, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "delete success", id)
+}
+
+// HandleMergeTag folds the tag in the URL into the tag given by "into".
+func (h *Handler) HandleMergeTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	var payload models.TagMergePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return
+	}
+
+	if payload.Into == id {
+		utils.ResponseJSON(w, http.StatusBadRequest, "cannot merge a tag into itself", false)
+		return
+	}
+
+	err = h.store.MergeTags(userID, id, payload.Into)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "merge success", payload.Into)
+}
+
+func parseTagPayload(w http.ResponseWriter, r *http.Request) (*models.TagPayload, bool) {
+	var tag models.TagPayload
+	if err := utils.ParseJSON(r, &tag); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return nil, false
+	}
+
+	tag.Name = strings.TrimSpace(tag.Name)
+	if err := utils.Validate.Struct(tag); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return nil, false
+	}
+
+	return &tag, true
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch err {
+	case sql.ErrNoRows:
+		utils.ResponseJSON(w, http.StatusNotFound, "tag not found", false)
+	case models.ErrWorkspaceNotFound:
+		utils.ResponseJSON(w, http.StatusNotFound, err.Error(), false)
+	case models.ErrWorkspaceRole:
+		utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+	case models.ErrTagExists:
+		utils.ResponseJSON(w, http.StatusConflict, err.Error(), false)
+	case models.ErrTagScope:
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+	default:
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+	}
+}
@@ -0,0 +1,239 @@
+package tag
+
+import (
+	"database/sql"
+	"go-note/models"
+	"go-note/utils"
+)
+
+const tagColumns = `t.id, t.name, COALESCE(t.user_id, 0), t.workspace_id, COUNT(n.id)`
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) CreateTag(userID int, tag *models.TagPayload) error {
+	var err error
+	if tag.WorkspaceID == nil {
+		_, err = s.db.Exec(`INSERT INTO tags (user_id, name) VALUES ($1, $2)`, userID, tag.Name)
+	} else {
+		if err := checkWorkspaceRole(s.db, userID, *tag.WorkspaceID, models.WorkspaceEditor); err != nil {
+			return err
+		}
+		_, err = s.db.Exec(`INSERT INTO tags (workspace_id, name) VALUES ($1, $2)`, *tag.WorkspaceID, tag.Name)
+	}
+	if utils.IsUniqueViolation(err) {
+		return models.ErrTagExists
+	}
+
+	return err
+}
+
+func (s *Store) GetTags(userID int, workspaceID *int) ([]*models.Tag, error) {
+	owner, ownerID := "t.user_id", userID
+	if workspaceID != nil {
+		if err := checkWorkspaceRole(s.db, userID, *workspaceID, models.WorkspaceViewer); err != nil {
+			return nil, err
+		}
+		owner, ownerID = "t.workspace_id", *workspaceID
+	}
+
+	sqlQuery := `
+		SELECT ` + tagColumns + `
+		FROM tags t
+		LEFT JOIN note_tags nt ON nt.tag_id = t.id
+		LEFT JOIN notes n ON n.id = nt.note_id AND n.deleted_at IS NULL
+		WHERE ` + owner + ` = $1
+		GROUP BY t.id
+		ORDER BY lower(t.name)`
+	rows, err := s.db.Query(sqlQuery, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]*models.Tag, 0)
+	for rows.Next() {
+		tag, err := scanRowsIntoTag(rows)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+func (s *Store) GetTagByID(userID, id int) (*models.Tag, error) {
+	if _, err := checkTagRole(s.db, userID, id, models.WorkspaceViewer); err != nil {
+		return nil, err
+	}
+
+	sqlQuery := `
+		SELECT ` + tagColumns + `
+		FROM tags t
+		LEFT JOIN note_tags nt ON nt.tag_id = t.id
+		LEFT JOIN notes n ON n.id = nt.note_id AND n.deleted_at IS NULL
+		WHERE t.id = $1
+		GROUP BY t.id`
+	rows, err := s.db.Query(sqlQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+
+	return scanRowsIntoTag(rows)
+}
+
+func (s *Store) UpdateTag(userID, id int, tag *models.TagPayload) error {
+	if _, err := checkTagRole(s.db, userID, id, models.WorkspaceEditor); err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(`UPDATE tags SET name = $1 WHERE id = $2`, tag.Name, id)
+	if utils.IsUniqueViolation(err) {
+		return models.ErrTagExists
+	}
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+func (s *Store) DeleteTag(userID, id int) error {
+	if _, err := checkTagRole(s.db, userID, id, models.WorkspaceEditor); err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(`DELETE FROM tags WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// MergeTags moves every note tagged with sourceID onto targetID and removes
+// the source tag, all in one transaction.
+func (s *Store) MergeTags(userID, sourceID, targetID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	source, err := checkTagRole(tx, userID, sourceID, models.WorkspaceEditor)
+	if err != nil {
+		return err
+	}
+	target, err := checkTagRole(tx, userID, targetID, models.WorkspaceEditor)
+	if err != nil {
+		return err
+	}
+	if source != target {
+		return models.ErrTagScope
+	}
+
+	sqlQuery := `
+		INSERT INTO note_tags (note_id, tag_id)
+		SELECT note_id, $2 FROM note_tags WHERE tag_id = $1
+		ON CONFLICT DO NOTHING`
+	_, err = tx.Exec(sqlQuery, sourceID, targetID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM tags WHERE id = $1`, sourceID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rowQuerier is what the role checks need from *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// checkTagRole fails with sql.ErrNoRows unless the tag id is a personal tag
+// of userID or a tag of one of their workspaces, and with
+// models.ErrWorkspaceRole when their role there is below need. It returns
+// the tag's workspace ID, 0 for personal tags.
+func checkTagRole(q rowQuerier, userID, id int, need string) (int, error) {
+	var workspaceID int
+	var role string
+	sqlQuery := `
+		SELECT COALESCE(t.workspace_id, 0), CASE WHEN t.user_id = $2 THEN 'owner' ELSE m.role END
+		FROM tags t
+		LEFT JOIN workspace_members m ON m.workspace_id = t.workspace_id AND m.user_id = $2
+		WHERE t.id = $1 AND (t.user_id = $2 OR m.user_id IS NOT NULL)`
+	if err := q.QueryRow(sqlQuery, id, userID).Scan(&workspaceID, &role); err != nil {
+		return 0, err
+	}
+
+	if !models.WorkspaceRolePermits(role, need) {
+		return 0, models.ErrWorkspaceRole
+	}
+
+	return workspaceID, nil
+}
+
+func checkWorkspaceRole(q rowQuerier, userID, workspaceID int, need string) error {
+	var role string
+	sqlQuery := `SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2`
+	err := q.QueryRow(sqlQuery, workspaceID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return models.ErrWorkspaceNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if !models.WorkspaceRolePermits(role, need) {
+		return models.ErrWorkspaceRole
+	}
+
+	return nil
+}
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func scanRowsIntoTag(rows *sql.Rows) (*models.Tag, error) {
+	tag := new(models.Tag)
+
+	err := rows.Scan(
+		&tag.ID,
+		&tag.Name,
+		&tag.UserID,
+		&tag.WorkspaceID,
+		&tag.NoteCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return tag, nil
+}
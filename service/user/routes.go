@@ -1,45 +1,404 @@
-package auth
+package user
 
 import (
+	"database/sql"
+	"go-note/auditlog"
+	"go-note/middlewares"
 	"go-note/models"
 	"go-note/utils"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
+	"github.com/go-playground/validator"
 	"github.com/gorilla/mux"
 )
 
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
 type Handler struct {
-	store models.UserStore
+	store    models.UserAdminStore
+	profiles models.ProfileStore
+	tokens   models.PersonalTokenStore
+	sessions models.SessionStore
+	auditLog auditlog.Recorder
+}
+
+// NewHandler returns a handler that logs audit events until
+// SetAuditRecorder is called.
+func NewHandler(store models.UserAdminStore, profiles models.ProfileStore, tokens models.PersonalTokenStore, sessions models.SessionStore) *Handler {
+	return &Handler{
+		store:    store,
+		profiles: profiles,
+		tokens:   tokens,
+		sessions: sessions,
+		auditLog: auditlog.NewLogRecorder(log.Writer()),
+	}
 }
 
-func NewHandler(store models.UserStore) *Handler {
-	return &Handler{store: store}
+// SetAuditRecorder sets where password changes, personal tokens, signed out
+// sessions and admin changes to accounts are recorded.
+func (h *Handler) SetAuditRecorder(rec auditlog.Recorder) {
+	h.auditLog = rec
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) {
-	router.HandleFunc("/user", h.handleGetUser).Methods("GET")
+
+	meRouter := router.PathPrefix("/me").Subrouter()
+	meRouter.Use(middlewares.JWTMiddleware, middlewares.SessionOnly)
+
+	meRouter.HandleFunc("", h.HandleGetMe).Methods("GET")
+	meRouter.HandleFunc("", h.HandleUpdateMe).Methods("PATCH")
+	meRouter.HandleFunc("/password", h.HandleChangePassword).Methods("PUT")
+	meRouter.HandleFunc("/tokens", h.HandleGetTokens).Methods("GET")
+	meRouter.HandleFunc("/tokens", h.HandleCreateToken).Methods("POST")
+	meRouter.HandleFunc("/tokens/{id}", h.HandleDeleteToken).Methods("DELETE")
+	meRouter.HandleFunc("/sessions", h.HandleGetSessions).Methods("GET")
+	meRouter.HandleFunc("/sessions", h.HandleDeleteOtherSessions).Methods("DELETE")
+	meRouter.HandleFunc("/sessions/{id}", h.HandleDeleteSession).Methods("DELETE")
+
+}
+
+// RegisterAdminRoutes expects router to already require the admin role.
+func (h *Handler) RegisterAdminRoutes(router *mux.Router) {
+
+	userRouter := router.PathPrefix("/users").Subrouter()
+
+	userRouter.HandleFunc("/", h.HandleGetUsers).Methods("GET")
+	userRouter.HandleFunc("/{id}", h.HandleGetUserByID).Methods("GET")
+	userRouter.HandleFunc("/{id}", h.HandleDeleteUser).Methods("DELETE")
+	userRouter.HandleFunc("/{id}/role", h.HandleSetRole).Methods("PUT")
+	userRouter.HandleFunc("/{id}/suspend", h.HandleSuspendUser).Methods("POST")
+	userRouter.HandleFunc("/{id}/unsuspend", h.HandleUnsuspendUser).Methods("POST")
+	userRouter.HandleFunc("/{id}/password-reset", h.HandleRequirePasswordReset).Methods("POST")
+
+}
+
+// HandleGetMe returns the account of the authenticated user.
+func (h *Handler) HandleGetMe(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	h.respondProfile(w, userID, "User fetched successfully")
+}
+
+// HandleUpdateMe changes the username and/or email of the authenticated
+// user.
+func (h *Handler) HandleUpdateMe(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload models.UserProfilePatch
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if payload.Email != nil {
+		email := strings.TrimSpace(*payload.Email)
+		payload.Email = &email
+	}
+	if payload.Username != nil {
+		username := strings.TrimSpace(*payload.Username)
+		payload.Username = &username
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, "invalid payload", errors.Error())
+		return
+	}
+
+	err := h.profiles.UpdateProfile(userID, &payload)
+	if err == models.ErrEmailExists {
+		utils.ResponseJSON(w, http.StatusConflict, err.Error(), false)
+		return
+	}
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	h.respondProfile(w, userID, "Profile updated successfully")
+}
+
+// HandleChangePassword sets a new password after checking the current one.
+// Every other session is signed out.
+func (h *Handler) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload models.UserPasswordPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, "invalid payload", errors.Error())
+		return
+	}
+
+	u, err := h.profiles.GetUserByID(userID)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	if !utils.ComparePasswords(u.Password, []byte(payload.CurrentPassword)) {
+		utils.ResponseJSON(w, http.StatusBadRequest, "current password is incorrect", false)
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(payload.NewPassword)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	sessionID := middlewares.GetSessionFromContext(r.Context())
+	if err := h.profiles.UpdatePassword(userID, hashedPassword, sessionID); err != nil {
+		writeUserError(w, err)
+		return
+	}
+	h.auditLog.Record(r, &models.AuditEvent{Action: models.AuditPasswordChanged, ActorID: userID, UserID: userID})
+
+	utils.ResponseJSON(w, http.StatusOK, "Password changed successfully", false)
+}
+
+// HandleGetUsers lists all users by ID, optionally filtered by q (email or
+// username), role and suspended.
+func (h *Handler) HandleGetUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := &models.UserListOptions{
+		Limit: defaultPageSize,
+		Query: query.Get("q"),
+		Role:  query.Get("role"),
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			utils.ResponseJSON(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxPageSize), false)
+			return
+		}
+		opts.Limit = n
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := strconv.Atoi(cursor)
+		if err != nil {
+			utils.ResponseJSON(w, http.StatusBadRequest, "invalid cursor", false)
+			return
+		}
+		opts.After = after
+	}
+
+	if opts.Role != "" && !models.IsValidRole(opts.Role) {
+		utils.ResponseJSON(w, http.StatusBadRequest, "unknown role", false)
+		return
+	}
+
+	if suspended := query.Get("suspended"); suspended != "" {
+		b, err := strconv.ParseBool(suspended)
+		if err != nil {
+			utils.ResponseJSON(w, http.StatusBadRequest, "suspended must be true or false", false)
+			return
+		}
+		opts.Suspended = &b
+	}
+
+	list, err := h.store.GetUsers(opts)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	page := utils.Pagination{Count: len(list.Users), Total: list.Total}
+	if list.Next != nil {
+		page.NextCursor = strconv.Itoa(*list.Next)
+	}
+
+	utils.ResponsePageJSON(w, http.StatusOK, "Users fetched successfully", list.Users, page)
+}
+
+func (h *Handler) HandleGetUserByID(w http.ResponseWriter, r *http.Request) {
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	u, err := h.store.GetUserByID(id)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "User fetched successfully", u)
+}
+
+func (h *Handler) HandleSetRole(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.otherUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload models.UserRolePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, "invalid payload", errors.Error())
+		return
+	}
+
+	if !models.IsValidRole(payload.Role) {
+		utils.ResponseJSON(w, http.StatusBadRequest, "unknown role", false)
+		return
+	}
+
+	if err := h.store.SetUserRole(id, payload.Role); err != nil {
+		writeUserError(w, err)
+		return
+	}
+	h.recordAdminAction(r, models.AuditRoleChanged, id, map[string]string{"role": payload.Role})
+
+	h.respondUser(w, id, "Role updated successfully")
+}
+
+func (h *Handler) HandleSuspendUser(w http.ResponseWriter, r *http.Request) {
+	h.setSuspended(w, r, true)
+}
+
+func (h *Handler) HandleUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	h.setSuspended(w, r, false)
+}
+
+// HandleRequirePasswordReset signs the user out everywhere and blocks logins
+// until they choose a new password.
+func (h *Handler) HandleRequirePasswordReset(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.otherUserID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.store.RequirePasswordReset(id); err != nil {
+		writeUserError(w, err)
+		return
+	}
+	h.recordAdminAction(r, models.AuditPasswordResetRequired, id, nil)
+
+	h.respondUser(w, id, "Password reset required")
+}
+
+// HandleDeleteUser deletes the user and everything they own.
+func (h *Handler) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.otherUserID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.store.DeleteUser(id); err != nil {
+		writeUserError(w, err)
+		return
+	}
+	h.recordAdminAction(r, models.AuditUserDeleted, id, nil)
+
+	utils.ResponseJSON(w, http.StatusOK, "delete success", id)
 }
 
-func (h *Handler) handleGetUser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	str, ok := vars["userID"]
+func (h *Handler) setSuspended(w http.ResponseWriter, r *http.Request, suspended bool) {
+	id, ok := h.otherUserID(w, r)
 	if !ok {
-		utils.ResponseJSON(w, http.StatusBadRequest, "missing user ID", false)
 		return
 	}
 
-	userID, err := strconv.Atoi(str)
+	if err := h.store.SetUserSuspended(id, suspended); err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	action, message := models.AuditUserUnsuspended, "User unsuspended successfully"
+	if suspended {
+		action, message = models.AuditUserSuspended, "User suspended successfully"
+	}
+	h.recordAdminAction(r, action, id, nil)
+	h.respondUser(w, id, message)
+}
+
+// recordAdminAction audits a change the admin making r made to the account
+// id.
+func (h *Handler) recordAdminAction(r *http.Request, action string, id int, details map[string]string) {
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  action,
+		ActorID: middlewares.GetUserIDFromContext(r.Context()),
+		UserID:  id,
+		Details: details,
+	})
+}
+
+// otherUserID returns the ID in the URL, refusing the admin's own ID so an
+// admin cannot lock themselves out.
+func (h *Handler) otherUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	adminID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return 0, false
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return 0, false
+	}
+
+	if id == adminID {
+		utils.ResponseJSON(w, http.StatusBadRequest, "cannot change your own account", false)
+		return 0, false
+	}
+
+	return id, true
+}
+
+func (h *Handler) respondUser(w http.ResponseWriter, id int, message string) {
+	u, err := h.store.GetUserByID(id)
 	if err != nil {
-		utils.ResponseJSON(w, http.StatusBadRequest, "invalid user ID", false)
+		writeUserError(w, err)
 		return
 	}
 
-	user, err := h.store.GetUserByID(userID)
+	utils.ResponseJSON(w, http.StatusOK, message, u)
+}
+
+func (h *Handler) respondProfile(w http.ResponseWriter, id int, message string) {
+	u, err := h.profiles.GetUserByID(id)
 	if err != nil {
-		utils.ResponseJSON(w, http.StatusInternalServerError, "error", err)
+		writeUserError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, message, u)
+}
+
+func writeUserError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusNotFound, "user not found", false)
 		return
 	}
 
-	utils.ResponseJSON(w, http.StatusOK, "success", user)
+	utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
 }
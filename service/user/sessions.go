@@ -0,0 +1,89 @@
+package user
+
+import (
+	"database/sql"
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/utils"
+	"net/http"
+	"strconv"
+)
+
+// HandleGetSessions lists where the user is logged in, marking the session
+// of the request as current.
+func (h *Handler) HandleGetSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := h.sessions.GetSessions(userID)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	current := middlewares.GetSessionFromContext(r.Context())
+	for _, session := range sessions {
+		session.Current = session.ID == current
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "Sessions fetched successfully", sessions)
+}
+
+// HandleDeleteSession signs one session out. Its access tokens stop working
+// at once.
+func (h *Handler) HandleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	err = h.sessions.RevokeSession(userID, id)
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusNotFound, "session not found", false)
+		return
+	}
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditSessionRevoked,
+		ActorID: userID,
+		UserID:  userID,
+		Target:  "session:" + strconv.Itoa(id),
+	})
+
+	utils.ResponseJSON(w, http.StatusOK, "delete success", id)
+}
+
+// HandleDeleteOtherSessions signs out everywhere but the session of the
+// request.
+func (h *Handler) HandleDeleteOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	n, err := h.sessions.RevokeOtherSessions(userID, middlewares.GetSessionFromContext(r.Context()))
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditSessionRevoked,
+		ActorID: userID,
+		UserID:  userID,
+		Target:  "session:others",
+		Details: map[string]string{"count": strconv.Itoa(n)},
+	})
+
+	utils.ResponseJSON(w, http.StatusOK, "Other sessions signed out", map[string]int{"revoked": n})
+}
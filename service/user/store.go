@@ -1,11 +1,17 @@
-package auth
+package user
 
 import (
 	"database/sql"
 	"fmt"
 	"go-note/models"
+	"go-note/utils"
+	"strings"
+
+	"github.com/lib/pq"
 )
 
+const userColumns = `id, email, username, password, role, suspended_at, password_reset_required, created_at, verified_at, totp_enabled_at IS NOT NULL`
+
 type Store struct {
 	db *sql.DB
 }
@@ -15,24 +21,441 @@ func NewStore(db *sql.DB) *Store {
 }
 
 func (s *Store) GetUserByID(id int) (*models.User, error) {
-	rows, err := s.db.Query("SELECT * FROM users WHERE id = ?", id)
+	rows, err := s.db.Query(`SELECT `+userColumns+` FROM users WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+
+	return scanRowsIntoUser(rows)
+}
+
+// UpdateProfile sets the fields present in profile. Email addresses are
+// compared case-insensitively against other accounts, and a new address has
+// to be verified again.
+func (s *Store) UpdateProfile(id int, profile *models.UserProfilePatch) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if profile.Email != nil {
+		taken := false
+		sqlQuery := `SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1) AND id <> $2)`
+		if err := tx.QueryRow(sqlQuery, *profile.Email, id).Scan(&taken); err != nil {
+			return err
+		}
+		if taken {
+			return models.ErrEmailExists
+		}
+	}
+
+	sqlQuery := `
+		UPDATE users
+		SET verified_at = CASE WHEN lower(COALESCE($1, email)) = lower(email) THEN verified_at END,
+			email = COALESCE($1, email),
+			username = COALESCE($2, username)
+		WHERE id = $3`
+	res, err := tx.Exec(sqlQuery, profile.Email, profile.Username, id)
+	if utils.IsUniqueViolation(err) {
+		return models.ErrEmailExists
+	}
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdatePassword stores a new password hash, clears a pending forced reset,
+// ends every session of the user but keepSessionID and revokes their
+// personal access tokens.
+func (s *Store) UpdatePassword(id int, hashedPassword string, keepSessionID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqlQuery := `UPDATE users SET password = $1, password_reset_required = false WHERE id = $2`
+	res, err := tx.Exec(sqlQuery, hashedPassword, id)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		return err
+	}
+
+	if _, err := revokeSessions(tx, id, keepSessionID); err != nil {
+		return err
+	}
+	if err := revokePersonalTokens(tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetUsers pages through all users in ID order.
+func (s *Store) GetUsers(opts *models.UserListOptions) (*models.UserList, error) {
+	where := []string{"TRUE"}
+	args := []interface{}{}
+
+	if opts.Query != "" {
+		args = append(args, opts.Query)
+		where = append(where, fmt.Sprintf("(email ILIKE '%%' || $%d || '%%' OR username ILIKE '%%' || $%d || '%%')", len(args), len(args)))
+	}
+	if opts.Role != "" {
+		args = append(args, opts.Role)
+		where = append(where, fmt.Sprintf("role = $%d", len(args)))
+	}
+	if opts.Suspended != nil {
+		if *opts.Suspended {
+			where = append(where, "suspended_at IS NOT NULL")
+		} else {
+			where = append(where, "suspended_at IS NULL")
+		}
+	}
+
+	total := 0
+	countQuery := `SELECT COUNT(*) FROM users WHERE ` + strings.Join(where, " AND ")
+	err := s.db.QueryRow(countQuery, args...).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.After > 0 {
+		args = append(args, opts.After)
+		where = append(where, fmt.Sprintf("id > $%d", len(args)))
+	}
+
+	args = append(args, opts.Limit+1)
+	sqlQuery := fmt.Sprintf(`SELECT %s FROM users WHERE %s ORDER BY id LIMIT $%d`,
+		userColumns, strings.Join(where, " AND "), len(args))
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]*models.User, 0)
+	for rows.Next() {
+		u, err := scanRowsIntoUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := &models.UserList{Users: users, Total: total}
+	if len(users) > opts.Limit {
+		list.Users = users[:opts.Limit]
+		list.Next = &list.Users[opts.Limit-1].ID
+	}
+
+	return list, nil
+}
+
+// SetUserRole changes the role used for tokens issued from now on.
+func (s *Store) SetUserRole(id int, role string) error {
+	res, err := s.db.Exec(`UPDATE users SET role = $1 WHERE id = $2`, role, id)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// SetUserSuspended suspends or reinstates a user. Suspending also ends the
+// user's sessions so no new access tokens can be issued.
+func (s *Store) SetUserSuspended(id int, suspended bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqlQuery := `
+		UPDATE users
+		SET suspended_at = CASE WHEN $1 THEN COALESCE(suspended_at, now()) ELSE NULL END
+		WHERE id = $2`
+	res, err := tx.Exec(sqlQuery, suspended, id)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		return err
+	}
+
+	if suspended {
+		if _, err := revokeSessions(tx, id, 0); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RequirePasswordReset blocks logins until the user sets a new password,
+// ends the user's sessions and revokes their personal access tokens.
+func (s *Store) RequirePasswordReset(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE users SET password_reset_required = true WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		return err
+	}
+
+	if _, err := revokeSessions(tx, id, 0); err != nil {
+		return err
+	}
+	if err := revokePersonalTokens(tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteUser removes a user together with their personal notes. Personal
+// tags, notebooks, tokens and workspace memberships go with the user through
+// their foreign keys; notes they wrote in workspaces stay there, with the
+// workspace's tags.
+func (s *Store) DeleteUser(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM notes WHERE user_id = $1 AND workspace_id IS NULL`, id); err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		return err
+	}
+
+	// The user's memberships went with them. Workspaces left without
+	// members are deleted; those left without an owner get their
+	// longest-standing admin, or failing that member, as the new owner.
+	if _, err := tx.Exec(`DELETE FROM workspaces w WHERE NOT EXISTS (SELECT 1 FROM workspace_members m WHERE m.workspace_id = w.id)`); err != nil {
+		return err
+	}
+	sqlQuery := `
+		UPDATE workspace_members SET role = 'owner'
+		WHERE (workspace_id, user_id) IN (
+			SELECT DISTINCT ON (m.workspace_id) m.workspace_id, m.user_id
+			FROM workspace_members m
+			WHERE NOT EXISTS (SELECT 1 FROM workspace_members o WHERE o.workspace_id = m.workspace_id AND o.role = 'owner')
+			ORDER BY m.workspace_id, m.role = 'admin' DESC, m.created_at, m.user_id
+		)`
+	if _, err := tx.Exec(sqlQuery); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) CreatePersonalToken(token *models.PersonalAccessToken) error {
+	sqlQuery := `
+		INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+	return s.db.QueryRow(sqlQuery, token.UserID, token.Name, token.TokenHash, pq.Array(token.Scopes), token.ExpiresAt).
+		Scan(&token.ID, &token.CreatedAt)
+}
+
+func (s *Store) GetPersonalTokens(userID int) ([]*models.PersonalAccessToken, error) {
+	sqlQuery := `
+		SELECT id, user_id, name, scopes, expires_at, last_used_at, created_at
+		FROM personal_access_tokens WHERE user_id = $1 ORDER BY id`
+	rows, err := s.db.Query(sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]*models.PersonalAccessToken, 0)
+	for rows.Next() {
+		token := new(models.PersonalAccessToken)
+		err := rows.Scan(&token.ID, &token.UserID, &token.Name, pq.Array(&token.Scopes),
+			&token.ExpiresAt, &token.LastUsedAt, &token.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (s *Store) DeletePersonalToken(userID, id int) error {
+	res, err := s.db.Exec(`DELETE FROM personal_access_tokens WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// AuthenticatePersonalToken looks up an unexpired token by hash together
+// with its owner, recording when it was used at most once a minute.
+func (s *Store) AuthenticatePersonalToken(tokenHash string) (*models.PersonalTokenAuth, error) {
+	sqlQuery := `
+		UPDATE personal_access_tokens p
+		SET last_used_at = CASE
+			WHEN p.last_used_at IS NULL OR p.last_used_at < now() - interval '1 minute' THEN now()
+			ELSE p.last_used_at END
+		FROM users u
+		WHERE p.token_hash = $1 AND u.id = p.user_id AND (p.expires_at IS NULL OR p.expires_at > now())
+		RETURNING p.user_id, p.scopes, u.role, u.verified_at IS NOT NULL, u.suspended_at IS NOT NULL`
+
+	auth := new(models.PersonalTokenAuth)
+	err := s.db.QueryRow(sqlQuery, tokenHash).
+		Scan(&auth.UserID, pq.Array(&auth.Scopes), &auth.Role, &auth.Verified, &auth.Suspended)
 	if err != nil {
 		return nil, err
 	}
 
-	u := new(models.User)
+	return auth, nil
+}
+
+// GetSessions lists the user's active sessions, most recently used first.
+func (s *Store) GetSessions(userID int) ([]*models.Session, error) {
+	sqlQuery := `
+		SELECT id, user_id, device, user_agent, ip, created_at, last_seen_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > now()
+		ORDER BY last_seen_at DESC, id DESC`
+	rows, err := s.db.Query(sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*models.Session, 0)
 	for rows.Next() {
-		u, err = scanRowsIntoUser(rows)
+		session := new(models.Session)
+		err := rows.Scan(&session.ID, &session.UserID, &session.Device, &session.UserAgent, &session.IP,
+			&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
 		if err != nil {
 			return nil, err
 		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (s *Store) RevokeSession(userID, sessionID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqlQuery := `
+		UPDATE sessions SET revoked_at = now()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > now()
+		RETURNING family_id`
+	familyID := ""
+	if err := tx.QueryRow(sqlQuery, sessionID, userID).Scan(&familyID); err != nil {
+		return err
+	}
+
+	sqlQuery = `UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.Exec(sqlQuery, familyID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) RevokeOtherSessions(userID, keepSessionID int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	n, err := revokeSessions(tx, userID, keepSessionID)
+	if err != nil {
+		return 0, err
 	}
 
-	if u.ID == 0 {
-		return nil, fmt.Errorf("user not found")
+	return n, tx.Commit()
+}
+
+// revokeSessions ends the user's sessions except keepSessionID, which may
+// be 0, and revokes their refresh tokens, returning how many active
+// sessions it ended.
+func revokeSessions(tx *sql.Tx, userID, keepSessionID int) (int, error) {
+	sqlQuery := `
+		UPDATE sessions SET revoked_at = now()
+		WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL AND expires_at > now()`
+	res, err := tx.Exec(sqlQuery, userID, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	sqlQuery = `
+		UPDATE refresh_tokens SET revoked_at = now()
+		WHERE user_id = $1 AND revoked_at IS NULL
+		AND family_id NOT IN (SELECT family_id FROM sessions WHERE id = $2)`
+	if _, err := tx.Exec(sqlQuery, userID, keepSessionID); err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// revokePersonalTokens deletes the user's personal access tokens, which
+// would otherwise outlive a password change.
+func revokePersonalTokens(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec(`DELETE FROM personal_access_tokens WHERE user_id = $1`, userID)
+	return err
+}
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
 	}
 
-	return u, nil
+	return nil
 }
 
 func scanRowsIntoUser(rows *sql.Rows) (*models.User, error) {
@@ -44,6 +467,11 @@ func scanRowsIntoUser(rows *sql.Rows) (*models.User, error) {
 		&user.Username,
 		&user.Password,
 		&user.Role,
+		&user.SuspendedAt,
+		&user.PasswordResetRequired,
+		&user.CreatedAt,
+		&user.VerifiedAt,
+		&user.TwoFactorEnabled,
 	)
 	if err != nil {
 		return nil, err
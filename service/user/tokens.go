@@ -0,0 +1,133 @@
+package user
+
+import (
+	"database/sql"
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator"
+)
+
+func (h *Handler) HandleGetTokens(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := h.tokens.GetPersonalTokens(userID)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "Tokens fetched successfully", tokens)
+}
+
+// HandleCreateToken creates a personal access token limited to the given
+// scopes, each of which the user's role must grant. The token itself is
+// only returned here.
+func (h *Handler) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload models.PersonalTokenPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	payload.Name = strings.TrimSpace(payload.Name)
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, "invalid payload", errors.Error())
+		return
+	}
+
+	role := middlewares.GetRoleFromContext(r.Context())
+	scopes := make([]string, 0, len(payload.Scopes))
+	seen := make(map[string]bool)
+	for _, scope := range payload.Scopes {
+		if !models.HasPermission(role, scope) {
+			utils.ResponseJSON(w, http.StatusBadRequest, models.ErrScopeNotAllowed.Error(), scope)
+			return
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if payload.ExpiresAt != nil && !payload.ExpiresAt.After(time.Now()) {
+		utils.ResponseJSON(w, http.StatusBadRequest, "expires_at must be in the future", false)
+		return
+	}
+
+	secret, err := utils.RandomToken(32)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+	plain := models.PersonalTokenPrefix + secret
+
+	token := &models.PersonalAccessToken{
+		UserID:    userID,
+		Name:      payload.Name,
+		TokenHash: utils.HashToken(plain),
+		Scopes:    scopes,
+		ExpiresAt: payload.ExpiresAt,
+	}
+	if err := h.tokens.CreatePersonalToken(token); err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditTokenCreated,
+		ActorID: userID,
+		UserID:  userID,
+		Target:  "token:" + strconv.Itoa(token.ID),
+		Details: map[string]string{"name": token.Name, "scopes": strings.Join(token.Scopes, " ")},
+	})
+
+	utils.ResponseJSON(w, http.StatusCreated, "Token created, copy it now as it will not be shown again", struct {
+		*models.PersonalAccessToken
+		Token string `json:"token"`
+	}{token, plain})
+}
+
+func (h *Handler) HandleDeleteToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	err = h.tokens.DeletePersonalToken(userID, id)
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusNotFound, "token not found", false)
+		return
+	}
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditTokenRevoked,
+		ActorID: userID,
+		UserID:  userID,
+		Target:  "token:" + strconv.Itoa(id),
+	})
+
+	utils.ResponseJSON(w, http.StatusOK, "delete success", id)
+}
@@ -0,0 +1,221 @@
+package workspace
+
+import (
+	"fmt"
+	"go-note/mailer"
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/utils"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/gorilla/mux"
+)
+
+const DefaultInvitationTTL = 7 * 24 * time.Hour
+
+// SetInvitations sets the page invitation emails link to, which receives
+// the token as its token query parameter, and how long invitations stay
+// valid. Without a URL the email contains the bare token.
+func (h *Handler) SetInvitations(inviteURL string, ttl time.Duration) {
+	h.inviteURL = inviteURL
+	h.inviteTTL = ttl
+}
+
+// HandleCreateInvitation queues an email inviting to join the workspace with
+// a role up to the caller's own. Inviting an email again replaces its
+// pending invitation. Whether the email went out is recorded on the
+// invitation.
+func (h *Handler) HandleCreateInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	var payload models.WorkspaceInvitationPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	payload.Email = strings.TrimSpace(payload.Email)
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return
+	}
+
+	if !models.IsValidWorkspaceRole(payload.Role) {
+		utils.ResponseJSON(w, http.StatusBadRequest, "role must be owner, admin, editor or viewer", false)
+		return
+	}
+
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	invitation := &models.WorkspaceInvitation{
+		WorkspaceID: id,
+		Email:       payload.Email,
+		Role:        payload.Role,
+		TokenHash:   utils.HashToken(token),
+		ExpiresAt:   time.Now().Add(h.inviteTTL),
+	}
+	if err := h.store.CreateInvitation(userID, invitation); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditWorkspaceInvited,
+		ActorID: userID,
+		Target:  workspaceTarget(id),
+		Details: map[string]string{"email": invitation.Email, "role": invitation.Role},
+	})
+
+	msg, err := h.invitationMessage(userID, invitation, token)
+	if err == nil && !h.mailQueue.Go(func() { h.sendInvitation(invitation.TokenHash, msg) }) {
+		err = fmt.Errorf("mail queue full")
+	}
+	if err != nil {
+		log.Println("queueing workspace invitation:", err)
+		h.setDelivery(invitation.TokenHash, models.InvitationFailed)
+		utils.ResponseJSON(w, http.StatusServiceUnavailable, "invitation email could not be queued, invite again later", false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusAccepted, "invitation queued", invitation)
+}
+
+func (h *Handler) HandleGetInvitations(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	invitations, err := h.store.GetInvitations(userID, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", invitations)
+}
+
+func (h *Handler) HandleDeleteInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	invitationID, err := strconv.Atoi(mux.Vars(r)["invitation"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, "invalid invitation", false)
+		return
+	}
+
+	if err := h.store.DeleteInvitation(userID, id, invitationID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "delete success", invitationID)
+}
+
+// HandleAcceptInvitation adds the caller to the workspace of an emailed
+// invitation. The invitation must have been sent to the caller's email.
+func (h *Handler) HandleAcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload models.AcceptInvitationPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return
+	}
+
+	workspace, err := h.store.AcceptInvitation(userID, utils.HashToken(payload.Token))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditWorkspaceJoined,
+		ActorID: userID,
+		UserID:  userID,
+		Target:  workspaceTarget(workspace.ID),
+		Details: map[string]string{"role": workspace.Role},
+	})
+	utils.ResponseJSON(w, http.StatusOK, "joined workspace", workspace)
+}
+
+func (h *Handler) invitationMessage(userID int, invitation *models.WorkspaceInvitation, token string) (*mailer.Message, error) {
+	workspace, err := h.store.GetWorkspace(userID, invitation.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+
+	link := token
+	if h.inviteURL != "" {
+		link = h.inviteURL + "?token=" + url.QueryEscape(token)
+	}
+
+	return &mailer.Message{
+		To:      invitation.Email,
+		Subject: "You're invited to " + workspace.Name,
+		Body: fmt.Sprintf("Hi,\n\nYou have been invited to join the workspace %q as %s. Use the following to accept, "+
+			"signed in with this email address. It expires in %s.\n\n%s\n\n"+
+			"If you don't want to join you can ignore this email.\n", workspace.Name, invitation.Role, h.inviteTTL, link),
+	}, nil
+}
+
+// sendInvitation runs on the mail queue and records how the send went.
+func (h *Handler) sendInvitation(tokenHash string, msg *mailer.Message) {
+	delivery := models.InvitationSent
+	if err := h.mail.Send(msg); err != nil {
+		log.Println("sending workspace invitation:", err)
+		delivery = models.InvitationFailed
+	}
+
+	h.setDelivery(tokenHash, delivery)
+}
+
+func (h *Handler) setDelivery(tokenHash, delivery string) {
+	if err := h.store.SetInvitationDelivery(tokenHash, delivery); err != nil {
+		log.Println("recording workspace invitation delivery:", err)
+	}
+}
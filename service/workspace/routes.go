@@ -0,0 +1,349 @@
+package workspace
+
+import (
+	"go-note/auditlog"
+	"go-note/mailer"
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/utils"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	store     models.WorkspaceStore
+	mail      mailer.Mailer
+	mailQueue *mailer.Queue
+	inviteURL string
+	inviteTTL time.Duration
+	auditLog  auditlog.Recorder
+}
+
+// NewHandler returns a handler that logs invitation emails until SetMailer
+// is called, sends them from its own queue until SetMailQueue is called and
+// logs audit events until SetAuditRecorder is called.
+func NewHandler(store models.WorkspaceStore) *Handler {
+	return &Handler{
+		store:     store,
+		mail:      mailer.NewLogMailer(log.Writer(), ""),
+		mailQueue: mailer.NewQueue(mailer.DefaultQueueSize),
+		inviteTTL: DefaultInvitationTTL,
+		auditLog:  auditlog.NewLogRecorder(log.Writer()),
+	}
+}
+
+func (h *Handler) SetMailer(m mailer.Mailer) {
+	h.mail = m
+}
+
+// SetMailQueue sets the queue invitation emails are sent from.
+func (h *Handler) SetMailQueue(q *mailer.Queue) {
+	h.mailQueue = q
+}
+
+// SetAuditRecorder sets where membership changes are recorded.
+func (h *Handler) SetAuditRecorder(rec auditlog.Recorder) {
+	h.auditLog = rec
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+
+	workspaceRouter := router.PathPrefix("/workspaces").Subrouter()
+	workspaceRouter.Use(middlewares.JWTMiddleware)
+
+	workspaceRouter.Handle("/", middlewares.Permit(models.PermNotesWrite, h.HandleCreateWorkspace)).Methods("POST")
+	workspaceRouter.Handle("/", middlewares.Permit(models.PermNotesRead, h.HandleGetWorkspaces)).Methods("GET")
+	workspaceRouter.Handle("/invitations/accept", middlewares.Permit(models.PermNotesRead, h.HandleAcceptInvitation)).Methods("POST")
+	workspaceRouter.Handle("/{id}", middlewares.Permit(models.PermNotesRead, h.HandleGetWorkspace)).Methods("GET")
+	workspaceRouter.Handle("/{id}", middlewares.Permit(models.PermNotesWrite, h.HandleUpdateWorkspace)).Methods("PUT")
+	workspaceRouter.Handle("/{id}", middlewares.Permit(models.PermNotesWrite, h.HandleDeleteWorkspace)).Methods("DELETE")
+	workspaceRouter.Handle("/{id}/members", middlewares.Permit(models.PermNotesRead, h.HandleGetMembers)).Methods("GET")
+	workspaceRouter.Handle("/{id}/members/{user:[0-9]+}", middlewares.Permit(models.PermNotesWrite, h.HandleUpdateMemberRole)).Methods("PUT")
+	workspaceRouter.Handle("/{id}/members/{user:[0-9]+}", middlewares.Permit(models.PermNotesWrite, h.HandleRemoveMember)).Methods("DELETE")
+	workspaceRouter.Handle("/{id}/members/me", middlewares.Permit(models.PermNotesRead, h.HandleLeaveWorkspace)).Methods("DELETE")
+	workspaceRouter.Handle("/{id}/invitations", middlewares.Permit(models.PermNotesRead, h.HandleGetInvitations)).Methods("GET")
+	workspaceRouter.Handle("/{id}/invitations", middlewares.Permit(models.PermNotesWrite, h.HandleCreateInvitation)).Methods("POST")
+	workspaceRouter.Handle("/{id}/invitations/{invitation:[0-9]+}", middlewares.Permit(models.PermNotesWrite, h.HandleDeleteInvitation)).Methods("DELETE")
+
+}
+
+func (h *Handler) HandleCreateWorkspace(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	payload, ok := parseWorkspacePayload(w, r)
+	if !ok {
+		return
+	}
+
+	workspace, err := h.store.CreateWorkspace(userID, payload)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusCreated, "create success", workspace)
+}
+
+// HandleGetWorkspaces lists the workspaces the caller is a member of with
+// their role in each.
+func (h *Handler) HandleGetWorkspaces(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	workspaces, err := h.store.GetWorkspaces(userID)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", workspaces)
+}
+
+func (h *Handler) HandleGetWorkspace(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	workspace, err := h.store.GetWorkspace(userID, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", workspace)
+}
+
+func (h *Handler) HandleUpdateWorkspace(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	payload, ok := parseWorkspacePayload(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.store.UpdateWorkspace(userID, id, payload); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "update success", id)
+}
+
+// HandleDeleteWorkspace deletes the workspace and all of its notes. Only
+// owners can.
+func (h *Handler) HandleDeleteWorkspace(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := h.store.DeleteWorkspace(userID, id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditWorkspaceDeleted,
+		ActorID: userID,
+		UserID:  userID,
+		Target:  workspaceTarget(id),
+	})
+	utils.ResponseJSON(w, http.StatusOK, "delete success", id)
+}
+
+func (h *Handler) HandleGetMembers(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	members, err := h.store.GetMembers(userID, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	utils.ResponseJSON(w, http.StatusOK, "success", members)
+}
+
+func (h *Handler) HandleUpdateMemberRole(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, memberID, ok := memberVars(w, r)
+	if !ok {
+		return
+	}
+
+	var payload models.WorkspaceRolePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if !models.IsValidWorkspaceRole(payload.Role) {
+		utils.ResponseJSON(w, http.StatusBadRequest, "role must be owner, admin, editor or viewer", false)
+		return
+	}
+
+	if err := h.store.UpdateMemberRole(userID, id, memberID, payload.Role); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditWorkspaceRoleChanged,
+		ActorID: userID,
+		UserID:  memberID,
+		Target:  workspaceTarget(id),
+		Details: map[string]string{"role": payload.Role},
+	})
+	utils.ResponseJSON(w, http.StatusOK, "update success", memberID)
+}
+
+// HandleRemoveMember takes a member out of the workspace, cutting off their
+// access to its notes at once.
+func (h *Handler) HandleRemoveMember(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, memberID, ok := memberVars(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.store.RemoveMember(userID, id, memberID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditWorkspaceMemberRemoved,
+		ActorID: userID,
+		UserID:  memberID,
+		Target:  workspaceTarget(id),
+	})
+	utils.ResponseJSON(w, http.StatusOK, "delete success", memberID)
+}
+
+// HandleLeaveWorkspace takes the user out of the workspace. Unlike removing
+// other members it only needs read access, so read-only users can leave.
+func (h *Handler) HandleLeaveWorkspace(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middlewares.RequireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+
+	if err := h.store.RemoveMember(userID, id, userID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	h.auditLog.Record(r, &models.AuditEvent{
+		Action:  models.AuditWorkspaceMemberRemoved,
+		ActorID: userID,
+		UserID:  userID,
+		Target:  workspaceTarget(id),
+	})
+	utils.ResponseJSON(w, http.StatusOK, "delete success", userID)
+}
+
+func parseWorkspacePayload(w http.ResponseWriter, r *http.Request) (*models.WorkspacePayload, bool) {
+	var payload models.WorkspacePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return nil, false
+	}
+
+	payload.Name = strings.TrimSpace(payload.Name)
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.ResponseJSON(w, http.StatusBadRequest, errors.Error(), false)
+		return nil, false
+	}
+
+	return &payload, true
+}
+
+// memberVars reads the workspace and member IDs from the path.
+func memberVars(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	id, err := utils.GetQueryID(r)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, err.Error(), false)
+		return 0, 0, false
+	}
+
+	memberID, err := strconv.Atoi(mux.Vars(r)["user"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, "invalid user", false)
+		return 0, 0, false
+	}
+
+	return id, memberID, true
+}
+
+func workspaceTarget(id int) string {
+	return "workspace:" + strconv.Itoa(id)
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch err {
+	case models.ErrWorkspaceNotFound, models.ErrMemberNotFound, models.ErrInvitationNotFound:
+		utils.ResponseJSON(w, http.StatusNotFound, err.Error(), false)
+	case models.ErrWorkspaceRole, models.ErrInvitationEmail:
+		utils.ResponseJSON(w, http.StatusForbidden, err.Error(), false)
+	case models.ErrWorkspaceLastOwner, models.ErrAlreadyMember:
+		utils.ResponseJSON(w, http.StatusConflict, err.Error(), false)
+	default:
+		utils.ResponseJSON(w, http.StatusInternalServerError, err.Error(), false)
+	}
+}
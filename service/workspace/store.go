@@ -0,0 +1,473 @@
+package workspace
+
+import (
+	"database/sql"
+	"go-note/models"
+	"strings"
+)
+
+// workspaceColumns reads a workspace joined as w with the caller's
+// membership as m.
+const workspaceColumns = `
+	w.id, w.name, m.role,
+	(SELECT COUNT(*) FROM workspace_members c WHERE c.workspace_id = w.id),
+	w.created_at, w.updated_at`
+
+const invitationColumns = `id, workspace_id, email, role, COALESCE(invited_by, 0), delivery, expires_at, created_at`
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) CreateWorkspace(userID int, payload *models.WorkspacePayload) (*models.Workspace, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	workspace := &models.Workspace{Name: payload.Name, Role: models.WorkspaceOwner, MemberCount: 1}
+	sqlQuery := `INSERT INTO workspaces (name) VALUES ($1) RETURNING id, created_at, updated_at`
+	err = tx.QueryRow(sqlQuery, payload.Name).Scan(&workspace.ID, &workspace.CreatedAt, &workspace.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlQuery = `INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(sqlQuery, workspace.ID, userID, models.WorkspaceOwner); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return workspace, nil
+}
+
+func (s *Store) GetWorkspaces(userID int) ([]*models.Workspace, error) {
+	sqlQuery := `
+		SELECT ` + workspaceColumns + `
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = $1
+		ORDER BY lower(w.name), w.id`
+	rows, err := s.db.Query(sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := make([]*models.Workspace, 0)
+	for rows.Next() {
+		workspace, err := scanRowIntoWorkspace(rows)
+		if err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, workspace)
+	}
+
+	return workspaces, rows.Err()
+}
+
+func (s *Store) GetWorkspace(userID, id int) (*models.Workspace, error) {
+	sqlQuery := `
+		SELECT ` + workspaceColumns + `
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = $1 AND w.id = $2`
+	workspace, err := scanRowIntoWorkspace(s.db.QueryRow(sqlQuery, userID, id))
+	if err == sql.ErrNoRows {
+		return nil, models.ErrWorkspaceNotFound
+	}
+
+	return workspace, err
+}
+
+func (s *Store) UpdateWorkspace(userID, id int, payload *models.WorkspacePayload) error {
+	if _, err := requireRole(s.db, userID, id, models.WorkspaceAdmin); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(`UPDATE workspaces SET name = $1, updated_at = now() WHERE id = $2`, payload.Name, id)
+	return err
+}
+
+// DeleteWorkspace deletes the workspace. Its notes, members and invitations
+// go with it through their foreign keys.
+func (s *Store) DeleteWorkspace(userID, id int) error {
+	if _, err := requireRole(s.db, userID, id, models.WorkspaceOwner); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(`DELETE FROM workspaces WHERE id = $1`, id)
+	return err
+}
+
+func (s *Store) GetMembers(userID, id int) ([]*models.WorkspaceMember, error) {
+	if _, err := requireRole(s.db, userID, id, models.WorkspaceViewer); err != nil {
+		return nil, err
+	}
+
+	sqlQuery := `
+		SELECT m.user_id, u.email, u.username, m.role, m.created_at
+		FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = $1
+		ORDER BY m.created_at, m.user_id`
+	rows, err := s.db.Query(sqlQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]*models.WorkspaceMember, 0)
+	for rows.Next() {
+		member := new(models.WorkspaceMember)
+		if err := rows.Scan(&member.UserID, &member.Email, &member.Username, &member.Role, &member.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+func (s *Store) UpdateMemberRole(userID, id, memberID int, role string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	roles, err := lockMembers(tx, userID, id)
+	if err != nil {
+		return err
+	}
+
+	current, ok := roles[memberID]
+	if !ok {
+		return models.ErrMemberNotFound
+	}
+	if err := canManage(roles[userID], current, role); err != nil {
+		return err
+	}
+	if current == models.WorkspaceOwner && role != models.WorkspaceOwner && countOwners(roles) == 1 {
+		return models.ErrWorkspaceLastOwner
+	}
+
+	sqlQuery := `UPDATE workspace_members SET role = $1 WHERE workspace_id = $2 AND user_id = $3`
+	if _, err := tx.Exec(sqlQuery, role, id, memberID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveMember takes the member out of the workspace. Their access to its
+// notes ends with the commit, as every note query checks membership.
+func (s *Store) RemoveMember(userID, id, memberID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	roles, err := lockMembers(tx, userID, id)
+	if err != nil {
+		return err
+	}
+
+	current, ok := roles[memberID]
+	if !ok {
+		return models.ErrMemberNotFound
+	}
+	if memberID != userID {
+		if err := canManage(roles[userID], current, current); err != nil {
+			return err
+		}
+	}
+	if current == models.WorkspaceOwner && countOwners(roles) == 1 {
+		return models.ErrWorkspaceLastOwner
+	}
+
+	sqlQuery := `DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2`
+	if _, err := tx.Exec(sqlQuery, id, memberID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) CreateInvitation(userID int, invitation *models.WorkspaceInvitation) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	role, err := requireRole(tx, userID, invitation.WorkspaceID, models.WorkspaceAdmin)
+	if err != nil {
+		return err
+	}
+	if !models.WorkspaceRolePermits(role, invitation.Role) {
+		return models.ErrWorkspaceRole
+	}
+
+	member := false
+	sqlQuery := `
+		SELECT EXISTS (
+			SELECT 1 FROM workspace_members m JOIN users u ON u.id = m.user_id
+			WHERE m.workspace_id = $1 AND lower(u.email) = lower($2)
+		)`
+	if err := tx.QueryRow(sqlQuery, invitation.WorkspaceID, invitation.Email).Scan(&member); err != nil {
+		return err
+	}
+	if member {
+		return models.ErrAlreadyMember
+	}
+
+	sqlQuery = `
+		INSERT INTO workspace_invitations (workspace_id, email, role, token_hash, invited_by, expires_at, delivery)
+		VALUES ($1, $2, $3, $4, $5, $6, 'queued')
+		ON CONFLICT (workspace_id, lower(email)) DO UPDATE SET
+			email = EXCLUDED.email, role = EXCLUDED.role, token_hash = EXCLUDED.token_hash,
+			invited_by = EXCLUDED.invited_by, delivery = EXCLUDED.delivery, expires_at = EXCLUDED.expires_at, created_at = now()
+		RETURNING id, delivery, created_at`
+	err = tx.QueryRow(sqlQuery, invitation.WorkspaceID, invitation.Email, invitation.Role, invitation.TokenHash, userID, invitation.ExpiresAt).
+		Scan(&invitation.ID, &invitation.Delivery, &invitation.CreatedAt)
+	if err != nil {
+		return err
+	}
+	invitation.InvitedBy = userID
+
+	return tx.Commit()
+}
+
+// GetInvitations lists the workspace's unexpired invitations, newest first.
+func (s *Store) GetInvitations(userID, id int) ([]*models.WorkspaceInvitation, error) {
+	if _, err := requireRole(s.db, userID, id, models.WorkspaceAdmin); err != nil {
+		return nil, err
+	}
+
+	sqlQuery := `
+		SELECT ` + invitationColumns + ` FROM workspace_invitations
+		WHERE workspace_id = $1 AND expires_at > now()
+		ORDER BY created_at DESC, id DESC`
+	rows, err := s.db.Query(sqlQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := make([]*models.WorkspaceInvitation, 0)
+	for rows.Next() {
+		invitation, err := scanRowIntoInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+
+	return invitations, rows.Err()
+}
+
+func (s *Store) SetInvitationDelivery(tokenHash, delivery string) error {
+	sqlQuery := `UPDATE workspace_invitations SET delivery = $2 WHERE token_hash = $1`
+	_, err := s.db.Exec(sqlQuery, tokenHash, delivery)
+
+	return err
+}
+
+func (s *Store) DeleteInvitation(userID, id, invitationID int) error {
+	if _, err := requireRole(s.db, userID, id, models.WorkspaceAdmin); err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(`DELETE FROM workspace_invitations WHERE id = $1 AND workspace_id = $2`, invitationID, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrInvitationNotFound
+	}
+
+	return nil
+}
+
+// AcceptInvitation keeps the role of users who joined some other way in the
+// meantime.
+func (s *Store) AcceptInvitation(userID int, tokenHash string) (*models.Workspace, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	sqlQuery := `
+		SELECT ` + invitationColumns + ` FROM workspace_invitations
+		WHERE token_hash = $1 AND expires_at > now()
+		FOR UPDATE`
+	invitation, err := scanRowIntoInvitation(tx.QueryRow(sqlQuery, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, models.ErrInvitationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var email string
+	if err := tx.QueryRow(`SELECT email FROM users WHERE id = $1`, userID).Scan(&email); err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(email, invitation.Email) {
+		return nil, models.ErrInvitationEmail
+	}
+
+	sqlQuery = `
+		INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (workspace_id, user_id) DO NOTHING`
+	if _, err := tx.Exec(sqlQuery, invitation.WorkspaceID, userID, invitation.Role); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM workspace_invitations WHERE id = $1`, invitation.ID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.GetWorkspace(userID, invitation.WorkspaceID)
+}
+
+// rowQuerier is what requireRole needs from *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// requireRole returns the role of userID in the workspace. It fails with
+// models.ErrWorkspaceNotFound for non-members and with
+// models.ErrWorkspaceRole when the role is below need.
+func requireRole(q rowQuerier, userID, id int, need string) (string, error) {
+	var role string
+	sqlQuery := `SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2`
+	err := q.QueryRow(sqlQuery, id, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", models.ErrWorkspaceNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !models.WorkspaceRolePermits(role, need) {
+		return role, models.ErrWorkspaceRole
+	}
+
+	return role, nil
+}
+
+// lockMembers locks the members of the workspace for the rest of the
+// transaction, so concurrent changes can't remove its last owner, and
+// returns their roles by user ID. It fails with models.ErrWorkspaceNotFound
+// unless userID is one of them.
+func lockMembers(tx *sql.Tx, userID, id int) (map[int]string, error) {
+	rows, err := tx.Query(`SELECT user_id, role FROM workspace_members WHERE workspace_id = $1 FOR UPDATE`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make(map[int]string)
+	for rows.Next() {
+		var memberID int
+		var role string
+		if err := rows.Scan(&memberID, &role); err != nil {
+			return nil, err
+		}
+		roles[memberID] = role
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := roles[userID]; !ok {
+		return nil, models.ErrWorkspaceNotFound
+	}
+
+	return roles, nil
+}
+
+// canManage fails with models.ErrWorkspaceRole unless a member with role
+// manager may change a member with role from to role to: managers are
+// admins or owners and can't act above their own role.
+func canManage(manager, from, to string) error {
+	if !models.WorkspaceRolePermits(manager, models.WorkspaceAdmin) ||
+		!models.WorkspaceRolePermits(manager, from) ||
+		!models.WorkspaceRolePermits(manager, to) {
+		return models.ErrWorkspaceRole
+	}
+
+	return nil
+}
+
+func countOwners(roles map[int]string) int {
+	owners := 0
+	for _, role := range roles {
+		if role == models.WorkspaceOwner {
+			owners++
+		}
+	}
+
+	return owners
+}
+
+// rowScanner is a *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRowIntoWorkspace(row rowScanner) (*models.Workspace, error) {
+	workspace := new(models.Workspace)
+
+	err := row.Scan(
+		&workspace.ID,
+		&workspace.Name,
+		&workspace.Role,
+		&workspace.MemberCount,
+		&workspace.CreatedAt,
+		&workspace.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return workspace, nil
+}
+
+func scanRowIntoInvitation(row rowScanner) (*models.WorkspaceInvitation, error) {
+	invitation := new(models.WorkspaceInvitation)
+
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.WorkspaceID,
+		&invitation.Email,
+		&invitation.Role,
+		&invitation.InvitedBy,
+		&invitation.Delivery,
+		&invitation.ExpiresAt,
+		&invitation.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
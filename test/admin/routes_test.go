@@ -0,0 +1,347 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/service/admin"
+	"go-note/service/user"
+	"go-note/utils"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAdminServiceHandlers(t *testing.T) {
+	handler := admin.NewHandler()
+
+	newRouter := func() *mux.Router {
+		router := mux.NewRouter()
+		adminRouter := router.PathPrefix("/admin").Subrouter()
+		adminRouter.Use(middlewares.RequireRole(models.RoleAdmin))
+		handler.RegisterRoutes(adminRouter)
+		return router
+	}
+
+	t.Run("should list roles for admins", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/admin/roles", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withRole(req, 1, models.RoleAdmin)
+
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("should forbid members from the admin router", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/admin/roles", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withRole(req, 1, models.RoleMember)
+
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+}
+
+func TestPermit(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	cases := []struct {
+		role       string
+		permission string
+		expected   int
+	}{
+		{models.RoleReadOnly, models.PermNotesRead, http.StatusOK},
+		{models.RoleReadOnly, models.PermNotesWrite, http.StatusForbidden},
+		{models.RoleMember, models.PermNotesWrite, http.StatusOK},
+		{models.RoleMember, models.PermAdmin, http.StatusForbidden},
+		{models.RoleAdmin, models.PermAdmin, http.StatusOK},
+		{"", models.PermNotesRead, http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withRole(req, 1, c.role)
+
+		rr := httptest.NewRecorder()
+		middlewares.Permit(c.permission, ok).ServeHTTP(rr, req)
+
+		if rr.Code != c.expected {
+			t.Errorf("role %q with %s: expected status code %d, got %d", c.role, c.permission, c.expected, rr.Code)
+		}
+	}
+}
+
+func TestAdminUserHandlers(t *testing.T) {
+	store := newMockUserAdminStore()
+	handler := user.NewHandler(store, nil, nil, nil)
+
+	router := mux.NewRouter()
+	adminRouter := router.PathPrefix("/admin").Subrouter()
+	handler.RegisterAdminRoutes(adminRouter)
+
+	serve := func(method, path string, payload interface{}) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		if payload != nil {
+			if err := json.NewEncoder(&body).Encode(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		req, err := http.NewRequest(method, path, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withRole(req, 1, models.RoleAdmin)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should page through users", func(t *testing.T) {
+		rr := serve(http.MethodGet, "/admin/users/?limit=2", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var response struct {
+			Data       []map[string]interface{} `json:"data"`
+			NextCursor string                   `json:"next_cursor"`
+			Total      int                      `json:"total"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Data) != 2 || response.NextCursor != "2" || response.Total != 3 {
+			t.Errorf("unexpected page: %+v", response)
+		}
+		if _, ok := response.Data[0]["password"]; ok {
+			t.Errorf("expected the password hash to be left out")
+		}
+	})
+
+	t.Run("should reject an unknown role filter", func(t *testing.T) {
+		rr := serve(http.MethodGet, "/admin/users/?role=owner", nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should change a user's role", func(t *testing.T) {
+		rr := serve(http.MethodPut, "/admin/users/2/role", models.UserRolePayload{Role: models.RoleReadOnly})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if store.users[2].Role != models.RoleReadOnly {
+			t.Errorf("expected role %q, got %q", models.RoleReadOnly, store.users[2].Role)
+		}
+
+		rr = serve(http.MethodPut, "/admin/users/2/role", models.UserRolePayload{Role: "owner"})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d for an unknown role, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should suspend and unsuspend a user", func(t *testing.T) {
+		rr := serve(http.MethodPost, "/admin/users/2/suspend", nil)
+		if rr.Code != http.StatusOK || store.users[2].SuspendedAt == nil {
+			t.Fatalf("expected user 2 to be suspended, got %d", rr.Code)
+		}
+
+		rr = serve(http.MethodPost, "/admin/users/2/unsuspend", nil)
+		if rr.Code != http.StatusOK || store.users[2].SuspendedAt != nil {
+			t.Errorf("expected user 2 to be unsuspended, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should require a password reset", func(t *testing.T) {
+		rr := serve(http.MethodPost, "/admin/users/3/password-reset", nil)
+		if rr.Code != http.StatusOK || !store.users[3].PasswordResetRequired {
+			t.Errorf("expected user 3 to need a password reset, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should not let admins change their own account", func(t *testing.T) {
+		for _, path := range []string{"/admin/users/1/suspend", "/admin/users/1/password-reset"} {
+			rr := serve(http.MethodPost, path, nil)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status code %d, got %d", path, http.StatusBadRequest, rr.Code)
+			}
+		}
+
+		rr := serve(http.MethodDelete, "/admin/users/1", nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should delete a user", func(t *testing.T) {
+		rr := serve(http.MethodDelete, "/admin/users/3", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		rr = serve(http.MethodGet, "/admin/users/3", nil)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	middlewares.SetPersonalTokenStore(mockPersonalTokenStore{
+		utils.HashToken("gnp_reader"): {UserID: 1, Role: models.RoleAdmin, Verified: true, Scopes: []string{models.PermNotesRead}},
+		utils.HashToken("gnp_admin"):  {UserID: 1, Role: models.RoleAdmin, Verified: true, Scopes: []string{models.PermAdmin}},
+		utils.HashToken("gnp_banned"): {UserID: 2, Role: models.RoleMember, Suspended: true, Scopes: []string{models.PermNotesRead}},
+	})
+	defer middlewares.SetPersonalTokenStore(nil)
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	cases := []struct {
+		name     string
+		token    string
+		handler  http.Handler
+		expected int
+	}{
+		{"read within scope", "gnp_reader", middlewares.Permit(models.PermNotesRead, ok), http.StatusOK},
+		{"write outside scope", "gnp_reader", middlewares.Permit(models.PermNotesWrite, ok), http.StatusForbidden},
+		{"admin router without admin scope", "gnp_reader", middlewares.RequireRole(models.RoleAdmin)(http.HandlerFunc(ok)), http.StatusForbidden},
+		{"admin router with admin scope", "gnp_admin", middlewares.RequireRole(models.RoleAdmin)(http.HandlerFunc(ok)), http.StatusOK},
+		{"account routes", "gnp_admin", middlewares.SessionOnly(http.HandlerFunc(ok)), http.StatusForbidden},
+		{"suspended owner", "gnp_banned", middlewares.Permit(models.PermNotesRead, ok), http.StatusForbidden},
+		{"unknown token", "gnp_unknown", middlewares.Permit(models.PermNotesRead, ok), http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+
+		rr := httptest.NewRecorder()
+		middlewares.JWTMiddleware(c.handler).ServeHTTP(rr, req)
+
+		if rr.Code != c.expected {
+			t.Errorf("%s: expected status code %d, got %d", c.name, c.expected, rr.Code)
+		}
+	}
+}
+
+// mockPersonalTokenStore maps token hashes to what they authenticate as.
+type mockPersonalTokenStore map[string]*models.PersonalTokenAuth
+
+func (m mockPersonalTokenStore) AuthenticatePersonalToken(tokenHash string) (*models.PersonalTokenAuth, error) {
+	auth, ok := m[tokenHash]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return auth, nil
+}
+
+func withRole(req *http.Request, userID int, role string) *http.Request {
+	ctx := context.WithValue(req.Context(), middlewares.UserKey, userID)
+	ctx = context.WithValue(ctx, middlewares.RoleKey, role)
+	return req.WithContext(ctx)
+}
+
+// mockUserAdminStore holds users 1 (the admin), 2 and 3.
+type mockUserAdminStore struct {
+	users map[int]*models.User
+}
+
+func newMockUserAdminStore() *mockUserAdminStore {
+	return &mockUserAdminStore{users: map[int]*models.User{
+		1: {ID: 1, Email: "admin@mail.com", Username: "admin", Password: "hash", Role: models.RoleAdmin},
+		2: {ID: 2, Email: "member@mail.com", Username: "member", Password: "hash", Role: models.RoleMember},
+		3: {ID: 3, Email: "other@mail.com", Username: "other", Password: "hash", Role: models.RoleMember},
+	}}
+}
+
+func (m *mockUserAdminStore) GetUserByID(id int) (*models.User, error) {
+	u, ok := m.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+func (m *mockUserAdminStore) GetUsers(opts *models.UserListOptions) (*models.UserList, error) {
+	list := &models.UserList{Users: make([]*models.User, 0), Total: len(m.users)}
+	for id := opts.After + 1; id <= 3; id++ {
+		u, ok := m.users[id]
+		if !ok {
+			continue
+		}
+		if len(list.Users) == opts.Limit {
+			next := list.Users[len(list.Users)-1].ID
+			list.Next = &next
+			break
+		}
+		list.Users = append(list.Users, u)
+	}
+	return list, nil
+}
+
+func (m *mockUserAdminStore) SetUserRole(id int, role string) error {
+	u, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	u.Role = role
+	return nil
+}
+
+func (m *mockUserAdminStore) SetUserSuspended(id int, suspended bool) error {
+	u, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	u.SuspendedAt = nil
+	if suspended {
+		now := time.Now()
+		u.SuspendedAt = &now
+	}
+	return nil
+}
+
+func (m *mockUserAdminStore) RequirePasswordReset(id int) error {
+	u, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	u.PasswordResetRequired = true
+	return nil
+}
+
+func (m *mockUserAdminStore) DeleteUser(id int) error {
+	if _, ok := m.users[id]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.users, id)
+	return nil
+}
@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/service/audit"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAuditHandlers(t *testing.T) {
+	store := &mockAuditStore{}
+	handler := audit.NewHandler(store)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/me/audit", handler.HandleGetMyAudit).Methods(http.MethodGet)
+	adminRouter := router.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(middlewares.RequireRole(models.RoleAdmin))
+	handler.RegisterAdminRoutes(adminRouter)
+
+	serve := func(path string, userID int, role string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		ctx := context.WithValue(req.Context(), middlewares.UserKey, userID)
+		ctx = context.WithValue(ctx, middlewares.RoleKey, role)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req.WithContext(ctx))
+		return rr
+	}
+
+	t.Run("should only list the user's own account", func(t *testing.T) {
+		rr := serve("/me/audit?user_id=3&action=login.failed", 2, models.RoleMember)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if store.opts.UserID != 2 || store.opts.Action != models.AuditLoginFailed {
+			t.Errorf("expected events of user 2 filtered by action, got %+v", store.opts)
+		}
+
+		var body struct {
+			Data       []*models.AuditEvent `json:"data"`
+			NextCursor string               `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Data) != 1 || body.Data[0].UserID != 2 {
+			t.Errorf("expected the user's event, got %+v", body.Data)
+		}
+	})
+
+	t.Run("should filter the admin listing", func(t *testing.T) {
+		path := "/admin/audit?user_id=3&actor_id=1&ip=10.0.0.1&since=2024-01-01T00:00:00Z&until=2024-02-01T00:00:00Z&limit=10&cursor=99"
+		rr := serve(path, 1, models.RoleAdmin)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		want := models.AuditListOptions{
+			Limit:   10,
+			Before:  99,
+			UserID:  3,
+			ActorID: 1,
+			IP:      "10.0.0.1",
+			Since:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Until:   time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		}
+		if *store.opts != want {
+			t.Errorf("expected options %+v, got %+v", want, *store.opts)
+		}
+	})
+
+	t.Run("should reject invalid filters", func(t *testing.T) {
+		for _, path := range []string{
+			"/admin/audit?user_id=abc",
+			"/admin/audit?since=yesterday",
+			"/admin/audit?limit=1000",
+			"/admin/audit?cursor=x",
+		} {
+			if rr := serve(path, 1, models.RoleAdmin); rr.Code != http.StatusBadRequest {
+				t.Errorf("expected %s to be rejected with %d, got %d", path, http.StatusBadRequest, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should forbid members from the admin listing", func(t *testing.T) {
+		if rr := serve("/admin/audit", 2, models.RoleMember); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+}
+
+// mockAuditStore remembers the options of the last listing and returns one
+// event of the filtered user.
+type mockAuditStore struct {
+	opts *models.AuditListOptions
+}
+
+func (m *mockAuditStore) CreateAuditEvents(events []*models.AuditEvent) error {
+	return nil
+}
+
+func (m *mockAuditStore) GetAuditEvents(opts *models.AuditListOptions) (*models.AuditList, error) {
+	m.opts = opts
+	event := &models.AuditEvent{ID: 1, Action: models.AuditLoginFailed, UserID: opts.UserID, CreatedAt: time.Now()}
+	return &models.AuditList{Events: []*models.AuditEvent{event}, Total: 1}, nil
+}
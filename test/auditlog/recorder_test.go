@@ -0,0 +1,138 @@
+package auditlog
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go-note/auditlog"
+	"go-note/models"
+)
+
+func TestAsyncRecorder(t *testing.T) {
+	t.Run("should store buffered events by close", func(t *testing.T) {
+		writer := &mockWriter{}
+		rec := auditlog.NewAsync(writer, 10, &bytes.Buffer{})
+
+		req := httptest.NewRequest("POST", "/auth/login", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("User-Agent", "test-agent")
+		for i := 0; i < 5; i++ {
+			rec.Record(req, &models.AuditEvent{Action: models.AuditLoginFailed})
+		}
+		rec.Close()
+
+		events := writer.all()
+		if len(events) != 5 {
+			t.Fatalf("expected 5 stored events, got %d", len(events))
+		}
+		for _, e := range events {
+			if e.IP != "10.0.0.1" || e.UserAgent != "test-agent" || e.CreatedAt.IsZero() {
+				t.Errorf("expected the event to be stamped with the request, got %+v", e)
+			}
+		}
+	})
+
+	t.Run("should not block when the buffer is full", func(t *testing.T) {
+		writer := &mockWriter{block: make(chan struct{})}
+		var fallback safeBuffer
+		rec := auditlog.NewAsync(writer, 1, &fallback)
+
+		for i := 0; i < 10; i++ {
+			rec.Record(nil, &models.AuditEvent{Action: models.AuditLoginSucceeded, UserID: i + 1})
+		}
+
+		close(writer.block)
+		rec.Close()
+
+		if stored, logged := len(writer.all()), strings.Count(fallback.String(), "action=login.succeeded"); stored+logged != 10 || logged == 0 {
+			t.Errorf("expected every event to be stored or logged, got %d stored and %d logged", stored, logged)
+		}
+	})
+
+	t.Run("should not lose events recorded while closing", func(t *testing.T) {
+		writer := &mockWriter{}
+		var fallback safeBuffer
+		rec := auditlog.NewAsync(writer, 1000, &fallback)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec.Record(nil, &models.AuditEvent{Action: models.AuditLogout})
+			}()
+		}
+		rec.Close()
+		wg.Wait()
+
+		if stored, logged := len(writer.all()), strings.Count(fallback.String(), "action=logout"); stored+logged != 100 {
+			t.Errorf("expected every event to be stored or logged, got %d stored and %d logged", stored, logged)
+		}
+	})
+
+	t.Run("should log events it fails to store", func(t *testing.T) {
+		writer := &mockWriter{err: errors.New("database is down")}
+		var fallback safeBuffer
+		rec := auditlog.NewAsync(writer, 10, &fallback)
+
+		rec.Record(nil, &models.AuditEvent{Action: models.AuditNoteDeleted, ActorID: 4, UserID: 4, Target: "note:7"})
+		rec.Close()
+
+		out := fallback.String()
+		if !strings.Contains(out, "database is down") || !strings.Contains(out, "action=note.deleted actor=4 user=4 target=note:7") {
+			t.Errorf("expected the failure and the event to be logged, got %q", out)
+		}
+	})
+}
+
+// mockWriter collects stored events, failing with err and waiting on block
+// when they are set.
+type mockWriter struct {
+	mu     sync.Mutex
+	events []*models.AuditEvent
+	err    error
+	block  chan struct{}
+}
+
+func (m *mockWriter) CreateAuditEvents(events []*models.AuditEvent) error {
+	if m.block != nil {
+		<-m.block
+	}
+	if m.err != nil {
+		return m.err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, events...)
+	return nil
+}
+
+func (m *mockWriter) all() []*models.AuditEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.events
+}
+
+// safeBuffer is a bytes.Buffer that can be written from the recorder's
+// goroutine while the test reads it.
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,228 @@
+package note
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"go-note/models"
+	"go-note/oidc"
+	"go-note/oidc/oidctest"
+	"go-note/service/auth"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := oidctest.NewIssuer("go-note")
+	defer issuer.Close()
+
+	userStore := newMockUserStore()
+	identities := newMockIdentityStore(userStore)
+	handler := auth.NewHandler(userStore, newMockTokenStore(), newMockTwoFactorStore(userStore))
+	handler.SetKeySet(newTestKeySet(t))
+	handler.SetIdentityStore(identities)
+
+	config := oidc.Config{Issuer: issuer.URL, ClientID: "go-note", RedirectURL: "http://app.test/auth/oidc/corp/callback"}
+	handler.AddOIDCProvider("corp", oidc.NewProvider(config, issuer.Client()))
+	signup := config
+	signup.RedirectURL = "http://app.test/auth/oidc/open/callback"
+	signup.AllowSignup = true
+	handler.AddOIDCProvider("open", oidc.NewProvider(signup, issuer.Client()))
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	t.Run("should link a verified email to its account", func(t *testing.T) {
+		issuer.SetIdentity(oidc.Identity{Subject: "corp-1", Email: "test@mail.com", EmailVerified: true})
+
+		rr := oidcLogin(t, router, issuer, "corp", nil)
+		login := decodeLogin(t, rr)
+		if rr.Code != http.StatusOK || login.Data.Token == "" || login.Data.RefreshToken == "" {
+			t.Fatalf("expected tokens, got %d %s", rr.Code, rr.Body.String())
+		}
+		if identities.links["corp/corp-1"] != 1 {
+			t.Errorf("expected identity to be linked to user 1, got %v", identities.links)
+		}
+
+		// Later logins go by subject even when the email changes.
+		issuer.SetIdentity(oidc.Identity{Subject: "corp-1", Email: "renamed@mail.com", EmailVerified: true})
+		if rr := oidcLogin(t, router, issuer, "corp", nil); rr.Code != http.StatusOK {
+			t.Errorf("expected linked identity to log in, got %d %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("should link emails regardless of case", func(t *testing.T) {
+		issuer.SetIdentity(oidc.Identity{Subject: "open-1", Email: "Test@Mail.com", EmailVerified: true})
+		accounts := len(userStore.users)
+
+		if rr := oidcLogin(t, router, issuer, "open", nil); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		if identities.links["open/open-1"] != 1 || len(userStore.users) != accounts {
+			t.Errorf("expected the identity to be linked to user 1 without a new account, got %v", identities.links)
+		}
+	})
+
+	t.Run("should refuse emails the provider has not verified", func(t *testing.T) {
+		issuer.SetIdentity(oidc.Identity{Subject: "corp-2", Email: "test@mail.com"})
+
+		if rr := oidcLogin(t, router, issuer, "corp", nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should refuse to link unverified accounts", func(t *testing.T) {
+		userStore.users["unverified@mail.com"] = &models.User{ID: 20, Email: "unverified@mail.com", Role: models.RoleMember}
+		issuer.SetIdentity(oidc.Identity{Subject: "corp-3", Email: "unverified@mail.com", EmailVerified: true})
+
+		if rr := oidcLogin(t, router, issuer, "corp", nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should create accounts only when signups are allowed", func(t *testing.T) {
+		issuer.SetIdentity(oidc.Identity{Subject: "new-1", Email: "sso@mail.com", EmailVerified: true, Name: "SSO User"})
+
+		if rr := oidcLogin(t, router, issuer, "corp", nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		rr := oidcLogin(t, router, issuer, "open", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected signup to succeed, got %d %s", rr.Code, rr.Body.String())
+		}
+		u := userStore.users["sso@mail.com"]
+		if u == nil || u.VerifiedAt == nil || u.Username != "SSO User" {
+			t.Errorf("expected a verified account for sso@mail.com, got %+v", u)
+		}
+	})
+
+	t.Run("should reject a mismatched state", func(t *testing.T) {
+		issuer.SetIdentity(oidc.Identity{Subject: "corp-1", Email: "test@mail.com", EmailVerified: true})
+
+		tamper := func(callback *url.URL) {
+			query := callback.Query()
+			query.Set("state", "forged")
+			callback.RawQuery = query.Encode()
+		}
+		if rr := oidcLogin(t, router, issuer, "corp", tamper); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should 404 unknown providers", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/auth/oidc/nope/login", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+// oidcLogin walks through the login redirect, the fake issuer and the
+// callback, letting tamper change the callback URL before it is followed.
+func oidcLogin(t *testing.T, router http.Handler, issuer *oidctest.Issuer, provider string, tamper func(*url.URL)) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/"+provider+"/login", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the issuer, got %d %s", rr.Code, rr.Body.String())
+	}
+	cookies := rr.Result().Cookies()
+
+	client := issuer.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	res, err := client.Get(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("expected the issuer to redirect back, got %d", res.StatusCode)
+	}
+
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		tamper(callback)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func decodeLogin(t *testing.T, rr *httptest.ResponseRecorder) tokenResponse {
+	t.Helper()
+
+	var response tokenResponse
+	response.code = rr.Code
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	return response
+}
+
+// mockIdentityStore links identities, keyed "provider/subject", to users of
+// a mockUserStore.
+type mockIdentityStore struct {
+	users *mockUserStore
+	links map[string]int
+}
+
+func newMockIdentityStore(users *mockUserStore) *mockIdentityStore {
+	return &mockIdentityStore{users: users, links: make(map[string]int)}
+}
+
+func (m *mockIdentityStore) GetUserByIdentity(provider, subject string) (*models.User, error) {
+	id, ok := m.links[provider+"/"+subject]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return m.users.GetUserByID(id)
+}
+
+func (m *mockIdentityStore) LinkIdentity(userID int, identity *models.ExternalIdentity) error {
+	m.links[identity.Provider+"/"+identity.Subject] = userID
+	return nil
+}
+
+func (m *mockIdentityStore) CreateUserWithIdentity(user *models.UserRegisterPayload, identity *models.ExternalIdentity) (*models.User, error) {
+	if _, err := m.users.GetUserByEmail(user.Email); err == nil {
+		return nil, models.ErrEmailExists
+	}
+
+	now := time.Now()
+	u := &models.User{
+		ID:         100 + len(m.users.users),
+		Email:      user.Email,
+		Username:   user.Username,
+		Password:   user.Password,
+		Role:       models.RoleMember,
+		VerifiedAt: &now,
+	}
+	m.users.users[user.Email] = u
+	m.links[identity.Provider+"/"+identity.Subject] = u.ID
+
+	return u, nil
+}
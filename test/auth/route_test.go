@@ -2,20 +2,36 @@ package note
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"go-note/jwtkeys"
+	"go-note/limiter"
+	"go-note/mailer"
+	"go-note/middlewares"
 	"go-note/models"
 	"go-note/service/auth"
+	"go-note/utils"
 
 	"github.com/gorilla/mux"
 )
 
 func TestAuthServiceHandlers(t *testing.T) {
-	userStore := &mockUserStore{}
-	handler := auth.NewHandler(userStore)
+	userStore := newMockUserStore()
+	tokenStore := newMockTokenStore()
+	twoFactorStore := newMockTwoFactorStore(userStore)
+	keys := newTestKeySet(t)
+	handler := auth.NewHandler(userStore, tokenStore, twoFactorStore)
+	handler.SetKeySet(keys)
+	middlewares.SetKeySet(keys)
+	defer middlewares.SetKeySet(nil)
 
 	t.Run("should fail register a user if the payload is missing", func(t *testing.T) {
 		req, err := http.NewRequest(http.MethodPost, "/auth/register", nil)
@@ -64,6 +80,29 @@ func TestAuthServiceHandlers(t *testing.T) {
 		}
 	})
 
+	t.Run("should refuse registering an email that differs only by case", func(t *testing.T) {
+		marshalled, err := json.Marshal(models.UserRegisterPayload{Email: "TESTXX@mail.com", Username: "test", Password: "123456"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/auth/register", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/auth/register", handler.HandleRegister).Methods(http.MethodPost)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
 	t.Run("should fail login a user if the payload is missing", func(t *testing.T) {
 		req, err := http.NewRequest(http.MethodPost, "/auth/login", nil)
 		if err != nil {
@@ -105,23 +144,872 @@ func TestAuthServiceHandlers(t *testing.T) {
 
 		router.ServeHTTP(rr, req)
 
-		if rr.Code != http.StatusCreated {
-			t.Errorf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("should rotate refresh tokens and detect reuse", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/auth/login", handler.HandleLogin).Methods(http.MethodPost)
+		router.HandleFunc("/auth/refresh", handler.HandleRefresh).Methods(http.MethodPost)
+
+		login := postJSON(t, router, "/auth/login", models.UserLoginPayload{Email: "test@mail.com", Password: "123456"})
+		if login.code != http.StatusOK || login.Data.RefreshToken == "" || login.Data.Token == "" {
+			t.Fatalf("login failed: %d %+v", login.code, login.Data)
+		}
+
+		first := postJSON(t, router, "/auth/refresh", models.RefreshPayload{RefreshToken: login.Data.RefreshToken})
+		if first.code != http.StatusOK || first.Data.RefreshToken == login.Data.RefreshToken {
+			t.Fatalf("expected a rotated refresh token, got %d %+v", first.code, first.Data)
+		}
+
+		reused := postJSON(t, router, "/auth/refresh", models.RefreshPayload{RefreshToken: login.Data.RefreshToken})
+		if reused.code != http.StatusUnauthorized {
+			t.Errorf("expected reuse to be rejected with %d, got %d", http.StatusUnauthorized, reused.code)
+		}
+
+		revoked := postJSON(t, router, "/auth/refresh", models.RefreshPayload{RefreshToken: first.Data.RefreshToken})
+		if revoked.code != http.StatusUnauthorized {
+			t.Errorf("expected the family to be revoked after reuse, got %d", revoked.code)
+		}
+	})
+
+	t.Run("should revoke tokens on logout", func(t *testing.T) {
+		router := mux.NewRouter()
+		handler.RegisterRoutes(router)
+
+		middlewares.SetRevocationStore(tokenStore)
+		defer middlewares.SetRevocationStore(nil)
+
+		login := postJSON(t, router, "/auth/login", models.UserLoginPayload{Email: "test@mail.com", Password: "123456"})
+		if login.code != http.StatusOK {
+			t.Fatalf("login failed: %d", login.code)
+		}
+
+		protected := middlewares.JWTMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		authorized := func() int {
+			req := httptest.NewRequest(http.MethodGet, "/notes", nil)
+			req.Header.Set("Authorization", "Bearer "+login.Data.Token)
+			rr := httptest.NewRecorder()
+			protected.ServeHTTP(rr, req)
+			return rr.Code
+		}
+
+		if code := authorized(); code != http.StatusOK {
+			t.Fatalf("expected the access token to work before logout, got %d", code)
+		}
+
+		marshalled, err := json.Marshal(models.LogoutPayload{RefreshToken: login.Data.RefreshToken})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/auth/logout", bytes.NewBuffer(marshalled))
+		req.Header.Set("Authorization", "Bearer "+login.Data.Token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected logout to succeed, got %d", rr.Code)
+		}
+
+		if code := authorized(); code != http.StatusUnauthorized {
+			t.Errorf("expected the access token to be revoked, got %d", code)
+		}
+
+		refresh := postJSON(t, router, "/auth/refresh", models.RefreshPayload{RefreshToken: login.Data.RefreshToken})
+		if refresh.code != http.StatusUnauthorized {
+			t.Errorf("expected the refresh token to be revoked, got %d", refresh.code)
+		}
+	})
+
+	t.Run("should mail single-use password reset tokens", func(t *testing.T) {
+		mail := &mockMailer{}
+		queue := mailer.NewQueue(mailer.DefaultQueueSize)
+		handler.SetMailer(mail)
+		handler.SetMailQueue(queue)
+		handler.SetPasswordReset("http://localhost/reset", time.Hour)
+
+		router := mux.NewRouter()
+		handler.RegisterRoutes(router)
+
+		unknown := serveJSON(t, router, "/auth/forgot-password", models.ForgotPasswordPayload{Email: "nobody@mail.com"})
+		known := serveJSON(t, router, "/auth/forgot-password", models.ForgotPasswordPayload{Email: "test@mail.com"})
+		if unknown.Code != http.StatusOK || known.Code != http.StatusOK || unknown.Body.String() != known.Body.String() {
+			t.Fatalf("expected identical responses, got %d %s and %d %s", unknown.Code, unknown.Body, known.Code, known.Body)
+		}
+
+		queue.Close()
+
+		if len(mail.sent) != 1 || mail.sent[0].To != "test@mail.com" {
+			t.Fatalf("expected one email to test@mail.com, got %+v", mail.sent)
+		}
+		_, link, found := strings.Cut(mail.sent[0].Body, "http://localhost/reset?token=")
+		if !found {
+			t.Fatalf("expected a reset link in %q", mail.sent[0].Body)
+		}
+		token := strings.Fields(link)[0]
+
+		reset := serveJSON(t, router, "/auth/reset-password", models.ResetPasswordPayload{Token: token, Password: "654321"})
+		if reset.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, reset.Code)
+		}
+		if !utils.ComparePasswords(tokenStore.passwords[1], []byte("654321")) {
+			t.Errorf("expected the new password to be stored")
+		}
+
+		reused := serveJSON(t, router, "/auth/reset-password", models.ResetPasswordPayload{Token: token, Password: "abcdef"})
+		if reused.Code != http.StatusBadRequest {
+			t.Errorf("expected a used token to be rejected with %d, got %d", http.StatusBadRequest, reused.Code)
+		}
+	})
+
+	t.Run("should verify emails of registered users", func(t *testing.T) {
+		mail := &mockMailer{}
+		handler.SetMailer(mail)
+		handler.SetEmailVerification(models.VerifyPolicyLogin, "http://localhost/verify", time.Hour)
+		defer handler.SetEmailVerification(models.VerifyPolicyNotes, "", auth.DefaultVerificationTTL)
+
+		router := mux.NewRouter()
+		handler.RegisterRoutes(router)
+
+		register := serveJSON(t, router, "/auth/register", models.UserRegisterPayload{Email: "new@mail.com", Username: "new", Password: "123456"})
+		if register.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, register.Code)
+		}
+
+		login := postJSON(t, router, "/auth/login", models.UserLoginPayload{Email: "new@mail.com", Password: "123456"})
+		if login.code != http.StatusForbidden {
+			t.Errorf("expected unverified login to be rejected with %d, got %d", http.StatusForbidden, login.code)
+		}
+
+		if len(mail.sent) != 1 || mail.sent[0].To != "new@mail.com" {
+			t.Fatalf("expected one email to new@mail.com, got %+v", mail.sent)
+		}
+		_, link, found := strings.Cut(mail.sent[0].Body, "http://localhost/verify?token=")
+		if !found {
+			t.Fatalf("expected a verification link in %q", mail.sent[0].Body)
+		}
+		token := strings.Fields(link)[0]
+
+		forged := serveJSON(t, router, "/auth/verify", models.VerifyEmailPayload{Token: login.Data.Token + "x"})
+		if forged.Code != http.StatusBadRequest {
+			t.Errorf("expected an invalid token to be rejected with %d, got %d", http.StatusBadRequest, forged.Code)
+		}
+
+		verify := serveJSON(t, router, "/auth/verify", models.VerifyEmailPayload{Token: token})
+		if verify.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, verify.Code)
+		}
+
+		login = postJSON(t, router, "/auth/login", models.UserLoginPayload{Email: "new@mail.com", Password: "123456"})
+		if login.code != http.StatusOK {
+			t.Errorf("expected verified login to succeed, got %d", login.code)
+		}
+
+		queue := mailer.NewQueue(mailer.DefaultQueueSize)
+		handler.SetMailQueue(queue)
+		resend := serveJSON(t, router, "/auth/verify/resend", models.ResendVerificationPayload{Email: "new@mail.com"})
+		queue.Close()
+		if resend.Code != http.StatusOK || len(mail.sent) != 1 {
+			t.Errorf("expected no email for a verified account, got %d and %d emails", resend.Code, len(mail.sent))
 		}
 	})
 
+	t.Run("should log in with two-factor authentication", func(t *testing.T) {
+		router := mux.NewRouter()
+		handler.RegisterRoutes(router)
+
+		login := postJSON(t, router, "/auth/login", models.UserLoginPayload{Email: "2fa@mail.com", Password: "123456"})
+		if login.code != http.StatusOK || login.Data.Token == "" {
+			t.Fatalf("login failed: %d", login.code)
+		}
+
+		authorized := func(path string, payload interface{}) (int, map[string]interface{}) {
+			marshalled, err := json.Marshal(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(marshalled))
+			req.Header.Set("Authorization", "Bearer "+login.Data.Token)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			var response struct {
+				Data map[string]interface{} `json:"data"`
+			}
+			json.NewDecoder(rr.Body).Decode(&response)
+			return rr.Code, response.Data
+		}
+
+		code, enrol := authorized("/auth/2fa/enroll", nil)
+		secret, _ := enrol["secret"].(string)
+		uri, _ := enrol["otpauth_uri"].(string)
+		if code != http.StatusOK || secret == "" || !strings.HasPrefix(uri, "otpauth://totp/") {
+			t.Fatalf("enrolment failed: %d %v", code, enrol)
+		}
+
+		if code, _ := authorized("/auth/2fa/confirm", models.TwoFactorCodePayload{Code: "000000"}); code != http.StatusUnauthorized {
+			t.Errorf("expected a wrong code to be rejected with %d, got %d", http.StatusUnauthorized, code)
+		}
+
+		step := time.Now().Unix() / utils.TOTPPeriod
+		totp, err := utils.TOTPCode(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, confirmed := authorized("/auth/2fa/confirm", models.TwoFactorCodePayload{Code: totp})
+		recovery, _ := confirmed["recovery_codes"].([]interface{})
+		if code != http.StatusOK || len(recovery) != 10 {
+			t.Fatalf("confirmation failed: %d %v", code, confirmed)
+		}
+
+		var challenge struct {
+			Data struct {
+				Required       bool   `json:"two_factor_required"`
+				ChallengeToken string `json:"challenge_token"`
+			} `json:"data"`
+		}
+		rr := serveJSON(t, router, "/auth/login", models.UserLoginPayload{Email: "2fa@mail.com", Password: "123456"})
+		json.NewDecoder(rr.Body).Decode(&challenge)
+		if rr.Code != http.StatusOK || !challenge.Data.Required || challenge.Data.ChallengeToken == "" {
+			t.Fatalf("expected a challenge, got %d %+v", rr.Code, challenge.Data)
+		}
+
+		replayed := postJSON(t, router, "/auth/2fa/login", models.TwoFactorLoginPayload{ChallengeToken: challenge.Data.ChallengeToken, Code: totp})
+		if replayed.code != http.StatusUnauthorized {
+			t.Errorf("expected a used code to be rejected with %d, got %d", http.StatusUnauthorized, replayed.code)
+		}
+
+		forged := postJSON(t, router, "/auth/2fa/login", models.TwoFactorLoginPayload{ChallengeToken: login.Data.Token, RecoveryCode: recovery[0].(string)})
+		if forged.code != http.StatusUnauthorized {
+			t.Errorf("expected an access token to be refused as a challenge, got %d", forged.code)
+		}
+
+		protected := middlewares.JWTMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		req := httptest.NewRequest(http.MethodGet, "/notes", nil)
+		req.Header.Set("Authorization", "Bearer "+challenge.Data.ChallengeToken)
+		rr = httptest.NewRecorder()
+		protected.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected a challenge to be refused as an access token, got %d", rr.Code)
+		}
+
+		second := postJSON(t, router, "/auth/2fa/login", models.TwoFactorLoginPayload{ChallengeToken: challenge.Data.ChallengeToken, RecoveryCode: strings.ToUpper(recovery[0].(string))})
+		if second.code != http.StatusOK || second.Data.Token == "" {
+			t.Fatalf("expected a recovery code to complete the login, got %d", second.code)
+		}
+
+		reused := postJSON(t, router, "/auth/2fa/login", models.TwoFactorLoginPayload{ChallengeToken: challenge.Data.ChallengeToken, RecoveryCode: recovery[0].(string)})
+		if reused.code != http.StatusUnauthorized {
+			t.Errorf("expected a used recovery code to be rejected with %d, got %d", http.StatusUnauthorized, reused.code)
+		}
+
+		if code, _ := authorized("/auth/2fa/disable", models.TwoFactorDisablePayload{}); code != http.StatusUnauthorized {
+			t.Errorf("expected disabling without a code to be rejected with %d, got %d", http.StatusUnauthorized, code)
+		}
+
+		next, err := utils.TOTPCode(secret, step+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, _ := authorized("/auth/2fa/disable", models.TwoFactorDisablePayload{Code: next}); code != http.StatusOK {
+			t.Errorf("expected disabling with a code to succeed, got %d", code)
+		}
+		if userStore.users["2fa@mail.com"].TwoFactorEnabled {
+			t.Errorf("expected two-factor authentication to be disabled")
+		}
+	})
+
+	t.Run("should publish the verification keys", func(t *testing.T) {
+		router := mux.NewRouter()
+		handler.RegisterWellKnownRoutes(router)
+
+		req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		var set jwtkeys.JWKS
+		if err := json.NewDecoder(rr.Body).Decode(&set); err != nil {
+			t.Fatal(err)
+		}
+		if rr.Code != http.StatusOK || len(set.Keys) != 1 || set.Keys[0].Kid != keys.JWKS().Keys[0].Kid {
+			t.Errorf("expected the signing key, got %d %+v", rr.Code, set.Keys)
+		}
+	})
+
+	t.Run("should reject blocked accounts on login", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/auth/login", handler.HandleLogin).Methods(http.MethodPost)
+
+		for _, email := range []string{"suspended@mail.com", "reset@mail.com"} {
+			login := postJSON(t, router, "/auth/login", models.UserLoginPayload{Email: email, Password: "123456"})
+			if login.code != http.StatusForbidden {
+				t.Errorf("expected login of %s to be rejected with %d, got %d", email, http.StatusForbidden, login.code)
+			}
+		}
+	})
+
+	t.Run("should lock out repeated failed logins", func(t *testing.T) {
+		policy := limiter.Policy{Threshold: 3, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+		lockoutHandler := auth.NewHandler(userStore, tokenStore, twoFactorStore)
+		lockoutHandler.SetLoginLimiters(limiter.NewMemory(policy), limiter.NewMemory(limiter.DefaultIPPolicy))
+
+		router := mux.NewRouter()
+		router.HandleFunc("/auth/login", lockoutHandler.HandleLogin).Methods(http.MethodPost)
+
+		for i := 0; i < policy.Threshold; i++ {
+			rr := serveJSON(t, router, "/auth/login", models.UserLoginPayload{Email: "test@mail.com", Password: "wrong-password"})
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("expected failed login %d to be rejected with %d, got %d", i+1, http.StatusBadRequest, rr.Code)
+			}
+		}
+
+		rr := serveJSON(t, router, "/auth/login", models.UserLoginPayload{Email: "TEST@mail.com", Password: "123456"})
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+		if retry := rr.Header().Get("Retry-After"); retry != "60" {
+			t.Errorf("expected Retry-After 60, got %q", retry)
+		}
+	})
+
+	t.Run("should lock out an IP address guessing many accounts", func(t *testing.T) {
+		policy := limiter.Policy{Threshold: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+		lockoutHandler := auth.NewHandler(userStore, tokenStore, twoFactorStore)
+		lockoutHandler.SetLoginLimiters(limiter.NewMemory(limiter.DefaultAccountPolicy), limiter.NewMemory(policy))
+		lockoutHandler.SetKeySet(keys)
+
+		router := mux.NewRouter()
+		router.HandleFunc("/auth/login", lockoutHandler.HandleLogin).Methods(http.MethodPost)
+
+		login := func(email, password, ip string) *httptest.ResponseRecorder {
+			body, _ := json.Marshal(models.UserLoginPayload{Email: email, Password: password})
+			req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(body))
+			req.RemoteAddr = ip + ":4321"
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			return rr
+		}
+
+		login("nobody@mail.com", "123456", "10.0.0.1")
+		login("someone@mail.com", "123456", "10.0.0.1")
+
+		if rr := login("test@mail.com", "123456", "10.0.0.1"); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+		if rr := login("test@mail.com", "123456", "10.0.0.2"); rr.Code != http.StatusOK {
+			t.Errorf("expected login from another address to succeed, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should audit logins and lockouts", func(t *testing.T) {
+		policy := limiter.Policy{Threshold: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+		recorder := &mockAuditRecorder{}
+		auditHandler := auth.NewHandler(userStore, tokenStore, twoFactorStore)
+		auditHandler.SetLoginLimiters(limiter.NewMemory(policy), limiter.NewMemory(limiter.DefaultIPPolicy))
+		auditHandler.SetKeySet(keys)
+		auditHandler.SetAuditRecorder(recorder)
+
+		router := mux.NewRouter()
+		router.HandleFunc("/auth/login", auditHandler.HandleLogin).Methods(http.MethodPost)
+
+		login := func(email, password string) {
+			body, _ := json.Marshal(models.UserLoginPayload{Email: email, Password: password})
+			req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(body))
+			req.RemoteAddr = "10.0.1.1:4321"
+			req.Header.Set("User-Agent", "audit-test")
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		login("test@mail.com", "123456")
+		login("nobody@mail.com", "123456")
+		login("nobody@mail.com", "123456")
+
+		want := []string{models.AuditLoginSucceeded, models.AuditLoginFailed, models.AuditLoginFailed, models.AuditLoginLockedOut}
+		if len(recorder.events) != len(want) {
+			t.Fatalf("expected %d audit events, got %d", len(want), len(recorder.events))
+		}
+		for i, e := range recorder.events {
+			if e.Action != want[i] {
+				t.Errorf("expected event %d to be %s, got %s", i, want[i], e.Action)
+			}
+			if e.IP != "10.0.1.1" || e.UserAgent != "audit-test" {
+				t.Errorf("expected the client of the request, got %q %q", e.IP, e.UserAgent)
+			}
+		}
+
+		success := recorder.events[0]
+		if success.ActorID != 1 || success.UserID != 1 || !strings.HasPrefix(success.Target, "session:") {
+			t.Errorf("expected a login of user 1 into a session, got %+v", success)
+		}
+		if failure := recorder.events[1]; failure.UserID != 0 || failure.Details["email"] != "nobody@mail.com" {
+			t.Errorf("expected a failed login for an unknown email, got %+v", failure)
+		}
+	})
+
+	t.Run("should audit refreshes and refresh token reuse", func(t *testing.T) {
+		recorder := &mockAuditRecorder{}
+		auditHandler := auth.NewHandler(userStore, tokenStore, twoFactorStore)
+		auditHandler.SetKeySet(keys)
+		auditHandler.SetAuditRecorder(recorder)
+
+		router := mux.NewRouter()
+		router.HandleFunc("/auth/login", auditHandler.HandleLogin).Methods(http.MethodPost)
+		router.HandleFunc("/auth/refresh", auditHandler.HandleRefresh).Methods(http.MethodPost)
+
+		login := postJSON(t, router, "/auth/login", models.UserLoginPayload{Email: "test@mail.com", Password: "123456"})
+		if login.code != http.StatusOK {
+			t.Fatalf("login failed: %d", login.code)
+		}
+		refresh := postJSON(t, router, "/auth/refresh", models.RefreshPayload{RefreshToken: login.Data.RefreshToken})
+		reuse := postJSON(t, router, "/auth/refresh", models.RefreshPayload{RefreshToken: login.Data.RefreshToken})
+		if refresh.code != http.StatusOK || reuse.code != http.StatusUnauthorized {
+			t.Fatalf("expected the refresh to succeed and its reuse to fail, got %d %d", refresh.code, reuse.code)
+		}
+
+		want := []string{models.AuditLoginSucceeded, models.AuditSessionRefreshed, models.AuditRefreshReused}
+		if len(recorder.events) != len(want) {
+			t.Fatalf("expected %d audit events, got %d", len(want), len(recorder.events))
+		}
+		for i, e := range recorder.events {
+			if e.Action != want[i] || e.UserID != 1 {
+				t.Errorf("expected event %d to be %s of user 1, got %+v", i, want[i], e)
+			}
+		}
+		if recorder.events[1].Target != recorder.events[0].Target {
+			t.Errorf("expected the refresh to keep session %s, got %s", recorder.events[0].Target, recorder.events[1].Target)
+		}
+	})
+
+	t.Run("should reject access tokens of ended sessions", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/auth/login", handler.HandleLogin).Methods(http.MethodPost)
+		router.HandleFunc("/auth/refresh", handler.HandleRefresh).Methods(http.MethodPost)
+
+		middlewares.SetRevocationStore(tokenStore)
+		defer middlewares.SetRevocationStore(nil)
+
+		body, _ := json.Marshal(models.UserLoginPayload{Email: "test@mail.com", Password: "123456"})
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(body))
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0")
+		req.RemoteAddr = "10.0.0.5:1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		var laptop tokenResponse
+		json.NewDecoder(rr.Body).Decode(&laptop)
+		phone := postJSON(t, router, "/auth/login", models.UserLoginPayload{Email: "test@mail.com", Password: "123456"})
+		if rr.Code != http.StatusOK || phone.code != http.StatusOK {
+			t.Fatalf("login failed: %d %d", rr.Code, phone.code)
+		}
+
+		var session *models.Session
+		for _, s := range tokenStore.sessions {
+			if s.IP == "10.0.0.5" {
+				session = s
+			}
+		}
+		if session == nil || session.Device != "Firefox on Linux" || session.UserID != 1 {
+			t.Fatalf("expected a Firefox on Linux session, got %+v", session)
+		}
+
+		if err := tokenStore.RevokeSession(1, session.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		protected := middlewares.JWTMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		for token, expected := range map[string]int{laptop.Data.Token: http.StatusUnauthorized, phone.Data.Token: http.StatusOK} {
+			req := httptest.NewRequest(http.MethodGet, "/notes", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			protected.ServeHTTP(rr, req)
+
+			if rr.Code != expected {
+				t.Errorf("expected status code %d, got %d", expected, rr.Code)
+			}
+		}
+
+		refresh := postJSON(t, router, "/auth/refresh", models.RefreshPayload{RefreshToken: laptop.Data.RefreshToken})
+		if refresh.code != http.StatusUnauthorized {
+			t.Errorf("expected the refresh token of an ended session to be refused with %d, got %d", http.StatusUnauthorized, refresh.code)
+		}
+	})
+
+	t.Run("should reject access tokens of suspended users", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/auth/login", handler.HandleLogin).Methods(http.MethodPost)
+
+		middlewares.SetRevocationStore(tokenStore)
+		defer middlewares.SetRevocationStore(nil)
+
+		login := postJSON(t, router, "/auth/login", models.UserLoginPayload{Email: "test@mail.com", Password: "123456"})
+		if login.code != http.StatusOK {
+			t.Fatalf("login failed: %d", login.code)
+		}
+
+		tokenStore.suspended[1] = true
+		defer delete(tokenStore.suspended, 1)
+
+		protected := middlewares.JWTMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		req := httptest.NewRequest(http.MethodGet, "/notes", nil)
+		req.Header.Set("Authorization", "Bearer "+login.Data.Token)
+		rr := httptest.NewRecorder()
+		protected.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+}
+
+func newTestKeySet(t *testing.T) *jwtkeys.KeySet {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := jwtkeys.New("go-note", "go-note-api", private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
 }
 
-type mockUserStore struct{}
+type tokenResponse struct {
+	code int
+	Data struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	} `json:"data"`
+}
+
+func serveJSON(t *testing.T, router http.Handler, path string, payload interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	marshalled, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, path, bytes.NewBuffer(marshalled))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func postJSON(t *testing.T, router http.Handler, path string, payload interface{}) tokenResponse {
+	t.Helper()
+
+	rr := serveJSON(t, router, path, payload)
+
+	var response tokenResponse
+	response.code = rr.Code
+	json.NewDecoder(rr.Body).Decode(&response)
+
+	return response
+}
+
+// mockUserStore knows the verified test@mail.com with password 123456, and
+// suspended@mail.com and reset@mail.com with the same password whose
+// accounts are blocked by an admin, and 2fa@mail.com for two-factor tests.
+// Registered users start unverified.
+type mockUserStore struct {
+	users map[string]*models.User
+}
+
+func newMockUserStore() *mockUserStore {
+	hashed, err := utils.HashPassword("123456")
+	if err != nil {
+		panic(err)
+	}
+
+	now := time.Now()
+	return &mockUserStore{users: map[string]*models.User{
+		"2fa@mail.com":       {ID: 10, Email: "2fa@mail.com", Username: "2fa", Password: hashed, Role: models.RoleMember, VerifiedAt: &now},
+		"test@mail.com":      {ID: 1, Email: "test@mail.com", Username: "test", Password: hashed, Role: models.RoleMember, VerifiedAt: &now},
+		"suspended@mail.com": {ID: 2, Email: "suspended@mail.com", Username: "suspended", Password: hashed, Role: models.RoleMember, SuspendedAt: &now},
+		"reset@mail.com":     {ID: 3, Email: "reset@mail.com", Username: "reset", Password: hashed, Role: models.RoleMember, PasswordResetRequired: true},
+	}}
+}
 
 func (m *mockUserStore) CreateUser(user *models.UserRegisterPayload) error {
+	m.users[user.Email] = &models.User{
+		ID:       len(m.users) + 1,
+		Email:    user.Email,
+		Username: user.Username,
+		Password: user.Password,
+		Role:     models.RoleMember,
+	}
 	return nil
 }
 
 func (m *mockUserStore) GetUserByEmail(email string) (*models.User, error) {
-	return &models.User{}, nil
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("user not found")
 }
 
 func (m *mockUserStore) GetUserByID(id int) (*models.User, error) {
-	return &models.User{}, nil
+	for _, u := range m.users {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("user not found")
+}
+
+func (m *mockUserStore) MarkEmailVerified(id int, email string) error {
+	u, err := m.GetUserByID(id)
+	if err != nil || u.Email != email {
+		return models.ErrVerificationInvalid
+	}
+	if u.VerifiedAt == nil {
+		now := time.Now()
+		u.VerifiedAt = &now
+	}
+	return nil
+}
+
+type mockRefreshToken struct {
+	models.RefreshToken
+	used    bool
+	revoked bool
+}
+
+// mockTokenStore mirrors the rotation and reuse rules of auth.Store in
+// memory.
+type mockTokenStore struct {
+	refresh map[string]*mockRefreshToken
+	revoked map[string]bool
+	// suspended lists users suspended after they logged in.
+	suspended map[int]bool
+	resets    map[string]*mockResetToken
+	// passwords records the hashes set through password resets.
+	passwords map[int]string
+	// sessions maps session IDs to whether they are still active.
+	sessions map[int]*models.Session
+	ended    map[int]bool
+}
+
+type mockResetToken struct {
+	models.PasswordResetToken
+	used bool
+}
+
+func newMockTokenStore() *mockTokenStore {
+	return &mockTokenStore{
+		refresh:   make(map[string]*mockRefreshToken),
+		revoked:   make(map[string]bool),
+		suspended: make(map[int]bool),
+		resets:    make(map[string]*mockResetToken),
+		passwords: make(map[int]string),
+		sessions:  make(map[int]*models.Session),
+		ended:     make(map[int]bool),
+	}
+}
+
+func (m *mockTokenStore) CreateSession(session *models.Session) error {
+	session.ID = len(m.sessions) + 1
+	m.sessions[session.ID] = session
+	return nil
+}
+
+func (m *mockTokenStore) RevokeSession(userID, sessionID int) error {
+	session, ok := m.sessions[sessionID]
+	if !ok || session.UserID != userID || m.ended[sessionID] {
+		return sql.ErrNoRows
+	}
+	m.revokeFamily(session.FamilyID)
+	return nil
+}
+
+func (m *mockTokenStore) CreateRefreshToken(token *models.RefreshToken) error {
+	m.refresh[token.TokenHash] = &mockRefreshToken{RefreshToken: *token}
+	return nil
+}
+
+func (m *mockTokenStore) RotateRefreshToken(oldHash string, next *models.RefreshToken) error {
+	old, ok := m.refresh[oldHash]
+	if !ok {
+		return models.ErrRefreshTokenInvalid
+	}
+	if old.used {
+		next.UserID = old.UserID
+		next.FamilyID = old.FamilyID
+		m.revokeFamily(old.FamilyID)
+		return models.ErrRefreshTokenReused
+	}
+	if old.revoked {
+		return models.ErrRefreshTokenInvalid
+	}
+
+	old.used = true
+	next.UserID = old.UserID
+	next.FamilyID = old.FamilyID
+	next.SessionID = old.SessionID
+	return m.CreateRefreshToken(next)
+}
+
+func (m *mockTokenStore) RevokeRefreshFamily(userID int, tokenHash string) error {
+	if token, ok := m.refresh[tokenHash]; ok && token.UserID == userID {
+		m.revokeFamily(token.FamilyID)
+	}
+	return nil
+}
+
+func (m *mockTokenStore) revokeFamily(familyID string) {
+	for _, token := range m.refresh {
+		if token.FamilyID == familyID {
+			token.revoked = true
+		}
+	}
+	for id, session := range m.sessions {
+		if session.FamilyID == familyID {
+			m.ended[id] = true
+		}
+	}
+}
+
+func (m *mockTokenStore) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	m.revoked[jti] = true
+	return nil
+}
+
+func (m *mockTokenStore) CheckAccessToken(jti string, userID, sessionID int) (models.AccessTokenStatus, error) {
+	session, ok := m.sessions[sessionID]
+	switch {
+	case m.revoked[jti]:
+		return models.AccessTokenRevoked, nil
+	case m.suspended[userID]:
+		return models.AccessTokenUserSuspended, nil
+	case !ok || session.UserID != userID || m.ended[sessionID]:
+		return models.AccessTokenSessionEnded, nil
+	}
+	return models.AccessTokenActive, nil
+}
+
+func (m *mockTokenStore) CreatePasswordResetToken(token *models.PasswordResetToken) error {
+	m.resets[token.TokenHash] = &mockResetToken{PasswordResetToken: *token}
+	return nil
+}
+
+func (m *mockTokenStore) ResetPassword(tokenHash, hashedPassword string) (int, error) {
+	token, ok := m.resets[tokenHash]
+	if !ok || token.used || time.Now().After(token.ExpiresAt) {
+		return 0, models.ErrResetTokenInvalid
+	}
+	token.used = true
+	m.passwords[token.UserID] = hashedPassword
+	return token.UserID, nil
+}
+
+// mockAuditRecorder keeps audit events in the order they were recorded.
+type mockAuditRecorder struct {
+	events []*models.AuditEvent
+}
+
+func (m *mockAuditRecorder) Record(r *http.Request, e *models.AuditEvent) {
+	e.IP = utils.ClientIP(r)
+	e.UserAgent = r.UserAgent()
+	m.events = append(m.events, e)
+}
+
+// mockMailer keeps sent messages instead of delivering them.
+type mockMailer struct {
+	sent []*mailer.Message
+}
+
+func (m *mockMailer) Send(msg *mailer.Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// mockTwoFactorStore keeps two-factor state in memory and mirrors it onto
+// the users of a mockUserStore.
+type mockTwoFactorStore struct {
+	users    *mockUserStore
+	secrets  map[int]string
+	lastStep map[int]int64
+	recovery map[int]map[string]bool
+}
+
+func newMockTwoFactorStore(users *mockUserStore) *mockTwoFactorStore {
+	return &mockTwoFactorStore{
+		users:    users,
+		secrets:  make(map[int]string),
+		lastStep: make(map[int]int64),
+		recovery: make(map[int]map[string]bool),
+	}
+}
+
+func (m *mockTwoFactorStore) GetTwoFactor(userID int) (*models.TwoFactor, error) {
+	u, err := m.users.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &models.TwoFactor{Secret: m.secrets[userID], Enabled: u.TwoFactorEnabled}, nil
+}
+
+func (m *mockTwoFactorStore) SetPendingTwoFactor(userID int, secret string) error {
+	u, err := m.users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if u.TwoFactorEnabled {
+		return models.ErrTwoFactorEnabled
+	}
+	m.secrets[userID] = secret
+	return nil
+}
+
+func (m *mockTwoFactorStore) EnableTwoFactor(userID int, recoveryCodeHashes []string) error {
+	u, err := m.users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	u.TwoFactorEnabled = true
+	m.recovery[userID] = make(map[string]bool)
+	for _, hash := range recoveryCodeHashes {
+		m.recovery[userID][hash] = true
+	}
+	return nil
+}
+
+func (m *mockTwoFactorStore) DisableTwoFactor(userID int) error {
+	u, err := m.users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	u.TwoFactorEnabled = false
+	delete(m.secrets, userID)
+	delete(m.recovery, userID)
+	return nil
+}
+
+func (m *mockTwoFactorStore) UseTOTPStep(userID int, step int64) (bool, error) {
+	if step <= m.lastStep[userID] {
+		return false, nil
+	}
+	m.lastStep[userID] = step
+	return true, nil
+}
+
+func (m *mockTwoFactorStore) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	if !m.recovery[userID][codeHash] {
+		return false, nil
+	}
+	delete(m.recovery[userID], codeHash)
+	return true, nil
 }
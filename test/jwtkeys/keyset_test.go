@@ -0,0 +1,144 @@
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"go-note/jwtkeys"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestKeySet(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "1", "aud": "go-note-api", "exp": time.Now().Add(time.Minute).Unix()}
+	}
+
+	t.Run("should sign and verify with RSA and Ed25519 keys", func(t *testing.T) {
+		for name, key := range map[string]crypto.Signer{"RS256": rsaKey, "EdDSA": edKey} {
+			keys, err := jwtkeys.New("go-note", "go-note-api", key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := keys.Sign(claims())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Header["alg"] != name || parsed.Header["kid"] == "" {
+				t.Errorf("expected %s token with a kid, got %v", name, parsed.Header)
+			}
+
+			got, err := keys.Parse(token, "go-note-api")
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if got["iss"] != "go-note" || got["iat"] == nil {
+				t.Errorf("%s: expected iss and iat claims, got %v", name, got)
+			}
+		}
+	})
+
+	t.Run("should accept tokens of retired keys during a rotation", func(t *testing.T) {
+		old, err := jwtkeys.New("go-note", "go-note-api", rsaKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := old.Sign(claims())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		current, err := jwtkeys.New("go-note", "go-note-api", edKey, rsaKey.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := current.Parse(token, "go-note-api"); err != nil {
+			t.Errorf("expected token of retired key to verify, got %v", err)
+		}
+
+		withoutOld, err := jwtkeys.New("go-note", "go-note-api", edKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := withoutOld.Parse(token, "go-note-api"); err == nil {
+			t.Errorf("expected token of removed key to be rejected")
+		}
+
+		set := current.JWKS()
+		if len(set.Keys) != 2 || set.Keys[0].Kty != "OKP" || set.Keys[1].Kty != "RSA" {
+			t.Errorf("expected the Ed25519 signing key and the RSA key, got %+v", set.Keys)
+		}
+	})
+
+	t.Run("should reject tokens for another audience or issuer", func(t *testing.T) {
+		keys, err := jwtkeys.New("go-note", "go-note-api", edKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := keys.Sign(claims())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := keys.Parse(token, "verify_email"); err == nil {
+			t.Errorf("expected token for another audience to be rejected")
+		}
+
+		other, err := jwtkeys.New("someone-else", "go-note-api", edKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Parse(token, "go-note-api"); err == nil {
+			t.Errorf("expected token from another issuer to be rejected")
+		}
+	})
+
+	t.Run("should reject HMAC tokens", func(t *testing.T) {
+		keys, err := jwtkeys.New("go-note", "go-note-api", edKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kid := keys.JWKS().Keys[0].Kid
+
+		c := claims()
+		c["iss"] = "go-note"
+		forged := jwt.NewWithClaims(jwt.SigningMethodHS256, c)
+		forged.Header["kid"] = kid
+		token, err := forged.SignedString([]byte(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := keys.Parse(token, "go-note-api"); err == nil {
+			t.Errorf("expected HS256 token to be rejected")
+		}
+	})
+
+	t.Run("should refuse to run without a signing key", func(t *testing.T) {
+		if _, err := jwtkeys.New("go-note", "go-note-api", nil); err != jwtkeys.ErrNoSigningKey {
+			t.Errorf("expected %v, got %v", jwtkeys.ErrNoSigningKey, err)
+		}
+		if _, err := jwtkeys.Load("go-note", "go-note-api", "", nil); err != jwtkeys.ErrNoSigningKey {
+			t.Errorf("expected %v, got %v", jwtkeys.ErrNoSigningKey, err)
+		}
+	})
+}
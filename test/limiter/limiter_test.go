@@ -0,0 +1,92 @@
+package limiter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go-note/limiter"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	policy := limiter.Policy{Threshold: 3, BaseDelay: time.Second, MaxDelay: 3 * time.Second, Window: time.Hour}
+
+	t.Run("should back off exponentially after the threshold", func(t *testing.T) {
+		l := limiter.NewMemory(policy)
+
+		want := []time.Duration{0, 0, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+		for i, expected := range want {
+			lock, err := l.Fail("account:test@mail.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lock != expected {
+				t.Errorf("failure %d: expected lockout %s, got %s", i+1, expected, lock)
+			}
+		}
+
+		wait, err := l.Check("account:test@mail.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait <= 0 || wait > 3*time.Second {
+			t.Errorf("expected a lockout of up to 3s, got %s", wait)
+		}
+
+		if wait, _ := l.Check("account:other@mail.com"); wait != 0 {
+			t.Errorf("expected other keys not to be locked out, got %s", wait)
+		}
+	})
+
+	t.Run("should forget failures on reset", func(t *testing.T) {
+		l := limiter.NewMemory(policy)
+
+		for i := 0; i < policy.Threshold; i++ {
+			l.Fail("ip:10.0.0.1")
+		}
+		if err := l.Reset("ip:10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if wait, _ := l.Check("ip:10.0.0.1"); wait != 0 {
+			t.Errorf("expected no lockout after reset, got %s", wait)
+		}
+		if lock, _ := l.Fail("ip:10.0.0.1"); lock != 0 {
+			t.Errorf("expected the count to start over after reset, got lockout %s", lock)
+		}
+	})
+
+	t.Run("should forget failures older than the window", func(t *testing.T) {
+		short := policy
+		short.Window = 10 * time.Millisecond
+		l := limiter.NewMemory(short)
+
+		l.Fail("ip:10.0.0.1")
+		l.Fail("ip:10.0.0.1")
+		time.Sleep(20 * time.Millisecond)
+
+		if lock, _ := l.Fail("ip:10.0.0.1"); lock != 0 {
+			t.Errorf("expected old failures to be forgotten, got lockout %s", lock)
+		}
+	})
+}
+
+func TestMemoryLimiterSize(t *testing.T) {
+	l := limiter.NewMemory(limiter.Policy{Threshold: 1, BaseDelay: time.Minute, MaxDelay: time.Minute, Window: time.Hour})
+
+	for i := 0; i <= 10000; i++ {
+		if lock, _ := l.Fail(fmt.Sprintf("ip:%d", i)); lock == 0 {
+			t.Fatalf("key %d: expected a lockout", i)
+		}
+	}
+
+	if wait, _ := l.Check("ip:0"); wait != 0 {
+		t.Errorf("expected the oldest key to be forgotten, got %s", wait)
+	}
+	if wait, _ := l.Check("ip:1"); wait == 0 {
+		t.Error("expected the second oldest key to be kept")
+	}
+	if wait, _ := l.Check("ip:10000"); wait == 0 {
+		t.Error("expected the newest key to be kept")
+	}
+}
@@ -0,0 +1,61 @@
+package mailer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"go-note/mailer"
+)
+
+func TestLogMailer(t *testing.T) {
+	var buf bytes.Buffer
+	m := mailer.NewLogMailer(&buf, "no-reply@localhost")
+
+	err := m.Send(&mailer.Message{
+		To:      "test@mail.com\r\nBcc: evil@mail.com",
+		Subject: "Reset your password",
+		Body:    "hello",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{"From: no-reply@localhost\r\n", "Subject: Reset your password\r\n", "\r\n\r\nhello"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in %q", want, out)
+		}
+	}
+	if strings.Contains(out, "\r\nBcc:") {
+		t.Errorf("expected header injection to be stripped, got %q", out)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	q := mailer.NewQueue(1)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var ran []int
+	if !q.Go(func() { close(started); <-release; ran = append(ran, 1) }) {
+		t.Fatal("expected the first job to be queued")
+	}
+	<-started
+
+	if !q.Go(func() { ran = append(ran, 2) }) {
+		t.Fatal("expected the second job to be buffered")
+	}
+	if q.Go(func() { ran = append(ran, 3) }) {
+		t.Error("expected a full queue to drop the job")
+	}
+
+	close(release)
+	q.Close()
+
+	if len(ran) != 2 || ran[0] != 1 || ran[1] != 2 {
+		t.Errorf("expected jobs 1 and 2 to run in order, got %v", ran)
+	}
+	if q.Go(func() {}) {
+		t.Error("expected a closed queue to drop the job")
+	}
+}
@@ -2,11 +2,19 @@ package note
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"go-note/middlewares"
 	"go-note/models"
 	"go-note/service/note"
 
@@ -22,6 +30,7 @@ func TestNoteServiceHandlers(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req = withUser(req, 1)
 
 		rr := httptest.NewRecorder()
 		router := mux.NewRouter()
@@ -40,6 +49,7 @@ func TestNoteServiceHandlers(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req = withUser(req, 1)
 
 		rr := httptest.NewRecorder()
 		router := mux.NewRouter()
@@ -58,6 +68,7 @@ func TestNoteServiceHandlers(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req = withUser(req, 1)
 
 		rr := httptest.NewRecorder()
 		router := mux.NewRouter()
@@ -76,6 +87,7 @@ func TestNoteServiceHandlers(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req = withUser(req, 1)
 
 		rr := httptest.NewRecorder()
 		router := mux.NewRouter()
@@ -93,7 +105,6 @@ func TestNoteServiceHandlers(t *testing.T) {
 		payload := models.NotePayload{
 			Title:       "test",
 			Description: "test description",
-			UserID:      1,
 		}
 
 		marshalled, err := json.Marshal(payload)
@@ -105,6 +116,7 @@ func TestNoteServiceHandlers(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req = withUser(req, 1)
 
 		rr := httptest.NewRecorder()
 		router := mux.NewRouter()
@@ -118,11 +130,45 @@ func TestNoteServiceHandlers(t *testing.T) {
 		}
 	})
 
+	t.Run("should require a verified email to create notes when configured", func(t *testing.T) {
+		verifiedHandler := note.NewHandler(noteStore)
+		verifiedHandler.SetRequireVerifiedEmail(true)
+
+		router := mux.NewRouter()
+		router.HandleFunc("/notes", verifiedHandler.HandleCreateNote).Methods(http.MethodPost)
+
+		for _, verified := range []bool{false, true} {
+			marshalled, err := json.Marshal(models.NotePayload{Title: "test", Description: "test description"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest(http.MethodPost, "/notes", bytes.NewBuffer(marshalled))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = withUser(req, 1)
+			req = req.WithContext(context.WithValue(req.Context(), middlewares.VerifiedKey, verified))
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			expected := http.StatusForbidden
+			if verified {
+				expected = http.StatusCreated
+			}
+			if rr.Code != expected {
+				t.Errorf("verified=%v: expected status code %d, got %d", verified, expected, rr.Code)
+			}
+		}
+	})
+
 	t.Run("should fail updating a note if the payload is missing", func(t *testing.T) {
 		req, err := http.NewRequest(http.MethodPut, "/notes/1", nil)
 		if err != nil {
 			t.Fatal(err)
 		}
+		req = withUser(req, 1)
 
 		rr := httptest.NewRecorder()
 		router := mux.NewRouter()
@@ -140,7 +186,6 @@ func TestNoteServiceHandlers(t *testing.T) {
 		payload := models.NotePayload{
 			Title:       "test",
 			Description: "test description",
-			UserID:      1,
 		}
 
 		marshalled, err := json.Marshal(payload)
@@ -152,6 +197,7 @@ func TestNoteServiceHandlers(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req = withUser(req, 1)
 
 		rr := httptest.NewRecorder()
 		router := mux.NewRouter()
@@ -171,6 +217,7 @@ func TestNoteServiceHandlers(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req = withUser(req, 1)
 
 		rr := httptest.NewRecorder()
 		router := mux.NewRouter()
@@ -183,26 +230,1351 @@ func TestNoteServiceHandlers(t *testing.T) {
 			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
 		}
 	})
+
+	t.Run("should reject requests without an authenticated user", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/notes", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notes", handler.HandleGetNotes).Methods(http.MethodGet)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	t.Run("should not find notes owned by another user", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodDelete, "/notes/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 2)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notes/{id}", handler.HandleDeleteNote).Methods(http.MethodDelete)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should page through notes with the returned cursor", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/notes", handler.HandleGetNotes).Methods(http.MethodGet)
+
+		req, err := http.NewRequest(http.MethodGet, "/notes?limit=1&sort=title&title=go", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var body struct {
+			NextCursor string `json:"next_cursor"`
+			Total      int    `json:"total"`
+			Count      int    `json:"count"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.NextCursor == "" || body.Total != 3 || body.Count != 1 {
+			t.Fatalf("unexpected paging metadata: %+v", body)
+		}
+
+		opts := noteStore.lastListOptions
+		if opts.Limit != 1 || opts.Sort != models.NoteSortTitle || opts.Order != models.SortAsc || opts.Title != "go" {
+			t.Errorf("unexpected list options: %+v", opts)
+		}
+
+		req, err = http.NewRequest(http.MethodGet, "/notes?limit=1&sort=title&cursor="+body.NextCursor, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		after := noteStore.lastListOptions.After
+		if after == nil || after.ID != 42 || after.Value != "b" {
+			t.Errorf("cursor did not round-trip: %+v", after)
+		}
+	})
+
+	t.Run("should reject invalid list parameters", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/notes", handler.HandleGetNotes).Methods(http.MethodGet)
+
+		// A well-formed cursor whose timestamp was tampered with.
+		tampered := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"created","o":"desc","v":"x","id":1}`))
+
+		for _, query := range []string{"limit=0", "limit=1000", "sort=size", "order=up", "created_after=yesterday", "cursor=!!", "cursor=" + tampered} {
+			req, err := http.NewRequest(http.MethodGet, "/notes?"+query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = withUser(req, 1)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status code %d, got %d", query, http.StatusBadRequest, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should search notes", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/notes/search?q=groceries&limit=5", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notes/search", handler.HandleSearchNotes).Methods(http.MethodGet)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var body struct {
+			Data []models.NoteSearchResult `json:"data"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Data) != 1 || body.Data[0].TitleHighlight != "<mark>groceries</mark>" {
+			t.Errorf("unexpected search results: %+v", body.Data)
+		}
+	})
+
+	t.Run("should escape markup in search highlights", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/notes/search?q="+url.QueryEscape(`<script>alert("x")</script>`), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notes/search", handler.HandleSearchNotes).Methods(http.MethodGet)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var body struct {
+			Data []models.NoteSearchResult `json:"data"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		expected := "<mark>&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</mark>"
+		if len(body.Data) != 1 || body.Data[0].TitleHighlight != expected {
+			t.Errorf("expected highlight %q, got %+v", expected, body.Data)
+		}
+	})
+
+	t.Run("should fail searching without a query", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/notes/search?q=+", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notes/search", handler.HandleSearchNotes).Methods(http.MethodGet)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should pass tag filters to the store", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/notes?tag=work&tag=urgent&tag_match=any", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notes", handler.HandleGetNotes).Methods(http.MethodGet)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		opts := noteStore.lastListOptions
+		if len(opts.Tags) != 2 || opts.Tags[0] != "work" || opts.Tags[1] != "urgent" || opts.TagMatch != models.TagMatchAny {
+			t.Errorf("unexpected tag filter: %v %s", opts.Tags, opts.TagMatch)
+		}
+	})
+
+	t.Run("should fail creating a note with an empty tag", func(t *testing.T) {
+		payload := models.NotePayload{
+			Title:       "test",
+			Description: "test description",
+			Tags:        []string{"work", "  "},
+		}
+
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/notes", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notes", handler.HandleCreateNote).Methods(http.MethodPost)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should handle moving a note between notebooks", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/notes/{id}/notebook", handler.HandleMoveNote).Methods(http.MethodPut)
+
+		cases := []struct {
+			body string
+			code int
+		}{
+			{`{"notebook_id": 7}`, http.StatusOK},
+			{`{"notebook_id": null}`, http.StatusOK},
+			{`{"notebook_id": 8}`, http.StatusBadRequest},
+		}
+		for _, c := range cases {
+			req, err := http.NewRequest(http.MethodPut, "/notes/1/notebook", bytes.NewBufferString(c.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = withUser(req, 1)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != c.code {
+				t.Errorf("%s: expected status code %d, got %d", c.body, c.code, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should pass the notebook filter to the store", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/notes?notebook_id=7&descendants=true", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notes", handler.HandleGetNotes).Methods(http.MethodGet)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		opts := noteStore.lastListOptions
+		if opts.NotebookID == nil || *opts.NotebookID != 7 || !opts.Descendants {
+			t.Errorf("unexpected notebook filter: %v %v", opts.NotebookID, opts.Descendants)
+		}
+	})
+
+	t.Run("should handle trash operations", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/notes/trash", handler.HandleGetTrash).Methods(http.MethodGet)
+		router.HandleFunc("/notes/trash/{id}/restore", handler.HandleRestoreNote).Methods(http.MethodPost)
+		router.HandleFunc("/notes/trash/{id}", handler.HandlePurgeNote).Methods(http.MethodDelete)
+
+		cases := []struct {
+			method string
+			path   string
+			code   int
+		}{
+			{http.MethodGet, "/notes/trash", http.StatusOK},
+			{http.MethodPost, "/notes/trash/5/restore", http.StatusOK},
+			{http.MethodPost, "/notes/trash/1/restore", http.StatusNotFound},
+			{http.MethodDelete, "/notes/trash/5", http.StatusOK},
+			{http.MethodDelete, "/notes/trash/1", http.StatusNotFound},
+		}
+		for _, c := range cases {
+			req, err := http.NewRequest(c.method, c.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = withUser(req, 1)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != c.code {
+				t.Errorf("%s %s: expected status code %d, got %d", c.method, c.path, c.code, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should diff two revisions", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/notes/1/revisions/diff?from=1&to=2", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notes/{id}/revisions/diff", handler.HandleDiffRevisions).Methods(http.MethodGet)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var body struct {
+			Data models.NoteDiff `json:"data"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "--- revision 1\n+++ revision 2\n" +
+			"@@ -1,5 +1,5 @@\n" +
+			"-groceries\n" +
+			"+shopping\n" +
+			" \n" +
+			" milk\n" +
+			" eggs\n" +
+			"-bread\n" +
+			"+butter\n"
+		if body.Data.Diff != expected {
+			t.Errorf("unexpected diff:\n%s", body.Data.Diff)
+		}
+	})
+
+	t.Run("should refuse diffs that are too large", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/notes/{id}/revisions/diff", handler.HandleDiffRevisions).Methods(http.MethodGet)
+
+		cases := []struct {
+			query    string
+			expected int
+		}{
+			{"from=3&to=4", http.StatusOK},
+			{"from=3&to=5", http.StatusUnprocessableEntity},
+		}
+		for _, c := range cases {
+			req, err := http.NewRequest(http.MethodGet, "/notes/1/revisions/diff?"+c.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = withUser(req, 1)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != c.expected {
+				t.Errorf("%s: expected status code %d, got %d", c.query, c.expected, rr.Code)
+			}
+			if c.expected == http.StatusOK && !strings.Contains(rr.Body.String(), `+line 1500 edited`) {
+				t.Errorf("%s: unexpected diff %s", c.query, rr.Body.String())
+			}
+		}
+	})
+
+	t.Run("should handle revision lookups and restores", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/notes/{id}/revisions", handler.HandleGetRevisions).Methods(http.MethodGet)
+		router.HandleFunc("/notes/{id}/revisions/{rev:[0-9]+}", handler.HandleGetRevision).Methods(http.MethodGet)
+		router.HandleFunc("/notes/{id}/revisions/{rev:[0-9]+}/restore", handler.HandleRestoreRevision).Methods(http.MethodPost)
+
+		cases := []struct {
+			method string
+			path   string
+			code   int
+		}{
+			{http.MethodGet, "/notes/1/revisions", http.StatusOK},
+			{http.MethodGet, "/notes/2/revisions", http.StatusNotFound},
+			{http.MethodGet, "/notes/1/revisions/2", http.StatusOK},
+			{http.MethodGet, "/notes/1/revisions/9", http.StatusNotFound},
+			{http.MethodPost, "/notes/1/revisions/1/restore", http.StatusOK},
+			{http.MethodPost, "/notes/1/revisions/9/restore", http.StatusNotFound},
+		}
+		for _, c := range cases {
+			req, err := http.NewRequest(c.method, c.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = withUser(req, 1)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != c.code {
+				t.Errorf("%s %s: expected status code %d, got %d", c.method, c.path, c.code, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should return the note version as an ETag", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/notes/{id}", handler.HandleGetNoteByID).Methods(http.MethodGet)
+
+		cases := []struct {
+			ifNoneMatch string
+			code        int
+		}{
+			{"", http.StatusOK},
+			{`"2"`, http.StatusOK},
+			{`"3"`, http.StatusNotModified},
+			{`W/"3"`, http.StatusNotModified},
+			{`"1", "3"`, http.StatusNotModified},
+			{"*", http.StatusNotModified},
+		}
+		for _, c := range cases {
+			req, err := http.NewRequest(http.MethodGet, "/notes/42", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = withUser(req, 1)
+			if c.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", c.ifNoneMatch)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != c.code {
+				t.Errorf("If-None-Match %s: expected status code %d, got %d", c.ifNoneMatch, c.code, rr.Code)
+			}
+			if etag := rr.Header().Get("ETag"); etag != `"3"` {
+				t.Errorf("expected ETag %q, got %q", `"3"`, etag)
+			}
+		}
+	})
+
+	t.Run("should check If-Match on writes", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/notes/{id}", handler.HandleUpdateNote).Methods(http.MethodPut)
+		router.HandleFunc("/notes/{id}", handler.HandleDeleteNote).Methods(http.MethodDelete)
+
+		cases := []struct {
+			method  string
+			ifMatch string
+			code    int
+		}{
+			{http.MethodPut, `"3"`, http.StatusOK},
+			{http.MethodPut, `"2"`, http.StatusPreconditionFailed},
+			{http.MethodPut, `W/"3"`, http.StatusPreconditionFailed},
+			{http.MethodPut, "*", http.StatusOK},
+			{http.MethodPut, `"1", "3"`, http.StatusOK},
+			{http.MethodPut, `W/"3", "3"`, http.StatusOK},
+			{http.MethodPut, `"1", "2"`, http.StatusPreconditionFailed},
+			{http.MethodPut, `"1", 3`, http.StatusPreconditionFailed},
+			{http.MethodDelete, `"2"`, http.StatusPreconditionFailed},
+			{http.MethodDelete, `"2", "3"`, http.StatusOK},
+			{http.MethodDelete, `"3"`, http.StatusOK},
+		}
+		for _, c := range cases {
+			body := bytes.NewBufferString(`{"title": "test", "description": "test description"}`)
+			req, err := http.NewRequest(c.method, "/notes/1", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = withUser(req, 1)
+			req.Header.Set("If-Match", c.ifMatch)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != c.code {
+				t.Errorf("%s If-Match %s: expected status code %d, got %d", c.method, c.ifMatch, c.code, rr.Code)
+			}
+			if c.method == http.MethodPut && c.code == http.StatusOK && rr.Header().Get("ETag") != `"4"` {
+				t.Errorf("PUT If-Match %s: expected ETag %q, got %q", c.ifMatch, `"4"`, rr.Header().Get("ETag"))
+			}
+		}
+	})
+
+	t.Run("should require If-Match when configured", func(t *testing.T) {
+		strict := note.NewHandler(noteStore)
+		strict.SetRequireIfMatch(true)
+
+		req, err := http.NewRequest(http.MethodDelete, "/notes/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notes/{id}", strict.HandleDeleteNote).Methods(http.MethodDelete)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusPreconditionRequired {
+			t.Errorf("expected status code %d, got %d", http.StatusPreconditionRequired, rr.Code)
+		}
+	})
+
+	t.Run("should handle patching a note", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/notes/{id}", handler.HandlePatchNote).Methods(http.MethodPatch)
+
+		cases := []struct {
+			name        string
+			contentType string
+			ifMatch     string
+			body        string
+			code        int
+			etag        string
+			check       func(p *models.NotePatch) bool
+		}{
+			{
+				name:        "merge patch changes only the title",
+				contentType: "application/merge-patch+json",
+				body:        `{"title": "shopping"}`,
+				code:        http.StatusOK,
+				check: func(p *models.NotePatch) bool {
+					return p.Title != nil && *p.Title == "shopping" && p.Description == nil && p.Tags == nil && !p.SetNotebook
+				},
+			},
+			{
+				name:        "merge patch moving the note to a notebook",
+				contentType: "application/merge-patch+json",
+				body:        `{"notebook_id": 7, "description": "milk"}`,
+				code:        http.StatusOK,
+				check: func(p *models.NotePatch) bool {
+					return p.SetNotebook && *p.NotebookID == 7 && p.Title == nil && p.Description == nil
+				},
+			},
+			{
+				name:        "json patch appending a tag",
+				contentType: "application/json-patch+json; charset=utf-8",
+				body:        `[{"op": "test", "path": "/title", "value": "groceries"}, {"op": "add", "path": "/tags/-", "value": "urgent"}]`,
+				code:        http.StatusOK,
+				check: func(p *models.NotePatch) bool {
+					return len(p.Tags) == 2 && p.Tags[0] == "home" && p.Tags[1] == "urgent" && p.Title == nil
+				},
+			},
+			{
+				name:        "merge patch removing a required field",
+				contentType: "application/merge-patch+json",
+				body:        `{"title": null}`,
+				code:        http.StatusBadRequest,
+			},
+			{
+				name:        "merge patch on an unknown field",
+				contentType: "application/merge-patch+json",
+				body:        `{"user_id": 2}`,
+				code:        http.StatusUnprocessableEntity,
+			},
+			{
+				name:        "json patch with a failing test",
+				contentType: "application/json-patch+json",
+				body:        `[{"op": "test", "path": "/title", "value": "other"}]`,
+				code:        http.StatusUnprocessableEntity,
+			},
+			{
+				name:        "plain json",
+				contentType: "application/json",
+				body:        `{"title": "shopping"}`,
+				code:        http.StatusUnsupportedMediaType,
+			},
+			{
+				name:        "stale If-Match",
+				contentType: "application/merge-patch+json",
+				ifMatch:     `"2"`,
+				body:        `{"title": "shopping"}`,
+				code:        http.StatusPreconditionFailed,
+			},
+			{
+				name:        "merge patch changing nothing",
+				contentType: "application/merge-patch+json",
+				body:        `{"title": "groceries", "tags": ["HOME"]}`,
+				code:        http.StatusOK,
+				etag:        `"3"`,
+				check: func(p *models.NotePatch) bool {
+					return p.Title == nil && p.Description == nil && p.Tags == nil && !p.SetNotebook
+				},
+			},
+			{
+				name:        "If-Match listing the current version",
+				contentType: "application/merge-patch+json",
+				ifMatch:     `"2", "3"`,
+				body:        `{"title": "shopping"}`,
+				code:        http.StatusOK,
+			},
+		}
+		for _, c := range cases {
+			noteStore.lastPatch = nil
+
+			req, err := http.NewRequest(http.MethodPatch, "/notes/1", bytes.NewBufferString(c.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = withUser(req, 1)
+			req.Header.Set("Content-Type", c.contentType)
+			if c.ifMatch != "" {
+				req.Header.Set("If-Match", c.ifMatch)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != c.code {
+				t.Errorf("%s: expected status code %d, got %d", c.name, c.code, rr.Code)
+				continue
+			}
+			if c.check != nil && (noteStore.lastPatch == nil || !c.check(noteStore.lastPatch)) {
+				t.Errorf("%s: unexpected patch %+v", c.name, noteStore.lastPatch)
+			}
+			etag := c.etag
+			if etag == "" {
+				etag = `"4"`
+			}
+			if c.code == http.StatusOK && rr.Header().Get("ETag") != etag {
+				t.Errorf("%s: expected ETag %q, got %q", c.name, etag, rr.Header().Get("ETag"))
+			}
+		}
+	})
+}
+
+func TestNoteSharing(t *testing.T) {
+	noteStore := &mockNoteStore{}
+	handler := note.NewHandler(noteStore)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/notes/shared", handler.HandleGetSharedNotes).Methods(http.MethodGet)
+	router.HandleFunc("/notes/{id}", handler.HandleGetNoteByID).Methods(http.MethodGet)
+	router.HandleFunc("/notes/{id}", handler.HandleUpdateNote).Methods(http.MethodPut)
+	router.HandleFunc("/notes/{id}", handler.HandleDeleteNote).Methods(http.MethodDelete)
+	router.HandleFunc("/notes/{id}/shares", handler.HandleGetNoteShares).Methods(http.MethodGet)
+	router.HandleFunc("/notes/{id}/shares", handler.HandleShareNote).Methods(http.MethodPost)
+	router.HandleFunc("/notes/{id}/shares/{user:[0-9]+}", handler.HandleRevokeNoteShare).Methods(http.MethodDelete)
+
+	serve := func(method, path string, userID int, payload interface{}) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		if payload != nil {
+			if err := json.NewEncoder(&body).Encode(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req := withUser(httptest.NewRequest(method, path, &body), userID)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	update := models.NotePayload{Title: "groceries", Description: "milk and eggs"}
+
+	t.Run("should reject invalid shares", func(t *testing.T) {
+		cases := []struct {
+			payload  models.NoteSharePayload
+			expected int
+		}{
+			{models.NoteSharePayload{User: "bob@mail.com", Permission: "owner"}, http.StatusBadRequest},
+			{models.NoteSharePayload{User: "alice", Permission: models.ShareViewer}, http.StatusBadRequest},
+			{models.NoteSharePayload{User: "nobody", Permission: models.ShareViewer}, http.StatusNotFound},
+		}
+		for _, c := range cases {
+			if rr := serve(http.MethodPost, "/notes/42/shares", 1, c.payload); rr.Code != c.expected {
+				t.Errorf("expected sharing with %s as %s to fail with %d, got %d", c.payload.User, c.payload.Permission, c.expected, rr.Code)
+			}
+		}
+
+		share := models.NoteSharePayload{User: "bob@mail.com", Permission: models.ShareViewer}
+		if rr := serve(http.MethodPost, "/notes/42/shares", 2, share); rr.Code != http.StatusNotFound {
+			t.Errorf("expected sharing someone else's note to fail with %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should let viewers read but not write", func(t *testing.T) {
+		share := models.NoteSharePayload{User: "bob@mail.com", Permission: models.ShareViewer}
+		if rr := serve(http.MethodPost, "/notes/42/shares", 1, share); rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+
+		rr := serve(http.MethodGet, "/notes/42", 3, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		var body struct {
+			Data models.Note `json:"data"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Data.Permission != models.ShareViewer || body.Data.UserID != 1 {
+			t.Errorf("expected the owner's note shared as viewer, got %+v", body.Data)
+		}
+
+		if rr := serve(http.MethodPut, "/notes/42", 3, update); rr.Code != http.StatusForbidden {
+			t.Errorf("expected viewer update to fail with %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if rr := serve(http.MethodGet, "/notes/1", 3, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected unshared note to be hidden, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should let editors write but not delete or reshare", func(t *testing.T) {
+		share := models.NoteSharePayload{User: "carol", Permission: models.ShareEditor}
+		if rr := serve(http.MethodPost, "/notes/42/shares", 1, share); rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+
+		if rr := serve(http.MethodPut, "/notes/42", 4, update); rr.Code != http.StatusOK {
+			t.Errorf("expected editor update to succeed, got %d", rr.Code)
+		}
+		if rr := serve(http.MethodDelete, "/notes/42", 4, nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected editor delete to fail with %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		reshare := models.NoteSharePayload{User: "bob@mail.com", Permission: models.ShareEditor}
+		if rr := serve(http.MethodPost, "/notes/42/shares", 4, reshare); rr.Code != http.StatusForbidden {
+			t.Errorf("expected editor reshare to fail with %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if rr := serve(http.MethodGet, "/notes/42/shares", 4, nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected editor share listing to fail with %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should list notes shared with the user", func(t *testing.T) {
+		rr := serve(http.MethodGet, "/notes/shared", 3, nil)
+		var body struct {
+			Data []*models.Note `json:"data"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if rr.Code != http.StatusOK || len(body.Data) != 1 || body.Data[0].ID != 42 {
+			t.Errorf("expected note 42 to be shared with bob, got %d %+v", rr.Code, body.Data)
+		}
+
+		rr = serve(http.MethodGet, "/notes/42/shares", 1, nil)
+		var shares struct {
+			Data []*models.NoteShare `json:"data"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&shares); err != nil {
+			t.Fatal(err)
+		}
+		if rr.Code != http.StatusOK || len(shares.Data) != 2 {
+			t.Errorf("expected two shares, got %d %+v", rr.Code, shares.Data)
+		}
+	})
+
+	t.Run("should revoke access at once", func(t *testing.T) {
+		if rr := serve(http.MethodDelete, "/notes/42/shares/3", 4, nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected an editor removing someone else to fail with %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		if rr := serve(http.MethodDelete, "/notes/42/shares/3", 1, nil); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if rr := serve(http.MethodGet, "/notes/42", 3, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected revoked viewer to lose access, got %d", rr.Code)
+		}
+		if rr := serve(http.MethodDelete, "/notes/42/shares/3", 1, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected revoking twice to fail with %d, got %d", http.StatusNotFound, rr.Code)
+		}
+
+		if rr := serve(http.MethodDelete, "/notes/42/shares/4", 4, nil); rr.Code != http.StatusOK {
+			t.Errorf("expected an editor to leave the note, got %d", rr.Code)
+		}
+	})
+}
+
+func TestWorkspaceNotes(t *testing.T) {
+	noteStore := &mockNoteStore{}
+	handler := note.NewHandler(noteStore)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/notes", handler.HandleCreateNote).Methods(http.MethodPost)
+	router.HandleFunc("/notes", handler.HandleGetNotes).Methods(http.MethodGet)
+
+	t.Run("should create notes by workspace role", func(t *testing.T) {
+		workspaceID, notebookID := 7, 5
+		cases := []struct {
+			name     string
+			userID   int
+			payload  models.NotePayload
+			expected int
+		}{
+			{"editor", 3, models.NotePayload{WorkspaceID: &workspaceID}, http.StatusCreated},
+			{"viewer", 1, models.NotePayload{WorkspaceID: &workspaceID}, http.StatusForbidden},
+			{"non-member", 2, models.NotePayload{WorkspaceID: &workspaceID}, http.StatusBadRequest},
+			{"notebook", 3, models.NotePayload{WorkspaceID: &workspaceID, NotebookID: &notebookID}, http.StatusBadRequest},
+		}
+		for _, c := range cases {
+			c.payload.Title, c.payload.Description = "standup", "notes"
+			var body bytes.Buffer
+			if err := json.NewEncoder(&body).Encode(c.payload); err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, withUser(httptest.NewRequest(http.MethodPost, "/notes", &body), c.userID))
+			if rr.Code != c.expected {
+				t.Errorf("%s: expected status code %d, got %d", c.name, c.expected, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should list workspace notes for members only", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withUser(httptest.NewRequest(http.MethodGet, "/notes?workspace_id=7", nil), 1))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if opts := noteStore.lastListOptions; opts.WorkspaceID == nil || *opts.WorkspaceID != 7 {
+			t.Errorf("expected workspace 7 to be listed, got %+v", opts)
+		}
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, withUser(httptest.NewRequest(http.MethodGet, "/notes?workspace_id=7", nil), 2))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected a non-member to get %d, got %d", http.StatusNotFound, rr.Code)
+		}
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, withUser(httptest.NewRequest(http.MethodGet, "/notes?workspace_id=x", nil), 1))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected an invalid workspace_id to fail with %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+}
+
+func TestNoteLinks(t *testing.T) {
+	noteStore := &mockNoteStore{}
+	handler := note.NewHandler(noteStore)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/notes/{id}/links", handler.HandleGetNoteLinks).Methods(http.MethodGet)
+	router.HandleFunc("/notes/{id}/links", handler.HandleCreateNoteLink).Methods(http.MethodPost)
+	router.HandleFunc("/notes/{id}/links/{link:[0-9]+}", handler.HandleDeleteNoteLink).Methods(http.MethodDelete)
+	handler.RegisterPublicRoutes(router)
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	createLink := func(payload interface{}) (*httptest.ResponseRecorder, string) {
+		var body bytes.Buffer
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			t.Fatal(err)
+		}
+		rr := serve(withUser(httptest.NewRequest(http.MethodPost, "/notes/42/links", &body), 1))
+
+		var created struct {
+			Data struct {
+				Token string `json:"token"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+			t.Fatal(err)
+		}
+		return rr, created.Data.Token
+	}
+
+	t.Run("should serve a link without authentication", func(t *testing.T) {
+		rr, token := createLink(map[string]interface{}{})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+		if !strings.HasPrefix(token, models.NoteLinkPrefix) || len(token) < 40 {
+			t.Fatalf("expected an unguessable token, got %q", token)
+		}
+		if noteStore.links[0].TokenHash == token {
+			t.Error("expected only the token's hash to be stored")
+		}
+
+		for i := 0; i < 2; i++ {
+			rr = serve(httptest.NewRequest(http.MethodGet, "/public/notes/"+token, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+			}
+		}
+		if strings.Contains(rr.Body.String(), "user_id") {
+			t.Errorf("expected the public note to hide its owner, got %s", rr.Body.String())
+		}
+		if noteStore.links[0].Views != 2 {
+			t.Errorf("expected 2 views, got %d", noteStore.links[0].Views)
+		}
+
+		if rr := serve(httptest.NewRequest(http.MethodGet, "/public/notes/gnl_guess", nil)); rr.Code != http.StatusNotFound {
+			t.Errorf("expected an unknown token to fail with %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should require the password", func(t *testing.T) {
+		rr, token := createLink(map[string]interface{}{"password": "open sesame"})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+
+		view := func(password string) int {
+			req := httptest.NewRequest(http.MethodGet, "/public/notes/"+token, nil)
+			if password != "" {
+				req.Header.Set(note.LinkPasswordHeader, password)
+			}
+			return serve(req).Code
+		}
+		if code := view(""); code != http.StatusUnauthorized {
+			t.Errorf("expected a missing password to fail with %d, got %d", http.StatusUnauthorized, code)
+		}
+		if code := view("wrong password"); code != http.StatusUnauthorized {
+			t.Errorf("expected a wrong password to fail with %d, got %d", http.StatusUnauthorized, code)
+		}
+		if code := view("open sesame"); code != http.StatusOK {
+			t.Errorf("expected the right password to succeed, got %d", code)
+		}
+
+		for i := 0; i < 10; i++ {
+			view("wrong password")
+		}
+		if code := view("open sesame"); code != http.StatusTooManyRequests {
+			t.Errorf("expected repeated wrong passwords to lock the link, got %d", code)
+		}
+	})
+
+	t.Run("should refuse expired links", func(t *testing.T) {
+		if rr, _ := createLink(map[string]interface{}{"expires_at": time.Now().Add(-time.Hour)}); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected a past expiry to fail with %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		rr, token := createLink(map[string]interface{}{"expires_at": time.Now().Add(time.Hour)})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+		expired := time.Now().Add(-time.Minute)
+		noteStore.links[len(noteStore.links)-1].ExpiresAt = &expired
+
+		if rr := serve(httptest.NewRequest(http.MethodGet, "/public/notes/"+token, nil)); rr.Code != http.StatusGone {
+			t.Errorf("expected an expired link to fail with %d, got %d", http.StatusGone, rr.Code)
+		}
+	})
+
+	t.Run("should let only the owner list and revoke links", func(t *testing.T) {
+		noteStore.shares = map[int]string{4: models.ShareEditor}
+		if rr := serve(withUser(httptest.NewRequest(http.MethodGet, "/notes/42/links", nil), 4)); rr.Code != http.StatusForbidden {
+			t.Errorf("expected an editor listing links to fail with %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if rr := serve(withUser(httptest.NewRequest(http.MethodDelete, "/notes/42/links/1", nil), 4)); rr.Code != http.StatusForbidden {
+			t.Errorf("expected an editor revoking a link to fail with %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		rr := serve(withUser(httptest.NewRequest(http.MethodGet, "/notes/42/links", nil), 1))
+		var body struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if rr.Code != http.StatusOK || len(body.Data) != 3 {
+			t.Fatalf("expected three links, got %d %+v", rr.Code, body.Data)
+		}
+		if _, ok := body.Data[0]["token"]; ok {
+			t.Error("expected listed links to leave out the token")
+		}
+
+		if rr := serve(withUser(httptest.NewRequest(http.MethodDelete, "/notes/42/links/1", nil), 1)); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if rr := serve(withUser(httptest.NewRequest(http.MethodDelete, "/notes/42/links/1", nil), 1)); rr.Code != http.StatusNotFound {
+			t.Errorf("expected revoking twice to fail with %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
 }
 
-type mockNoteStore struct{}
+func TestPurger(t *testing.T) {
+	purger := &mockPurger{calls: make(chan time.Time, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	note.StartPurger(ctx, purger, time.Hour, time.Hour)
+
+	select {
+	case before := <-purger.calls:
+		if d := time.Until(before); d > -59*time.Minute || d < -61*time.Minute {
+			t.Errorf("expected notes trashed an hour ago to be purged, got cutoff %v", before)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("purger did not run on start")
+	}
+}
+
+type mockPurger struct {
+	calls chan time.Time
+}
+
+func (m *mockPurger) PurgeTrash(before time.Time) (int64, error) {
+	m.calls <- before
+	return 0, nil
+}
 
-func (m *mockNoteStore) CreateNote(note *models.NotePayload) error {
+func withUser(req *http.Request, userID int) *http.Request {
+	ctx := context.WithValue(req.Context(), middlewares.UserKey, userID)
+	return req.WithContext(ctx)
+}
+
+// mockNoteStore owns note IDs 1 and 42 for user 1, both at version 3;
+// everything else is reported as missing, like the real store does for other
+// users' notes. Note 42 can be shared with users 3 (bob) and 4 (carol).
+type mockNoteStore struct {
+	lastListOptions *models.NoteListOptions
+	lastPatch       *models.NotePatch
+	shares          map[int]string
+	links           []*models.NoteLink
+}
+
+func (m *mockNoteStore) owns(userID, id int) bool {
+	return userID == 1 && (id == 1 || id == 42)
+}
+
+// access returns the permission userID has on note id, or "" for none.
+func (m *mockNoteStore) access(userID, id int) string {
+	if m.owns(userID, id) {
+		return models.ShareOwner
+	}
+	if id == 42 {
+		return m.shares[userID]
+	}
+	return ""
+}
+
+// require fails like the real store when userID has less than need on id.
+func (m *mockNoteStore) require(userID, id int, need string) error {
+	have := m.access(userID, id)
+	switch {
+	case have == "":
+		return sql.ErrNoRows
+	case models.SharePermits(have, need):
+		return nil
+	case need == models.ShareOwner:
+		return models.ErrNoteOwnerOnly
+	default:
+		return models.ErrNoteReadOnly
+	}
+}
+
+// mockWorkspaceRoles are the members of workspace 7.
+var mockWorkspaceRoles = map[int]string{1: models.WorkspaceViewer, 3: models.WorkspaceEditor}
+
+func (m *mockNoteStore) CreateNote(userID int, note *models.NotePayload) error {
+	if note.WorkspaceID == nil {
+		return nil
+	}
+	role := ""
+	if *note.WorkspaceID == 7 {
+		role = mockWorkspaceRoles[userID]
+	}
+	switch {
+	case role == "":
+		return models.ErrWorkspaceNotFound
+	case note.NotebookID != nil:
+		return models.ErrWorkspaceNotebook
+	case !models.WorkspaceRolePermits(role, models.WorkspaceEditor):
+		return models.ErrWorkspaceRole
+	}
 	return nil
 }
 
-func (m *mockNoteStore) GetNotes() ([]*models.Note, error) {
+func (m *mockNoteStore) GetNotes(userID int, opts *models.NoteListOptions) (*models.NoteList, error) {
+	m.lastListOptions = opts
+	if opts.WorkspaceID != nil && (*opts.WorkspaceID != 7 || mockWorkspaceRoles[userID] == "") {
+		return nil, models.ErrWorkspaceNotFound
+	}
+	list := &models.NoteList{Notes: []*models.Note{{ID: 42, UserID: userID}}, Total: 3}
+	if opts.After == nil {
+		list.Next = &models.NoteCursor{Sort: opts.Sort, Order: opts.Order, Value: "b", ID: 42}
+	}
+	return list, nil
+}
+
+func (m *mockNoteStore) GetNoteByID(userID, id int) (*models.Note, error) {
+	if err := m.require(userID, id, models.ShareViewer); err != nil {
+		return nil, err
+	}
+	note := &models.Note{
+		ID:          id,
+		Title:       "groceries",
+		Description: "milk",
+		UserID:      1,
+		Tags:        []string{"home"},
+		Version:     3,
+	}
+	if !m.owns(userID, id) {
+		note.Permission = m.access(userID, id)
+	}
+	return note, nil
+}
+
+func (m *mockNoteStore) UpdateNote(userID, id int, note *models.NotePayload, version int) (int, error) {
+	if err := m.require(userID, id, models.ShareEditor); err != nil {
+		return 0, err
+	}
+	if version != 0 && version != 3 {
+		return 0, models.ErrVersionMismatch
+	}
+	return 4, nil
+}
+
+func (m *mockNoteStore) DeleteNote(userID, id int, version int) error {
+	if err := m.require(userID, id, models.ShareOwner); err != nil {
+		return err
+	}
+	if version != 0 && version != 3 {
+		return models.ErrVersionMismatch
+	}
+	return nil
+}
+
+func (m *mockNoteStore) PatchNote(userID, id int, patch *models.NotePatch, version int) (int, error) {
+	if err := m.require(userID, id, models.ShareEditor); err != nil {
+		return 0, err
+	}
+	if version != 0 && version != 3 {
+		return 0, models.ErrVersionMismatch
+	}
+	m.lastPatch = patch
+	if patch.Title == nil && patch.Description == nil && !patch.SetNotebook && patch.Tags == nil {
+		return 3, nil
+	}
+	return 4, nil
+}
+
+func (m *mockNoteStore) MoveNote(userID, id int, notebookID *int) error {
+	if !m.owns(userID, id) {
+		return sql.ErrNoRows
+	}
+	if notebookID != nil && *notebookID != 7 {
+		return models.ErrNotebookNotFound
+	}
+	return nil
+}
+
+func (m *mockNoteStore) GetTrash(userID int) ([]*models.Note, error) {
 	return []*models.Note{}, nil
 }
 
-func (m *mockNoteStore) GetNoteByID(id int) (*models.Note, error) {
-	return &models.Note{}, nil
+// Note 5 of user 1 sits in the trash.
+func (m *mockNoteStore) RestoreNote(userID, id int) error {
+	if userID != 1 || id != 5 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
-func (m *mockNoteStore) UpdateNote(id int, note *models.NotePayload) error {
+func (m *mockNoteStore) PurgeNote(userID, id int) error {
+	if userID != 1 || id != 5 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
 
-func (m *mockNoteStore) DeleteNote(id int) error {
+// Note 1 has two revisions that differ in the title and one line of the
+// description. Revisions 3 and 4 are long and differ in one line, revision
+// 5 is just as long with nothing in common.
+var mockRevisions = map[int]*models.NoteRevision{
+	1: {NoteID: 1, Revision: 1, Title: "groceries", Description: "milk\neggs\nbread"},
+	2: {NoteID: 1, Revision: 2, Title: "shopping", Description: "milk\neggs\nbutter"},
+	3: {NoteID: 1, Revision: 3, Title: "log", Description: mockLines("line", -1)},
+	4: {NoteID: 1, Revision: 4, Title: "log", Description: mockLines("line", 1500)},
+	5: {NoteID: 1, Revision: 5, Title: "other", Description: mockLines("other", -1)},
+}
+
+// mockLines returns 3000 numbered lines, with line changed edited.
+func mockLines(prefix string, changed int) string {
+	lines := make([]string, 3000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%s %d", prefix, i)
+	}
+	if changed >= 0 {
+		lines[changed] += " edited"
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (m *mockNoteStore) GetRevisions(userID, noteID int) ([]*models.NoteRevision, error) {
+	if !m.owns(userID, noteID) {
+		return nil, sql.ErrNoRows
+	}
+	return []*models.NoteRevision{mockRevisions[2], mockRevisions[1]}, nil
+}
+
+func (m *mockNoteStore) GetRevision(userID, noteID, revision int) (*models.NoteRevision, error) {
+	if !m.owns(userID, noteID) {
+		return nil, sql.ErrNoRows
+	}
+	rev, ok := mockRevisions[revision]
+	if !ok {
+		return nil, models.ErrRevisionNotFound
+	}
+	return rev, nil
+}
+
+func (m *mockNoteStore) RestoreRevision(userID, noteID, revision int) error {
+	_, err := m.GetRevision(userID, noteID, revision)
+	return err
+}
+
+func (m *mockNoteStore) SearchNotes(userID int, opts *models.NoteSearchOptions) ([]*models.NoteSearchResult, error) {
+	return []*models.NoteSearchResult{{
+		Note:           models.Note{ID: 42, Title: opts.Query, UserID: userID},
+		Rank:           0.5,
+		TitleHighlight: models.HighlightStart + opts.Query + models.HighlightStop,
+	}}, nil
+}
+
+var mockShareUsers = map[string]*models.NoteShare{
+	"alice":        {UserID: 1, Email: "alice@mail.com", Username: "alice"},
+	"bob@mail.com": {UserID: 3, Email: "bob@mail.com", Username: "bob"},
+	"carol":        {UserID: 4, Email: "carol@mail.com", Username: "carol"},
+}
+
+func (m *mockNoteStore) ShareNote(userID, noteID int, share *models.NoteSharePayload) (*models.NoteShare, error) {
+	if err := m.require(userID, noteID, models.ShareOwner); err != nil {
+		return nil, err
+	}
+	user, ok := mockShareUsers[share.User]
+	if !ok {
+		return nil, models.ErrShareUserNotFound
+	}
+	if user.UserID == userID {
+		return nil, models.ErrShareSelf
+	}
+	if m.shares == nil {
+		m.shares = make(map[int]string)
+	}
+	m.shares[user.UserID] = share.Permission
+	return &models.NoteShare{NoteID: noteID, UserID: user.UserID, Email: user.Email, Username: user.Username, Permission: share.Permission}, nil
+}
+
+func (m *mockNoteStore) GetNoteShares(userID, noteID int) ([]*models.NoteShare, error) {
+	if err := m.require(userID, noteID, models.ShareOwner); err != nil {
+		return nil, err
+	}
+	shares := make([]*models.NoteShare, 0)
+	for id, permission := range m.shares {
+		shares = append(shares, &models.NoteShare{NoteID: noteID, UserID: id, Permission: permission})
+	}
+	return shares, nil
+}
+
+func (m *mockNoteStore) RevokeNoteShare(userID, noteID, shareUserID int) error {
+	if shareUserID != userID {
+		if err := m.require(userID, noteID, models.ShareOwner); err != nil {
+			return err
+		}
+	}
+	if m.access(shareUserID, noteID) == "" || m.owns(shareUserID, noteID) {
+		return models.ErrShareNotFound
+	}
+	delete(m.shares, shareUserID)
+	return nil
+}
+
+func (m *mockNoteStore) GetSharedNotes(userID int) ([]*models.Note, error) {
+	notes := make([]*models.Note, 0)
+	if permission, ok := m.shares[userID]; ok {
+		notes = append(notes, &models.Note{ID: 42, Title: "groceries", UserID: 1, Permission: permission})
+	}
+	return notes, nil
+}
+
+func (m *mockNoteStore) CreateNoteLink(userID int, link *models.NoteLink) error {
+	if err := m.require(userID, link.NoteID, models.ShareOwner); err != nil {
+		return err
+	}
+	link.ID = len(m.links) + 1
+	link.HasPassword = link.PasswordHash != ""
+	link.CreatedAt = time.Now()
+	m.links = append(m.links, link)
 	return nil
 }
+
+func (m *mockNoteStore) GetNoteLinks(userID, noteID int) ([]*models.NoteLink, error) {
+	if err := m.require(userID, noteID, models.ShareOwner); err != nil {
+		return nil, err
+	}
+	links := make([]*models.NoteLink, 0)
+	for _, link := range m.links {
+		if link != nil && link.NoteID == noteID {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (m *mockNoteStore) DeleteNoteLink(userID, noteID, linkID int) error {
+	if err := m.require(userID, noteID, models.ShareOwner); err != nil {
+		return err
+	}
+	if linkID < 1 || linkID > len(m.links) || m.links[linkID-1] == nil || m.links[linkID-1].NoteID != noteID {
+		return models.ErrLinkNotFound
+	}
+	m.links[linkID-1] = nil
+	return nil
+}
+
+func (m *mockNoteStore) GetNoteLinkByToken(tokenHash string) (*models.NoteLink, error) {
+	for _, link := range m.links {
+		if link != nil && link.TokenHash == tokenHash {
+			return link, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockNoteStore) ViewNoteLink(linkID int) (*models.PublicNote, error) {
+	link := m.links[linkID-1]
+	link.Views++
+	return &models.PublicNote{Title: "groceries", Description: "milk"}, nil
+}
@@ -0,0 +1,234 @@
+package notebook
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/service/notebook"
+
+	"github.com/gorilla/mux"
+)
+
+func TestNotebookServiceHandlers(t *testing.T) {
+	notebookStore := &mockNotebookStore{}
+	handler := notebook.NewHandler(notebookStore)
+
+	t.Run("should handle creating a notebook", func(t *testing.T) {
+		parentID := 1
+		marshalled, err := json.Marshal(models.NotebookPayload{Name: "work", ParentID: &parentID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/notebooks", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notebooks", handler.HandleCreateNotebook).Methods(http.MethodPost)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusCreated {
+			t.Errorf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+	})
+
+	t.Run("should fail creating a notebook under a missing parent", func(t *testing.T) {
+		parentID := 99
+		marshalled, err := json.Marshal(models.NotebookPayload{Name: "work", ParentID: &parentID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/notebooks", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notebooks", handler.HandleCreateNotebook).Methods(http.MethodPost)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should fail moving a notebook into its own subtree", func(t *testing.T) {
+		parentID := 2
+		marshalled, err := json.Marshal(models.NotebookPayload{Name: "work", ParentID: &parentID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPut, "/notebooks/1", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notebooks/{id}", handler.HandleUpdateNotebook).Methods(http.MethodPut)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should return the notebook subtree", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/notebooks/1?descendants=true", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notebooks/{id}", handler.HandleGetNotebookByID).Methods(http.MethodGet)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var body struct {
+			Data models.Notebook `json:"data"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Data.Children) != 1 || body.Data.Children[0].ID != 2 {
+			t.Errorf("expected child notebook 2, got %+v", body.Data.Children)
+		}
+	})
+
+	t.Run("should handle deleting a notebook", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/notebooks/{id}", handler.HandleDeleteNotebook).Methods(http.MethodDelete)
+
+		cases := []struct {
+			query string
+			code  int
+			mode  string
+		}{
+			{"", http.StatusOK, models.NotebookDeleteRehome},
+			{"?notes=cascade", http.StatusOK, models.NotebookDeleteCascade},
+			{"?notes=trash", http.StatusBadRequest, ""},
+		}
+		for _, c := range cases {
+			notebookStore.lastDeleteMode = ""
+
+			req, err := http.NewRequest(http.MethodDelete, "/notebooks/1"+c.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = withUser(req, 1)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != c.code {
+				t.Errorf("%q: expected status code %d, got %d", c.query, c.code, rr.Code)
+			}
+			if notebookStore.lastDeleteMode != c.mode {
+				t.Errorf("%q: expected delete mode %q, got %q", c.query, c.mode, notebookStore.lastDeleteMode)
+			}
+		}
+	})
+
+	t.Run("should not find notebooks owned by another user", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/notebooks/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 2)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/notebooks/{id}", handler.HandleGetNotebookByID).Methods(http.MethodGet)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func withUser(req *http.Request, userID int) *http.Request {
+	ctx := context.WithValue(req.Context(), middlewares.UserKey, userID)
+	return req.WithContext(ctx)
+}
+
+// mockNotebookStore gives user 1 notebook 1 with a single child, notebook 2.
+type mockNotebookStore struct {
+	lastDeleteMode string
+}
+
+func (m *mockNotebookStore) owns(userID, id int) bool {
+	return userID == 1 && (id == 1 || id == 2)
+}
+
+func (m *mockNotebookStore) CreateNotebook(userID int, notebook *models.NotebookPayload) error {
+	if notebook.ParentID != nil && !m.owns(userID, *notebook.ParentID) {
+		return models.ErrNotebookNotFound
+	}
+	return nil
+}
+
+func (m *mockNotebookStore) GetNotebooks(userID int) ([]*models.Notebook, error) {
+	return []*models.Notebook{}, nil
+}
+
+func (m *mockNotebookStore) GetNotebookByID(userID, id int, descendants bool) (*models.Notebook, error) {
+	if !m.owns(userID, id) {
+		return nil, sql.ErrNoRows
+	}
+	notebook := &models.Notebook{ID: id, UserID: userID}
+	if descendants && id == 1 {
+		parentID := 1
+		notebook.Children = []*models.Notebook{{ID: 2, UserID: userID, ParentID: &parentID}}
+	}
+	return notebook, nil
+}
+
+func (m *mockNotebookStore) UpdateNotebook(userID, id int, notebook *models.NotebookPayload) error {
+	if !m.owns(userID, id) {
+		return sql.ErrNoRows
+	}
+	if notebook.ParentID != nil && id == 1 && (*notebook.ParentID == 1 || *notebook.ParentID == 2) {
+		return models.ErrNotebookCycle
+	}
+	return nil
+}
+
+func (m *mockNotebookStore) DeleteNotebook(userID, id int, mode string) error {
+	if !m.owns(userID, id) {
+		return sql.ErrNoRows
+	}
+	m.lastDeleteMode = mode
+	return nil
+}
@@ -0,0 +1,281 @@
+package tag
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/service/tag"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTagServiceHandlers(t *testing.T) {
+	tagStore := &mockTagStore{}
+	handler := tag.NewHandler(tagStore)
+
+	t.Run("should handle get tags", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/tags", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/tags", handler.HandleGetTags).Methods(http.MethodGet)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("should handle creating a tag", func(t *testing.T) {
+		marshalled, err := json.Marshal(models.TagPayload{Name: " work "})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/tags", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/tags", handler.HandleCreateTag).Methods(http.MethodPost)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusCreated {
+			t.Errorf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+		if tagStore.lastName != "work" {
+			t.Errorf("expected tag name to be trimmed, got %q", tagStore.lastName)
+		}
+	})
+
+	t.Run("should conflict when renaming onto an existing tag", func(t *testing.T) {
+		marshalled, err := json.Marshal(models.TagPayload{Name: "taken"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPut, "/tags/1", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/tags/{id}", handler.HandleUpdateTag).Methods(http.MethodPut)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected status code %d, got %d", http.StatusConflict, rr.Code)
+		}
+	})
+
+	t.Run("should handle merging tags", func(t *testing.T) {
+		marshalled, err := json.Marshal(models.TagMergePayload{Into: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/tags/1/merge", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/tags/{id}/merge", handler.HandleMergeTag).Methods(http.MethodPost)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("should fail merging a tag into itself", func(t *testing.T) {
+		marshalled, err := json.Marshal(models.TagMergePayload{Into: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/tags/1/merge", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 1)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/tags/{id}/merge", handler.HandleMergeTag).Methods(http.MethodPost)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should not find tags owned by another user", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodDelete, "/tags/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = withUser(req, 2)
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/tags/{id}", handler.HandleDeleteTag).Methods(http.MethodDelete)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should check workspace membership for workspace tags", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.HandleFunc("/tags", handler.HandleGetTags).Methods(http.MethodGet)
+		router.HandleFunc("/tags/{id}", handler.HandleGetTagByID).Methods(http.MethodGet)
+		router.HandleFunc("/tags/{id}", handler.HandleDeleteTag).Methods(http.MethodDelete)
+		router.HandleFunc("/tags/{id}/merge", handler.HandleMergeTag).Methods(http.MethodPost)
+
+		cases := []struct {
+			name     string
+			method   string
+			path     string
+			userID   int
+			body     interface{}
+			expected int
+		}{
+			{"viewer lists workspace tags", http.MethodGet, "/tags?workspace_id=1", 2, nil, http.StatusOK},
+			{"non-member lists workspace tags", http.MethodGet, "/tags?workspace_id=1", 3, nil, http.StatusNotFound},
+			{"malformed workspace", http.MethodGet, "/tags?workspace_id=one", 1, nil, http.StatusBadRequest},
+			{"viewer reads a workspace tag", http.MethodGet, "/tags/3", 2, nil, http.StatusOK},
+			{"non-member reads a workspace tag", http.MethodGet, "/tags/3", 3, nil, http.StatusNotFound},
+			{"viewer deletes a workspace tag", http.MethodDelete, "/tags/3", 2, nil, http.StatusForbidden},
+			{"editor deletes a workspace tag", http.MethodDelete, "/tags/3", 1, nil, http.StatusOK},
+			{"merge across owners", http.MethodPost, "/tags/1/merge", 1, models.TagMergePayload{Into: 3}, http.StatusBadRequest},
+		}
+		for _, c := range cases {
+			var body bytes.Buffer
+			if c.body != nil {
+				if err := json.NewEncoder(&body).Encode(c.body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			req := withUser(httptest.NewRequest(c.method, c.path, &body), c.userID)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != c.expected {
+				t.Errorf("%s: expected status code %d, got %d", c.name, c.expected, rr.Code)
+			}
+		}
+	})
+}
+
+func withUser(req *http.Request, userID int) *http.Request {
+	ctx := context.WithValue(req.Context(), middlewares.UserKey, userID)
+	return req.WithContext(ctx)
+}
+
+// mockTagStore owns tag IDs 1 and 2 for user 1. Tag 3 belongs to
+// workspace 1, where user 1 is an editor and user 2 a viewer. The name
+// "taken" is already in use.
+type mockTagStore struct {
+	lastName string
+}
+
+var mockWorkspaceRoles = map[int]string{1: models.WorkspaceEditor, 2: models.WorkspaceViewer}
+
+// access mirrors the store's role checks: personal tags are their owner's,
+// tag 3 needs a high enough role in workspace 1.
+func (m *mockTagStore) access(userID, id int, need string) error {
+	switch {
+	case id == 3 && mockWorkspaceRoles[userID] == "":
+		return sql.ErrNoRows
+	case id == 3 && !models.WorkspaceRolePermits(mockWorkspaceRoles[userID], need):
+		return models.ErrWorkspaceRole
+	case id == 3 || m.owns(userID, id):
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockTagStore) owns(userID, id int) bool {
+	return userID == 1 && (id == 1 || id == 2)
+}
+
+func (m *mockTagStore) CreateTag(userID int, tag *models.TagPayload) error {
+	m.lastName = tag.Name
+	if tag.Name == "taken" {
+		return models.ErrTagExists
+	}
+	return nil
+}
+
+func (m *mockTagStore) GetTags(userID int, workspaceID *int) ([]*models.Tag, error) {
+	if workspaceID != nil && (*workspaceID != 1 || mockWorkspaceRoles[userID] == "") {
+		return nil, models.ErrWorkspaceNotFound
+	}
+	return []*models.Tag{}, nil
+}
+
+func (m *mockTagStore) GetTagByID(userID, id int) (*models.Tag, error) {
+	if err := m.access(userID, id, models.WorkspaceViewer); err != nil {
+		return nil, err
+	}
+	return &models.Tag{ID: id, UserID: userID}, nil
+}
+
+func (m *mockTagStore) UpdateTag(userID, id int, tag *models.TagPayload) error {
+	if err := m.access(userID, id, models.WorkspaceEditor); err != nil {
+		return err
+	}
+	if tag.Name == "taken" {
+		return models.ErrTagExists
+	}
+	return nil
+}
+
+func (m *mockTagStore) DeleteTag(userID, id int) error {
+	return m.access(userID, id, models.WorkspaceEditor)
+}
+
+func (m *mockTagStore) MergeTags(userID, sourceID, targetID int) error {
+	if err := m.access(userID, sourceID, models.WorkspaceEditor); err != nil {
+		return err
+	}
+	if err := m.access(userID, targetID, models.WorkspaceEditor); err != nil {
+		return err
+	}
+	if (sourceID == 3) != (targetID == 3) {
+		return models.ErrTagScope
+	}
+	return nil
+}
@@ -2,20 +2,27 @@ package note
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"go-note/middlewares"
 	"go-note/models"
 	"go-note/service/auth"
+	"go-note/service/user"
+	"go-note/utils"
 
 	"github.com/gorilla/mux"
 )
 
 func TestUserServiceHandlers(t *testing.T) {
 	userStore := &mockUserStore{}
-	handler := auth.NewHandler(userStore)
+	handler := auth.NewHandler(userStore, nil, nil)
 
 	t.Run("should fail creating a user if the payload is missing", func(t *testing.T) {
 		req, err := http.NewRequest(http.MethodPost, "/auth/register", nil)
@@ -66,6 +73,324 @@ func TestUserServiceHandlers(t *testing.T) {
 
 }
 
+func TestProfileHandlers(t *testing.T) {
+	profiles := newMockProfileStore()
+	tokens := &mockPersonalTokenStore{}
+	handler := user.NewHandler(nil, profiles, tokens, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/me", handler.HandleGetMe).Methods(http.MethodGet)
+	router.HandleFunc("/me", handler.HandleUpdateMe).Methods(http.MethodPatch)
+	router.HandleFunc("/me/password", handler.HandleChangePassword).Methods(http.MethodPut)
+	router.HandleFunc("/me/tokens", handler.HandleGetTokens).Methods(http.MethodGet)
+	router.HandleFunc("/me/tokens", handler.HandleCreateToken).Methods(http.MethodPost)
+	router.HandleFunc("/me/tokens/{id}", handler.HandleDeleteToken).Methods(http.MethodDelete)
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	request := func(method, path, body string) *http.Request {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.WithValue(req.Context(), middlewares.UserKey, 1)
+		ctx = context.WithValue(ctx, middlewares.RoleKey, models.RoleMember)
+		return req.WithContext(ctx)
+	}
+
+	t.Run("should return the current user without the password", func(t *testing.T) {
+		rr := serve(request(http.MethodGet, "/me", ""))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if strings.Contains(rr.Body.String(), "password\"") {
+			t.Errorf("expected no password in %s", rr.Body.String())
+		}
+	})
+
+	t.Run("should require an authenticated user", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/me", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := serve(req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	t.Run("should update the username only", func(t *testing.T) {
+		rr := serve(request(http.MethodPatch, "/me", `{"username": " renamed "}`))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		u := profiles.users[1]
+		if u.Username != "renamed" || u.Email != "test@mail.com" {
+			t.Errorf("unexpected profile %q %q", u.Username, u.Email)
+		}
+	})
+
+	t.Run("should reject invalid or taken emails", func(t *testing.T) {
+		rr := serve(request(http.MethodPatch, "/me", `{"email": "not-an-email"}`))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		rr = serve(request(http.MethodPatch, "/me", `{"email": "taken@mail.com"}`))
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected status code %d, got %d", http.StatusConflict, rr.Code)
+		}
+	})
+
+	t.Run("should require the current password to change it", func(t *testing.T) {
+		rr := serve(request(http.MethodPut, "/me/password", `{"current_password": "wrong", "new_password": "abcdef"}`))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		rr = serve(request(http.MethodPut, "/me/password", `{"current_password": "123456", "new_password": "abcdef"}`))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if !utils.ComparePasswords(profiles.users[1].Password, []byte("abcdef")) {
+			t.Errorf("expected the new password to be stored")
+		}
+	})
+}
+
+func TestSessionHandlers(t *testing.T) {
+	sessions := &mockSessionStore{sessions: []*models.Session{
+		{ID: 1, UserID: 1, Device: "Firefox on Linux"},
+		{ID: 2, UserID: 1, Device: "Safari on iOS"},
+		{ID: 3, UserID: 1, Device: "Chrome on Windows"},
+		{ID: 4, UserID: 2, Device: "Edge on Windows"},
+	}}
+	handler := user.NewHandler(nil, nil, nil, sessions)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/me/sessions", handler.HandleGetSessions).Methods(http.MethodGet)
+	router.HandleFunc("/me/sessions", handler.HandleDeleteOtherSessions).Methods(http.MethodDelete)
+	router.HandleFunc("/me/sessions/{id}", handler.HandleDeleteSession).Methods(http.MethodDelete)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.WithValue(req.Context(), middlewares.UserKey, 1)
+		ctx = context.WithValue(ctx, middlewares.SessionKey, 1)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req.WithContext(ctx))
+		return rr
+	}
+
+	list := func() []*models.Session {
+		rr := serve(http.MethodGet, "/me/sessions")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var response struct {
+			Data []*models.Session `json:"data"`
+		}
+		json.NewDecoder(rr.Body).Decode(&response)
+		return response.Data
+	}
+
+	t.Run("should list the user's sessions marking the current one", func(t *testing.T) {
+		got := list()
+		if len(got) != 3 || !got[0].Current || got[1].Current {
+			t.Errorf("expected three sessions with the first current, got %+v", got)
+		}
+	})
+
+	t.Run("should sign out one session", func(t *testing.T) {
+		if rr := serve(http.MethodDelete, "/me/sessions/4"); rr.Code != http.StatusNotFound {
+			t.Errorf("expected another user's session to be %d, got %d", http.StatusNotFound, rr.Code)
+		}
+
+		if rr := serve(http.MethodDelete, "/me/sessions/2"); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if got := list(); len(got) != 2 {
+			t.Errorf("expected two sessions left, got %d", len(got))
+		}
+	})
+
+	t.Run("should sign out everywhere else", func(t *testing.T) {
+		rr := serve(http.MethodDelete, "/me/sessions")
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"revoked":1`) {
+			t.Fatalf("expected one session signed out, got %d %s", rr.Code, rr.Body.String())
+		}
+
+		got := list()
+		if len(got) != 1 || got[0].ID != 1 {
+			t.Errorf("expected only the current session left, got %+v", got)
+		}
+	})
+}
+
+func TestPersonalTokenHandlers(t *testing.T) {
+	tokens := &mockPersonalTokenStore{}
+	handler := user.NewHandler(nil, nil, tokens, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/me/tokens", handler.HandleGetTokens).Methods(http.MethodGet)
+	router.HandleFunc("/me/tokens", handler.HandleCreateToken).Methods(http.MethodPost)
+	router.HandleFunc("/me/tokens/{id}", handler.HandleDeleteToken).Methods(http.MethodDelete)
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.WithValue(req.Context(), middlewares.UserKey, 1)
+		ctx = context.WithValue(ctx, middlewares.RoleKey, models.RoleMember)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req.WithContext(ctx))
+		return rr
+	}
+
+	t.Run("should create a scoped token and show it once", func(t *testing.T) {
+		rr := serve(http.MethodPost, "/me/tokens", `{"name": " ci ", "scopes": ["notes:read", "notes:read"]}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+
+		var response struct {
+			Data struct {
+				Token  string   `json:"token"`
+				Name   string   `json:"name"`
+				Scopes []string `json:"scopes"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(response.Data.Token, models.PersonalTokenPrefix) || response.Data.Name != "ci" || len(response.Data.Scopes) != 1 {
+			t.Errorf("unexpected token %+v", response.Data)
+		}
+		if len(tokens.created) != 1 || tokens.created[0].TokenHash != utils.HashToken(response.Data.Token) {
+			t.Errorf("expected only the hash of the token to be stored")
+		}
+
+		rr = serve(http.MethodGet, "/me/tokens", "")
+		if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), models.PersonalTokenPrefix) {
+			t.Errorf("expected the list to leave out tokens, got %d %s", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("should refuse scopes the role does not grant", func(t *testing.T) {
+		rr := serve(http.MethodPost, "/me/tokens", `{"name": "ci", "scopes": ["admin"]}`)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should refuse expiry in the past", func(t *testing.T) {
+		rr := serve(http.MethodPost, "/me/tokens", `{"name": "ci", "scopes": ["notes:read"], "expires_at": "2000-01-01T00:00:00Z"}`)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should revoke a token", func(t *testing.T) {
+		rr := serve(http.MethodDelete, "/me/tokens/1", "")
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		rr = serve(http.MethodDelete, "/me/tokens/1", "")
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+// mockPersonalTokenStore keeps the tokens of user 1.
+type mockPersonalTokenStore struct {
+	created []*models.PersonalAccessToken
+}
+
+func (m *mockPersonalTokenStore) CreatePersonalToken(token *models.PersonalAccessToken) error {
+	token.ID = len(m.created) + 1
+	m.created = append(m.created, token)
+	return nil
+}
+
+func (m *mockPersonalTokenStore) GetPersonalTokens(userID int) ([]*models.PersonalAccessToken, error) {
+	return m.created, nil
+}
+
+func (m *mockPersonalTokenStore) DeletePersonalToken(userID, id int) error {
+	for i, token := range m.created {
+		if token.ID == id && token.UserID == userID {
+			m.created = append(m.created[:i], m.created[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// mockProfileStore holds user 1, test@mail.com with password 123456. The
+// email taken@mail.com belongs to someone else.
+type mockProfileStore struct {
+	users map[int]*models.User
+}
+
+func newMockProfileStore() *mockProfileStore {
+	hashed, err := utils.HashPassword("123456")
+	if err != nil {
+		panic(err)
+	}
+
+	return &mockProfileStore{users: map[int]*models.User{
+		1: {ID: 1, Email: "test@mail.com", Username: "test", Password: hashed, Role: models.RoleMember},
+	}}
+}
+
+func (m *mockProfileStore) GetUserByID(id int) (*models.User, error) {
+	u, ok := m.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+func (m *mockProfileStore) UpdateProfile(id int, profile *models.UserProfilePatch) error {
+	u, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if profile.Email != nil {
+		if *profile.Email == "taken@mail.com" {
+			return models.ErrEmailExists
+		}
+		u.Email = *profile.Email
+	}
+	if profile.Username != nil {
+		u.Username = *profile.Username
+	}
+	return nil
+}
+
+func (m *mockProfileStore) UpdatePassword(id int, hashedPassword string, keepSessionID int) error {
+	u, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	u.Password = hashedPassword
+	return nil
+}
+
 type mockUserStore struct{}
 
 func (m *mockUserStore) CreateUser(user *models.UserRegisterPayload) error {
@@ -73,9 +398,49 @@ func (m *mockUserStore) CreateUser(user *models.UserRegisterPayload) error {
 }
 
 func (m *mockUserStore) GetUserByEmail(email string) (*models.User, error) {
-	return &models.User{}, nil
+	return nil, fmt.Errorf("user not found")
 }
 
 func (m *mockUserStore) GetUserByID(id int) (*models.User, error) {
 	return &models.User{}, nil
 }
+
+func (m *mockUserStore) MarkEmailVerified(id int, email string) error {
+	return nil
+}
+
+type mockSessionStore struct {
+	sessions []*models.Session
+}
+
+func (m *mockSessionStore) GetSessions(userID int) ([]*models.Session, error) {
+	sessions := make([]*models.Session, 0)
+	for _, session := range m.sessions {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *mockSessionStore) RevokeSession(userID, sessionID int) error {
+	for i, session := range m.sessions {
+		if session.ID == sessionID && session.UserID == userID {
+			m.sessions = append(m.sessions[:i], m.sessions[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockSessionStore) RevokeOtherSessions(userID, keepSessionID int) (int, error) {
+	kept := make([]*models.Session, 0)
+	for _, session := range m.sessions {
+		if session.UserID != userID || session.ID == keepSessionID {
+			kept = append(kept, session)
+		}
+	}
+	n := len(m.sessions) - len(kept)
+	m.sessions = kept
+	return n, nil
+}
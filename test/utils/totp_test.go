@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"go-note/utils"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to 6 digits.
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, want := range vectors {
+		got, err := utils.TOTPCode(secret, unix/utils.TOTPPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("T=%d: expected %s, got %s", unix, want, got)
+		}
+	}
+
+	t.Run("should accept one period of drift", func(t *testing.T) {
+		now := time.Unix(1111111111, 0)
+		code, err := utils.TOTPCode(secret, now.Unix()/utils.TOTPPeriod-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := utils.ValidateTOTP(secret, code, now); !ok {
+			t.Errorf("expected the previous code to be accepted")
+		}
+		if _, ok := utils.ValidateTOTP(secret, code, now.Add(2*utils.TOTPPeriod*time.Second)); ok {
+			t.Errorf("expected a stale code to be rejected")
+		}
+	})
+
+	t.Run("should build an otpauth URI", func(t *testing.T) {
+		uri := utils.TOTPURI("go-note", "test@mail.com", "ABC")
+		if !strings.HasPrefix(uri, "otpauth://totp/go-note:test@mail.com?") || !strings.Contains(uri, "secret=ABC") {
+			t.Errorf("unexpected URI %s", uri)
+		}
+	})
+}
+
+func TestSecretBox(t *testing.T) {
+	if _, err := utils.NewSecretBox("c2hvcnQ="); err == nil {
+		t.Error("expected a short key to be rejected")
+	}
+
+	box, err := utils.NewSecretBox("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := box.Seal("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "JBSWY3DPEHPK3PXP") {
+		t.Fatalf("expected the secret to be encrypted, got %q", sealed)
+	}
+
+	plaintext, wasSealed, err := box.Open(sealed)
+	if err != nil || !wasSealed || plaintext != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("expected the secret back, got %q, %v, %v", plaintext, wasSealed, err)
+	}
+
+	tampered := []byte(sealed)
+	tampered[len(tampered)-5] ^= 1
+	if _, _, err := box.Open(string(tampered)); err == nil {
+		t.Error("expected a tampered value to fail")
+	}
+
+	plaintext, wasSealed, err = box.Open("JBSWY3DPEHPK3PXP")
+	if err != nil || wasSealed || plaintext != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("expected legacy plaintext to pass through, got %q, %v, %v", plaintext, wasSealed, err)
+	}
+}
@@ -0,0 +1,413 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go-note/mailer"
+	"go-note/middlewares"
+	"go-note/models"
+	"go-note/service/workspace"
+
+	"github.com/gorilla/mux"
+)
+
+func TestWorkspaceHandlers(t *testing.T) {
+	store := newMockWorkspaceStore()
+	mail := &mockMailer{}
+	queue := mailer.NewQueue(10)
+	handler := workspace.NewHandler(store)
+	handler.SetMailer(mail)
+	handler.SetMailQueue(queue)
+	handler.SetInvitations("https://notes.example.com/join", time.Hour)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/workspaces", handler.HandleCreateWorkspace).Methods(http.MethodPost)
+	router.HandleFunc("/workspaces/invitations/accept", handler.HandleAcceptInvitation).Methods(http.MethodPost)
+	router.HandleFunc("/workspaces/{id}", handler.HandleGetWorkspace).Methods(http.MethodGet)
+	router.HandleFunc("/workspaces/{id}/members", handler.HandleGetMembers).Methods(http.MethodGet)
+	router.HandleFunc("/workspaces/{id}/members/{user:[0-9]+}", handler.HandleUpdateMemberRole).Methods(http.MethodPut)
+	router.HandleFunc("/workspaces/{id}/members/{user:[0-9]+}", handler.HandleRemoveMember).Methods(http.MethodDelete)
+	router.HandleFunc("/workspaces/{id}/members/me", handler.HandleLeaveWorkspace).Methods(http.MethodDelete)
+	router.HandleFunc("/workspaces/{id}/invitations", handler.HandleCreateInvitation).Methods(http.MethodPost)
+
+	serve := func(method, path string, userID int, payload interface{}) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		if payload != nil {
+			if err := json.NewEncoder(&body).Encode(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req := httptest.NewRequest(method, path, &body)
+		req = req.WithContext(context.WithValue(req.Context(), middlewares.UserKey, userID))
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	tokenPattern := regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+	t.Run("should make the creator the owner", func(t *testing.T) {
+		rr := serve(http.MethodPost, "/workspaces", 1, models.WorkspacePayload{Name: "  Team  "})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+
+		var body struct {
+			Data models.Workspace `json:"data"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Data.ID != 1 || body.Data.Name != "Team" || body.Data.Role != models.WorkspaceOwner {
+			t.Errorf("expected workspace 1 owned by the caller, got %+v", body.Data)
+		}
+	})
+
+	t.Run("should email invitations", func(t *testing.T) {
+		cases := []struct {
+			payload  models.WorkspaceInvitationPayload
+			expected int
+		}{
+			{models.WorkspaceInvitationPayload{Email: "bob@mail.com", Role: "superuser"}, http.StatusBadRequest},
+			{models.WorkspaceInvitationPayload{Email: "not an email", Role: models.WorkspaceEditor}, http.StatusBadRequest},
+			{models.WorkspaceInvitationPayload{Email: "alice@mail.com", Role: models.WorkspaceEditor}, http.StatusConflict},
+			{models.WorkspaceInvitationPayload{Email: "bob@mail.com", Role: models.WorkspaceEditor}, http.StatusAccepted},
+		}
+		for _, c := range cases {
+			if rr := serve(http.MethodPost, "/workspaces/1/invitations", 1, c.payload); rr.Code != c.expected {
+				t.Errorf("expected inviting %s as %s to give %d, got %d", c.payload.Email, c.payload.Role, c.expected, rr.Code)
+			}
+		}
+		queue.Close()
+
+		if len(mail.sent) != 1 || mail.sent[0].To != "bob@mail.com" || !strings.Contains(mail.sent[0].Body, "https://notes.example.com/join?token=") {
+			t.Fatalf("expected one invitation email to bob with a link, got %+v", mail.sent)
+		}
+		if strings.Contains(mail.sent[0].Body, store.invitations[0].TokenHash) {
+			t.Error("expected the email to carry the token, not its hash")
+		}
+		if store.invitations[0].Delivery != models.InvitationSent {
+			t.Errorf("expected the invitation to be marked sent, got %q", store.invitations[0].Delivery)
+		}
+
+		if rr := serve(http.MethodPost, "/workspaces/1/invitations", 2, models.WorkspaceInvitationPayload{Email: "carol@mail.com", Role: models.WorkspaceViewer}); rr.Code != http.StatusNotFound {
+			t.Errorf("expected a non-member invite to fail with %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should report invitations that could not be sent", func(t *testing.T) {
+		if rr := serve(http.MethodPost, "/workspaces/1/invitations", 1, models.WorkspaceInvitationPayload{Email: "carol@mail.com", Role: models.WorkspaceViewer}); rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected a closed queue to give %d, got %d", http.StatusServiceUnavailable, rr.Code)
+		}
+
+		failing := workspace.NewHandler(store)
+		failing.SetMailer(&mockMailer{err: errors.New("smtp: connection refused")})
+		failingQueue := mailer.NewQueue(10)
+		failing.SetMailQueue(failingQueue)
+		req := httptest.NewRequest(http.MethodPost, "/workspaces/1/invitations", strings.NewReader(`{"email": "dave@mail.com", "role": "viewer"}`))
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		req = req.WithContext(context.WithValue(req.Context(), middlewares.UserKey, 1))
+		rr := httptest.NewRecorder()
+		failing.HandleCreateInvitation(rr, req)
+		failingQueue.Close()
+
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status code %d, got %d", http.StatusAccepted, rr.Code)
+		}
+		for _, invitation := range store.invitations[1:] {
+			if invitation.Delivery != models.InvitationFailed {
+				t.Errorf("expected the invitation of %s to be marked failed, got %q", invitation.Email, invitation.Delivery)
+			}
+		}
+	})
+
+	t.Run("should only let the invited email join", func(t *testing.T) {
+		match := tokenPattern.FindStringSubmatch(mail.sent[0].Body)
+		if match == nil {
+			t.Fatalf("expected a token in %q", mail.sent[0].Body)
+		}
+		accept := models.AcceptInvitationPayload{Token: match[1]}
+
+		if rr := serve(http.MethodPost, "/workspaces/invitations/accept", 3, accept); rr.Code != http.StatusForbidden {
+			t.Errorf("expected another user to be refused with %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		rr := serve(http.MethodPost, "/workspaces/invitations/accept", 2, accept)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if store.workspaces[1][2] != models.WorkspaceEditor {
+			t.Errorf("expected bob to join as editor, got %q", store.workspaces[1][2])
+		}
+
+		if rr := serve(http.MethodPost, "/workspaces/invitations/accept", 2, accept); rr.Code != http.StatusNotFound {
+			t.Errorf("expected a used invitation to fail with %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should guard member roles", func(t *testing.T) {
+		if rr := serve(http.MethodPut, "/workspaces/1/members/1", 2, models.WorkspaceRolePayload{Role: models.WorkspaceViewer}); rr.Code != http.StatusForbidden {
+			t.Errorf("expected an editor changing roles to fail with %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if rr := serve(http.MethodPut, "/workspaces/1/members/1", 1, models.WorkspaceRolePayload{Role: models.WorkspaceAdmin}); rr.Code != http.StatusConflict {
+			t.Errorf("expected demoting the last owner to fail with %d, got %d", http.StatusConflict, rr.Code)
+		}
+		if rr := serve(http.MethodDelete, "/workspaces/1/members/1", 1, nil); rr.Code != http.StatusConflict {
+			t.Errorf("expected the last owner leaving to fail with %d, got %d", http.StatusConflict, rr.Code)
+		}
+		if rr := serve(http.MethodPut, "/workspaces/1/members/2", 1, models.WorkspaceRolePayload{Role: "boss"}); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected an unknown role to fail with %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if rr := serve(http.MethodPut, "/workspaces/1/members/2", 1, models.WorkspaceRolePayload{Role: models.WorkspaceViewer}); rr.Code != http.StatusOK {
+			t.Errorf("expected the owner to change roles, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should cut off removed members", func(t *testing.T) {
+		if rr := serve(http.MethodGet, "/workspaces/1/members", 2, nil); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := serve(http.MethodDelete, "/workspaces/1/members/2", 1, nil); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if rr := serve(http.MethodGet, "/workspaces/1", 2, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected a removed member to get %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if rr := serve(http.MethodDelete, "/workspaces/1/members/2", 1, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected removing twice to fail with %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should let members leave", func(t *testing.T) {
+		store.workspaces[1][3] = models.WorkspaceViewer
+
+		if rr := serve(http.MethodDelete, "/workspaces/1/members/me", 3, nil); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if _, ok := store.workspaces[1][3]; ok {
+			t.Error("expected carol to have left")
+		}
+		if rr := serve(http.MethodDelete, "/workspaces/1/members/me", 3, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected leaving twice to fail with %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if rr := serve(http.MethodDelete, "/workspaces/1/members/me", 1, nil); rr.Code != http.StatusConflict {
+			t.Errorf("expected the last owner to be kept with %d, got %d", http.StatusConflict, rr.Code)
+		}
+	})
+}
+
+// mockWorkspaceStore keeps member roles by workspace and user in memory.
+// Users 1 (alice), 2 (bob) and 3 (carol) exist.
+type mockWorkspaceStore struct {
+	workspaces  map[int]map[int]string
+	names       map[int]string
+	invitations []*models.WorkspaceInvitation
+	emails      map[int]string
+}
+
+func newMockWorkspaceStore() *mockWorkspaceStore {
+	return &mockWorkspaceStore{
+		workspaces: make(map[int]map[int]string),
+		names:      make(map[int]string),
+		emails:     map[int]string{1: "alice@mail.com", 2: "bob@mail.com", 3: "carol@mail.com"},
+	}
+}
+
+func (m *mockWorkspaceStore) role(userID, id int, need string) (string, error) {
+	role := m.workspaces[id][userID]
+	if role == "" {
+		return "", models.ErrWorkspaceNotFound
+	}
+	if !models.WorkspaceRolePermits(role, need) {
+		return role, models.ErrWorkspaceRole
+	}
+	return role, nil
+}
+
+func (m *mockWorkspaceStore) owners(id int) int {
+	owners := 0
+	for _, role := range m.workspaces[id] {
+		if role == models.WorkspaceOwner {
+			owners++
+		}
+	}
+	return owners
+}
+
+func (m *mockWorkspaceStore) CreateWorkspace(userID int, payload *models.WorkspacePayload) (*models.Workspace, error) {
+	id := len(m.workspaces) + 1
+	m.workspaces[id] = map[int]string{userID: models.WorkspaceOwner}
+	m.names[id] = payload.Name
+	return m.GetWorkspace(userID, id)
+}
+
+func (m *mockWorkspaceStore) GetWorkspaces(userID int) ([]*models.Workspace, error) {
+	workspaces := make([]*models.Workspace, 0)
+	for id := range m.workspaces {
+		if workspace, err := m.GetWorkspace(userID, id); err == nil {
+			workspaces = append(workspaces, workspace)
+		}
+	}
+	return workspaces, nil
+}
+
+func (m *mockWorkspaceStore) GetWorkspace(userID, id int) (*models.Workspace, error) {
+	role, err := m.role(userID, id, models.WorkspaceViewer)
+	if err != nil {
+		return nil, err
+	}
+	return &models.Workspace{ID: id, Name: m.names[id], Role: role, MemberCount: len(m.workspaces[id])}, nil
+}
+
+func (m *mockWorkspaceStore) UpdateWorkspace(userID, id int, payload *models.WorkspacePayload) error {
+	if _, err := m.role(userID, id, models.WorkspaceAdmin); err != nil {
+		return err
+	}
+	m.names[id] = payload.Name
+	return nil
+}
+
+func (m *mockWorkspaceStore) DeleteWorkspace(userID, id int) error {
+	if _, err := m.role(userID, id, models.WorkspaceOwner); err != nil {
+		return err
+	}
+	delete(m.workspaces, id)
+	return nil
+}
+
+func (m *mockWorkspaceStore) GetMembers(userID, id int) ([]*models.WorkspaceMember, error) {
+	if _, err := m.role(userID, id, models.WorkspaceViewer); err != nil {
+		return nil, err
+	}
+	members := make([]*models.WorkspaceMember, 0)
+	for memberID, role := range m.workspaces[id] {
+		members = append(members, &models.WorkspaceMember{UserID: memberID, Email: m.emails[memberID], Role: role})
+	}
+	return members, nil
+}
+
+func (m *mockWorkspaceStore) UpdateMemberRole(userID, id, memberID int, role string) error {
+	manager, err := m.role(userID, id, models.WorkspaceAdmin)
+	if err != nil {
+		return err
+	}
+	current, ok := m.workspaces[id][memberID]
+	switch {
+	case !ok:
+		return models.ErrMemberNotFound
+	case !models.WorkspaceRolePermits(manager, current) || !models.WorkspaceRolePermits(manager, role):
+		return models.ErrWorkspaceRole
+	case current == models.WorkspaceOwner && role != models.WorkspaceOwner && m.owners(id) == 1:
+		return models.ErrWorkspaceLastOwner
+	}
+	m.workspaces[id][memberID] = role
+	return nil
+}
+
+func (m *mockWorkspaceStore) RemoveMember(userID, id, memberID int) error {
+	need := models.WorkspaceViewer
+	if memberID != userID {
+		need = models.WorkspaceAdmin
+	}
+	manager, err := m.role(userID, id, need)
+	if err != nil {
+		return err
+	}
+	current, ok := m.workspaces[id][memberID]
+	switch {
+	case !ok:
+		return models.ErrMemberNotFound
+	case !models.WorkspaceRolePermits(manager, current):
+		return models.ErrWorkspaceRole
+	case current == models.WorkspaceOwner && m.owners(id) == 1:
+		return models.ErrWorkspaceLastOwner
+	}
+	delete(m.workspaces[id], memberID)
+	return nil
+}
+
+func (m *mockWorkspaceStore) CreateInvitation(userID int, invitation *models.WorkspaceInvitation) error {
+	manager, err := m.role(userID, invitation.WorkspaceID, models.WorkspaceAdmin)
+	if err != nil {
+		return err
+	}
+	if !models.WorkspaceRolePermits(manager, invitation.Role) {
+		return models.ErrWorkspaceRole
+	}
+	for memberID := range m.workspaces[invitation.WorkspaceID] {
+		if strings.EqualFold(m.emails[memberID], invitation.Email) {
+			return models.ErrAlreadyMember
+		}
+	}
+	invitation.ID = len(m.invitations) + 1
+	invitation.InvitedBy = userID
+	invitation.Delivery = models.InvitationQueued
+	stored := *invitation
+	m.invitations = append(m.invitations, &stored)
+	return nil
+}
+
+func (m *mockWorkspaceStore) GetInvitations(userID, id int) ([]*models.WorkspaceInvitation, error) {
+	if _, err := m.role(userID, id, models.WorkspaceAdmin); err != nil {
+		return nil, err
+	}
+	return m.invitations, nil
+}
+
+func (m *mockWorkspaceStore) SetInvitationDelivery(tokenHash, delivery string) error {
+	for _, invitation := range m.invitations {
+		if invitation != nil && invitation.TokenHash == tokenHash {
+			invitation.Delivery = delivery
+		}
+	}
+	return nil
+}
+
+func (m *mockWorkspaceStore) DeleteInvitation(userID, id, invitationID int) error {
+	if _, err := m.role(userID, id, models.WorkspaceAdmin); err != nil {
+		return err
+	}
+	return models.ErrInvitationNotFound
+}
+
+func (m *mockWorkspaceStore) AcceptInvitation(userID int, tokenHash string) (*models.Workspace, error) {
+	for i, invitation := range m.invitations {
+		if invitation == nil || invitation.TokenHash != tokenHash || !invitation.ExpiresAt.After(time.Now()) {
+			continue
+		}
+		if !strings.EqualFold(m.emails[userID], invitation.Email) {
+			return nil, models.ErrInvitationEmail
+		}
+		if _, ok := m.workspaces[invitation.WorkspaceID][userID]; !ok {
+			m.workspaces[invitation.WorkspaceID][userID] = invitation.Role
+		}
+		m.invitations[i] = &models.WorkspaceInvitation{}
+		return m.GetWorkspace(userID, invitation.WorkspaceID)
+	}
+	return nil, models.ErrInvitationNotFound
+}
+
+// mockMailer keeps sent messages instead of delivering them, or fails with
+// err when it is set.
+type mockMailer struct {
+	sent []*mailer.Message
+	err  error
+}
+
+func (m *mockMailer) Send(msg *mailer.Message) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// sealedPrefix marks values sealed by SecretBox, telling them apart from
+// plaintext stored before encryption was introduced.
+const sealedPrefix = "v1:"
+
+// SecretBox encrypts small secrets, such as TOTP secrets, for storage with
+// AES-256-GCM under a server key.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox takes a 32-byte key, base64 encoded.
+func NewSecretBox(encodedKey string) (*SecretBox, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+	if err != nil {
+		return nil, fmt.Errorf("key is not base64: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretBox{aead: aead}, nil
+}
+
+// Seal encrypts plaintext under a random nonce.
+func (b *SecretBox) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value from Seal. Values without the sealed prefix are
+// returned as they are, with sealed false, so they can be sealed later.
+func (b *SecretBox) Open(value string) (plaintext string, sealed bool, err error) {
+	encoded, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		return value, false, nil
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", true, err
+	}
+	if len(data) < b.aead.NonceSize() {
+		return "", true, fmt.Errorf("sealed value too short")
+	}
+
+	nonce, ciphertext := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	opened, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", true, err
+	}
+
+	return string(opened), true, nil
+}
@@ -1,13 +1,23 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -28,6 +38,14 @@ func GetQueryID(r *http.Request) (int, error) {
 	return id, nil
 }
 
+// Pagination is the paging metadata attached to list responses.
+// NextCursor is empty on the last page.
+type Pagination struct {
+	NextCursor string `json:"next_cursor"`
+	Count      int    `json:"count"`
+	Total      int    `json:"total"`
+}
+
 func ResponseJSON(w http.ResponseWriter, code int, message string, data interface{}) {
 	response := make(map[string]interface{})
 	response["message"] = message
@@ -36,6 +54,23 @@ func ResponseJSON(w http.ResponseWriter, code int, message string, data interfac
 		response["data"] = data
 	}
 
+	writeJSON(w, code, response)
+}
+
+// ResponsePageJSON writes the same envelope as ResponseJSON with the paging
+// metadata alongside data.
+func ResponsePageJSON(w http.ResponseWriter, code int, message string, data interface{}, page Pagination) {
+	response := make(map[string]interface{})
+	response["message"] = message
+	response["data"] = data
+	response["next_cursor"] = page.NextCursor
+	response["count"] = page.Count
+	response["total"] = page.Total
+
+	writeJSON(w, code, response)
+}
+
+func writeJSON(w http.ResponseWriter, code int, response map[string]interface{}) {
 	jsonData, err := json.Marshal(response)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -84,3 +119,90 @@ func ComparePasswords(hashed string, plain []byte) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hashed), plain)
 	return err == nil
 }
+
+// IsUniqueViolation reports whether err is a Postgres unique constraint
+// violation.
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// GetEnvDuration parses the environment variable key as a time.Duration,
+// returning fallback when it is unset.
+func GetEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration such as 720h, got %q", key, value)
+	}
+
+	return d, nil
+}
+
+// GetEnvInt parses the environment variable key as a positive integer,
+// returning fallback when it is unset.
+func GetEnvInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer, got %q", key, value)
+	}
+
+	return n, nil
+}
+
+// RandomToken returns n random bytes encoded as unpadded base64url, for use
+// as an opaque bearer secret.
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex SHA-256 of an opaque token. Only hashes of
+// tokens are stored so a database leak doesn't hand out live credentials.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// trustProxy makes ClientIP believe X-Forwarded-For, which is only safe
+// behind a single reverse proxy that appends to the header.
+var trustProxy bool
+
+// SetTrustProxy sets whether ClientIP reads X-Forwarded-For.
+func SetTrustProxy(trust bool) {
+	trustProxy = trust
+}
+
+// ClientIP returns the address of the client that sent r: the entry the
+// proxy appended to X-Forwarded-For when proxies are trusted, the peer
+// address otherwise. Earlier entries are client-supplied and ignored.
+func ClientIP(r *http.Request) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			entries := strings.Split(forwarded, ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}